@@ -0,0 +1,38 @@
+package tdigest
+
+// quantileAlert is a rule registered by OnQuantileExceed.
+type quantileAlert struct {
+	q, threshold float64
+	cb           func(value float64)
+	exceeded     bool // whether the last check was above threshold
+}
+
+// OnQuantileExceed registers cb to be called with quantile q whenever it rises
+// above threshold. The rule is checked each time buffered values are merged,
+// that is once per buffer's worth of adds or on the next query, so it costs
+// one quantile lookup per merge rather than per add. It is edge-triggered: cb
+// fires when the quantile crosses from at or below threshold to above it, and
+// then not again until the quantile has come back down.
+//
+// cb runs synchronously inside Add or the query that merged the values, and
+// must not add to t or register rules. Rules are not cloned or serialized,
+// and Clear keeps them but re-arms them.
+func (t *TDigest) OnQuantileExceed(q, threshold float64, cb func(value float64)) {
+	t.alerts = append(t.alerts, quantileAlert{q: q, threshold: threshold, cb: cb})
+}
+
+// checkAlerts evaluates the registered rules against the processed
+// centroids, whose cumulative weights must be current.
+func (t *TDigest) checkAlerts() {
+	for i := range t.alerts {
+		a := &t.alerts[i]
+		v := t.quantile(a.q)
+		exceeded := v > a.threshold
+		if exceeded && !a.exceeded {
+			a.exceeded = true
+			a.cb(v)
+			continue
+		}
+		a.exceeded = exceeded
+	}
+}
@@ -0,0 +1,58 @@
+package tdigest
+
+import "testing"
+
+func TestOnQuantileExceed(t *testing.T) {
+	td := NewWithDecay(100, 0.5, 2000)
+	var fired []float64
+	td.OnQuantileExceed(0.99, 500, func(v float64) { fired = append(fired, v) })
+
+	add := func(x float64, n int) {
+		for i := 0; i < n; i++ {
+			td.Add(x, 1)
+		}
+	}
+	add(100, 1000)
+	if td.Quantile(0.99); len(fired) != 0 {
+		t.Fatalf("fired below the threshold: %v", fired)
+	}
+
+	// A sustained slow tail crosses the threshold once, however many merges
+	// it stays above for.
+	add(1000, 500)
+	td.ProcessNow()
+	if len(fired) != 1 || !(fired[0] > 500) {
+		t.Fatalf("unexpected alerts after crossing, got %v", fired)
+	}
+	add(1000, 500)
+	td.Quantile(0.5)
+	if len(fired) != 1 {
+		t.Errorf("fired again while above the threshold: %v", fired)
+	}
+
+	// Decay lets the fast values take over and re-arms the rule.
+	add(100, 20000)
+	td.ProcessNow()
+	if got := td.Quantile(0.99); got > 500 {
+		t.Fatalf("tail did not recover, p99 %g", got)
+	}
+	add(1000, 20000)
+	td.ProcessNow()
+	if len(fired) != 2 {
+		t.Errorf("unexpected alerts after a second crossing, got %v", fired)
+	}
+
+	// Clones do not carry the rule; clearing re-arms it.
+	clone := td.Clone()
+	clone.Add(-1, 1)
+	clone.ProcessNow()
+	if len(fired) != 2 {
+		t.Errorf("clone fired the rule: %v", fired)
+	}
+	td.ClearKeepingCapacity()
+	add(1000, 10)
+	td.ProcessNow()
+	if len(fired) != 3 || fired[2] != 1000 {
+		t.Errorf("unexpected alerts after clearing, got %v", fired)
+	}
+}
@@ -2,12 +2,54 @@ package tdigest
 
 import (
 	"fmt"
+	"math"
 	"sort"
 )
 
 // ErrWeightLessThanZero is used when the weight is not able to be processed.
 const ErrWeightLessThanZero = Error("centroid weight cannot be less than zero")
 
+// ErrInvalidMean is used when a centroid mean is NaN or infinite.
+const ErrInvalidMean = Error("centroid mean must be finite")
+
+// ErrInvalidWeight is used when a centroid weight is not positive and finite.
+const ErrInvalidWeight = Error("centroid weight must be positive and finite")
+
+// ErrUnsortedCentroids is used when centroid means are not in ascending order.
+const ErrUnsortedCentroids = Error("centroid means are not in ascending order")
+
+// ErrInvalidFactor is used when a weight scale factor is not positive and finite.
+const ErrInvalidFactor = Error("scale factor must be positive and finite")
+
+// ErrInvalidCompression is used when a compression is not positive and finite.
+const ErrInvalidCompression = Error("compression must be positive and finite")
+
+// ErrWeightOverflow is used when adding a weight would make the total infinite.
+const ErrWeightOverflow = Error("total weight would overflow")
+
+// ErrInconsistentWeight is used when a digest's recorded weights disagree with
+// its centroids.
+const ErrInconsistentWeight = Error("recorded weight does not match centroids")
+
+// ErrInvalidQuantile is used when a quantile is outside [0, 1].
+const ErrInvalidQuantile = Error("quantile must be between 0 and 1")
+
+// ErrColumnLength is used when centroid mean and weight columns differ in length.
+const ErrColumnLength = Error("centroid columns must have equal lengths")
+
+// ErrChecksumMismatch is used when a checksummed encoding does not match its
+// checksum.
+const ErrChecksumMismatch = Error("data corruption detected: checksum mismatch")
+
+// ErrSizeBudget is used when a size budget cannot hold even a single centroid.
+const ErrSizeBudget = Error("size budget too small for a single centroid")
+
+// ErrUnknownScaler is used when a scaler name is not registered.
+const ErrUnknownScaler = Error("unknown scaler")
+
+// ErrUnknownDistribution is used when a distribution name is not supported.
+const ErrUnknownDistribution = Error("unknown distribution")
+
 // Error is a domain error encountered while processing tdigests
 type Error string
 
@@ -32,7 +74,14 @@ func (c *Centroid) Add(r Centroid) error {
 	}
 	if c.Weight != 0 {
 		c.Weight += r.Weight
-		c.Mean += r.Weight * (r.Mean - c.Mean) / c.Weight
+		m := c.Mean + r.Weight*(r.Mean-c.Mean)/c.Weight
+		if math.IsInf(m, 0) || math.IsNaN(m) {
+			// The means are too large to subtract or scale without
+			// overflow; weight each by its share instead.
+			f := r.Weight / c.Weight
+			m = c.Mean*(1-f) + r.Mean*f
+		}
+		c.Mean = m
 	} else {
 		c.Weight = r.Weight
 		c.Mean = r.Mean
@@ -40,16 +89,24 @@ func (c *Centroid) Add(r Centroid) error {
 	return nil
 }
 
-// CentroidList is sorted by the Mean of the centroid, ascending.
+// CentroidList is sorted by the Mean of the centroid, ascending. Centroids
+// with equal means are ordered by Weight, ascending, so that sorting is
+// deterministic.
 type CentroidList []Centroid
 
+// Clear empties l, keeping its capacity for reuse.
 func (l *CentroidList) Clear() {
 	*l = (*l)[0:0]
 }
 
-func (l CentroidList) Len() int           { return len(l) }
-func (l CentroidList) Less(i, j int) bool { return l[i].Mean < l[j].Mean }
-func (l CentroidList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l CentroidList) Len() int { return len(l) }
+func (l CentroidList) Less(i, j int) bool {
+	if l[i].Mean != l[j].Mean {
+		return l[i].Mean < l[j].Mean
+	}
+	return l[i].Weight < l[j].Weight
+}
+func (l CentroidList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
 
 // NewCentroidList creates a priority queue for the centroids
 func NewCentroidList(centroids []Centroid) CentroidList {
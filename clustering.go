@@ -0,0 +1,150 @@
+package tdigest
+
+import (
+	"math"
+	"sort"
+)
+
+// Algorithm selects how buffered values are folded into the centroids.
+type Algorithm int
+
+const (
+	// Merging sorts the buffer together with the existing centroids and
+	// merges them in a single pass. It is the default.
+	Merging Algorithm = iota
+
+	// Clustering adds buffered values one at a time, in arrival order, to
+	// the nearest centroid that still has room under the scaler's size bound,
+	// as in the original t-digest. It is slower to build than Merging but
+	// never re-sorts existing centroids. The centroids are recompressed with
+	// a merging pass when there are too many of them.
+	Clustering
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case Merging:
+		return "merging"
+	case Clustering:
+		return "clustering"
+	}
+	return "unknown"
+}
+
+func NewWithAlgorithm(compression float64, a Algorithm) *TDigest {
+	t := NewWithCompression(compression)
+	t.Algorithm = a
+	return t
+}
+
+// cluster adds each unprocessed centroid to the nearest processed centroid,
+// or inserts it as a new centroid if the nearest one is full.
+func (t *TDigest) cluster(updateCumulative bool) {
+	if t.exampleLimit > 0 {
+		t.padExamples()
+	}
+	var prefix weightTree
+	prefix.build(t.processed)
+	for i, c := range t.unprocessed {
+		t.processedWeight += c.Weight
+		var at int64
+		if t.keepTimes {
+			at = t.unprocessedTimes[i]
+		}
+		t.clusterCentroid(c, at, &prefix)
+	}
+	t.unprocessed.Clear()
+	t.unprocessedTimes = t.unprocessedTimes[:0]
+	t.unprocessedWeight = 0
+	t.processedWeight = sumWeights(t.processed)
+	if t.processed.Len() > 0 {
+		t.min = math.Min(t.min, t.processed[0].Mean)
+		t.max = math.Max(t.max, t.processed[t.processed.Len()-1].Mean)
+	}
+	if updateCumulative {
+		t.updateCumulative()
+	}
+}
+
+// clusterCentroid adds c, stamped at if timestamps are kept, keeping prefix
+// in step with the centroid weights.
+func (t *TDigest) clusterCentroid(c Centroid, at int64, prefix *weightTree) {
+	n := t.processed.Len()
+	i := sort.Search(n, func(i int) bool {
+		return t.processed[i].Mean >= c.Mean
+	})
+	j := i
+	if i == n || (i > 0 && c.Mean-t.processed[i-1].Mean <= t.processed[i].Mean-c.Mean) {
+		j = i - 1
+	}
+
+	compression := t.compressionAt(c.Mean)
+	if j >= 0 && t.compressionAt(t.processed[j].Mean) == compression {
+		// The merged centroid may span at most one unit of the scale
+		// function, or more in the body with MergeThreshold, the same bound
+		// the merging pass applies, and may not straddle a pinned tail.
+		before := prefix.sum(j)
+		k0 := t.Scaler.integratedLocation(before/t.processedWeight, compression)
+		k1 := t.Scaler.integratedLocation((before+t.processed[j].Weight+c.Weight)/t.processedWeight, compression)
+		if k1-k0 <= t.mergeStep(before/t.processedWeight) {
+			if t.keepTimes {
+				t.processedTimes[j] = mergeTimes(t.processedTimes[j], t.processed[j].Weight, at, c.Weight)
+			}
+			(&t.processed[j]).Add(c)
+			prefix.add(j, c.Weight)
+			if t.exampleLimit > 0 {
+				t.processedExamples[j] = mergeExamples(t.processedExamples[j], []float64{c.Mean}, t.exampleLimit)
+			}
+			return
+		}
+	}
+
+	t.processed = append(t.processed, Centroid{})
+	copy(t.processed[i+1:], t.processed[i:])
+	t.processed[i] = c
+	if t.exampleLimit > 0 {
+		t.processedExamples = append(t.processedExamples, nil)
+		copy(t.processedExamples[i+1:], t.processedExamples[i:])
+		t.processedExamples[i] = []float64{c.Mean}
+	}
+	if t.keepTimes {
+		t.processedTimes = append(t.processedTimes, 0)
+		copy(t.processedTimes[i+1:], t.processedTimes[i:])
+		t.processedTimes[i] = at
+	}
+	// Inserting shifts every later centroid, which is already linear, so
+	// rebuild rather than patch the tree.
+	prefix.build(t.processed)
+}
+
+// weightTree is a Fenwick tree over centroid weights, giving the weight of
+// any prefix of the centroids in O(log n).
+type weightTree []float64
+
+// build resets the tree to the weights of list.
+func (w *weightTree) build(list CentroidList) {
+	tree := append((*w)[:0], make([]float64, len(list)+1)...)
+	for i, c := range list {
+		tree[i+1] += c.Weight
+		if j := i + 1 + (i+1)&-(i+1); j < len(tree) {
+			tree[j] += tree[i+1]
+		}
+	}
+	*w = tree
+}
+
+// add adds weight to centroid i.
+func (w weightTree) add(i int, weight float64) {
+	for i++; i < len(w); i += i & -i {
+		w[i] += weight
+	}
+}
+
+// sum returns the total weight of the centroids before i.
+func (w weightTree) sum(i int) float64 {
+	var s float64
+	for ; i > 0; i -= i & -i {
+		s += w[i]
+	}
+	return s
+}
@@ -0,0 +1,61 @@
+package tdigest
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestClustering_Quantile(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []float64
+		quantile float64
+		want     float64
+		epsilon  float64
+	}{
+		{name: "increasing", quantile: 0.5, data: []float64{1, 2, 3, 4, 5}, want: 3},
+		{name: "small 99 (max)", quantile: 0.99, data: []float64{1, 2, 3, 4, 5, 5, 4, 3, 2, 1}, want: 5},
+		{name: "normal 50", quantile: 0.5, data: NormalData, want: 10.000673533707138, epsilon: 0.01},
+		{name: "normal 90", quantile: 0.9, data: NormalData, want: 13.842132136909889, epsilon: 0.01},
+		{name: "uniform 99.9", quantile: 0.999, data: UniformData, want: 99.90103781043621, epsilon: 0.01},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			td := NewWithAlgorithm(1000, Clustering)
+			for _, x := range tt.data {
+				td.Add(x, 1)
+			}
+			got := td.Quantile(tt.quantile)
+			if math.Abs(got-tt.want) > tt.epsilon {
+				t.Errorf("unexpected quantile %f, got %g want %g", tt.quantile, got, tt.want)
+			}
+			for i := 1; i < td.processed.Len(); i++ {
+				if td.processed[i].Mean < td.processed[i-1].Mean {
+					t.Fatalf("centroid %d out of order", i)
+				}
+			}
+			if td.processed.Len() > td.maxProcessed {
+				t.Errorf("too many centroids, got %d want at most %d", td.processed.Len(), td.maxProcessed)
+			}
+		})
+	}
+}
+
+func BenchmarkAlgorithm(b *testing.B) {
+	for _, a := range []Algorithm{Merging, Clustering} {
+		b.Run(a.String(), func(b *testing.B) {
+			td := NewWithAlgorithm(benchmarkCompression, a)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				td.Add(NormalData[i%len(NormalData)], 1)
+			}
+			b.StopTimer()
+			// Relative error at the tail against the full-resolution digest.
+			for _, q := range []float64{0.5, 0.99, 0.999} {
+				want := NormalDigest.Quantile(q)
+				b.ReportMetric(math.Abs(td.Quantile(q)-want)/want, "err@p"+strconv.FormatFloat(q*100, 'g', -1, 64))
+			}
+		})
+	}
+}
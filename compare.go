@@ -0,0 +1,125 @@
+package tdigest
+
+import (
+	"math"
+	"sort"
+)
+
+// Wasserstein1 returns the 1-Wasserstein (earth mover's) distance between the
+// distributions summarized by t and other, computed as the integral over
+// [0, 1] of the absolute difference of their quantile functions. Both quantile
+// functions are piecewise linear between centroids, so the integral is
+// evaluated exactly on the union of their breakpoints. It returns NaN if
+// either digest is empty.
+func (t *TDigest) Wasserstein1(other *TDigest) float64 {
+	t.processForQuery()
+	other.processForQuery()
+	if t.processed.Len() == 0 || other.processed.Len() == 0 {
+		return math.NaN()
+	}
+
+	qs := append(t.quantileBreakpoints(nil), other.quantileBreakpoints(nil)...)
+	qs = append(qs, 0, 1)
+	sort.Float64s(qs)
+
+	var sum float64
+	q0 := qs[0]
+	d0 := t.Quantile(q0) - other.Quantile(q0)
+	for _, q1 := range qs[1:] {
+		if q1 <= q0 {
+			continue
+		}
+		d1 := t.Quantile(q1) - other.Quantile(q1)
+		sum += integrateAbsLinear(d0, d1, q1-q0)
+		q0, d0 = q1, d1
+	}
+	return sum
+}
+
+// klSmoothing is the probability mass added to every bin by KLDivergence so
+// that bins empty in one digest do not make the divergence infinite.
+const klSmoothing = 1e-10
+
+// KLDivergence returns the Kullback-Leibler divergence D(t || other), in nats,
+// of the two digests discretized into the given number of equal-width bins
+// spanning the union of their ranges. Bin probabilities are taken from each
+// digest's CDF, clamped to 0 and 1 outside its range whatever its
+// CDFOutOfRange.
+//
+// A bin that is empty in other but not in t would make the divergence
+// infinite, so every bin probability p is smoothed to
+// (p + klSmoothing) / (1 + bins*klSmoothing) before comparing. This bounds the
+// contribution of such bins while changing populated bins negligibly. It
+// returns NaN if bins is less than one or either digest is empty.
+func (t *TDigest) KLDivergence(other *TDigest, bins int) float64 {
+	t.processForQuery()
+	other.processForQuery()
+	if bins < 1 || t.processed.Len() == 0 || other.processed.Len() == 0 {
+		return math.NaN()
+	}
+
+	lo := math.Min(t.min, other.min)
+	hi := math.Max(t.max, other.max)
+	if hi <= lo {
+		return 0
+	}
+	width := (hi - lo) / float64(bins)
+	norm := 1 + float64(bins)*klSmoothing
+
+	var kl float64
+	prevP, prevQ := 0.0, 0.0
+	for i := 1; i <= bins; i++ {
+		edge := lo + float64(i)*width
+		if i == bins {
+			edge = hi
+		}
+		cp, cq := t.cdf(edge), other.cdf(edge)
+		p := (cp - prevP + klSmoothing) / norm
+		q := (cq - prevQ + klSmoothing) / norm
+		kl += p * math.Log(p/q)
+		prevP, prevQ = cp, cq
+	}
+	return kl
+}
+
+// CDFDelta returns t.CDF(x) - other.CDF(x) for each x in xs, the signed
+// difference whose plot over a grid shows where the distributions diverge.
+// Each CDF treats values outside its digest's range as its CDFOutOfRange
+// selects. By default that is 0 at or below the minimum and 1 at or above the
+// maximum, so outside the overlap of the two ranges the delta is exactly the
+// weight one digest has there; with OutOfRangeNaN the delta is NaN there.
+// Both digests are processed once for the whole grid. Every delta is NaN if
+// either digest is empty, as is the delta at a NaN x.
+func (t *TDigest) CDFDelta(other *TDigest, xs []float64) []float64 {
+	t.processForQuery()
+	other.processForQuery()
+	deltas := make([]float64, len(xs))
+	empty := t.processed.Len() == 0 || other.processed.Len() == 0
+	for i, x := range xs {
+		if empty || math.IsNaN(x) {
+			deltas[i] = math.NaN()
+			continue
+		}
+		deltas[i] = t.cdfInRange(x) - other.cdfInRange(x)
+	}
+	return deltas
+}
+
+// quantileBreakpoints appends to qs the quantiles at which the digest's
+// quantile function changes slope, i.e. the centroid midpoints.
+func (t *TDigest) quantileBreakpoints(qs []float64) []float64 {
+	for _, c := range t.cumulative[:len(t.cumulative)-1] {
+		qs = append(qs, c/t.processedWeight)
+	}
+	return qs
+}
+
+// integrateAbsLinear integrates |f| over an interval of width h on which f is
+// linear with end values d0 and d1.
+func integrateAbsLinear(d0, d1, h float64) float64 {
+	a0, a1 := math.Abs(d0), math.Abs(d1)
+	if (d0 >= 0) == (d1 >= 0) {
+		return (a0 + a1) / 2.0 * h
+	}
+	return (d0*d0 + d1*d1) / (2.0 * (a0 + a1)) * h
+}
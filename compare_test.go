@@ -0,0 +1,108 @@
+package tdigest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWasserstein1(t *testing.T) {
+	shifted := NewWithCompression(1000)
+	for _, x := range UniformData {
+		shifted.Add(x+10, 1)
+	}
+	tests := []struct {
+		name    string
+		a, b    *TDigest
+		want    float64
+		epsilon float64
+	}{
+		{name: "identical", a: UniformDigest, b: UniformDigest, want: 0},
+		{name: "shifted", a: UniformDigest, b: shifted, want: 10, epsilon: 0.01},
+		{name: "symmetric", a: shifted, b: UniformDigest, want: 10, epsilon: 0.01},
+		{name: "normal vs uniform", a: NormalDigest, b: UniformDigest, want: 40, epsilon: 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.a.Wasserstein1(tt.b)
+			if math.Abs(got-tt.want) > tt.epsilon {
+				t.Errorf("unexpected distance, got %g want %g", got, tt.want)
+			}
+		})
+	}
+
+	if got := New().Wasserstein1(UniformDigest); !math.IsNaN(got) {
+		t.Errorf("unexpected distance from empty digest, got %g want NaN", got)
+	}
+}
+
+func TestKLDivergence(t *testing.T) {
+	if got := UniformDigest.KLDivergence(UniformDigest, 100); got != 0 {
+		t.Errorf("unexpected divergence of identical digests, got %g want 0", got)
+	}
+
+	other := NewWithCompression(1000)
+	for _, x := range UniformData[:N/2] {
+		other.Add(x, 1)
+	}
+	if got := UniformDigest.KLDivergence(other, 10); got < 0 || got > 1e-3 {
+		t.Errorf("unexpected divergence of similar digests, got %g", got)
+	}
+
+	got := UniformDigest.KLDivergence(NormalDigest, 50)
+	if got <= 0.1 || math.IsInf(got, 0) || math.IsNaN(got) {
+		t.Errorf("unexpected divergence of different digests, got %g", got)
+	}
+
+	if got := UniformDigest.KLDivergence(NormalDigest, 0); !math.IsNaN(got) {
+		t.Errorf("unexpected divergence with no bins, got %g want NaN", got)
+	}
+
+	// Every bin edge lies outside one of two disjoint digests.
+	low := NewWithCompression(100)
+	high := NewWithCompression(100)
+	for i := 0; i < 100; i++ {
+		low.Add(float64(i), 1)
+		high.Add(float64(i+200), 1)
+	}
+	want := low.KLDivergence(high, 20)
+	low.CDFOutOfRange, high.CDFOutOfRange = OutOfRangeNaN, OutOfRangeNaN
+	if got := low.KLDivergence(high, 20); got != want || !(got > 0) || math.IsInf(got, 0) {
+		t.Errorf("unexpected divergence with OutOfRangeNaN, got %g want %g", got, want)
+	}
+}
+
+func TestCDFDelta(t *testing.T) {
+	low := NewWithCompression(100)
+	high := NewWithCompression(100)
+	for i := 0; i < 100; i++ {
+		low.Add(float64(i), 1)
+		high.Add(float64(i+50), 1)
+	}
+	xs := []float64{-10, 25, 49.5, 75, 99.5, 200, math.NaN()}
+	got := low.CDFDelta(high, xs)
+	if len(got) != len(xs) {
+		t.Fatalf("unexpected length, got %d want %d", len(got), len(xs))
+	}
+	for i, x := range xs {
+		if math.IsNaN(x) {
+			if !math.IsNaN(got[i]) {
+				t.Errorf("x %g: got %g want NaN", x, got[i])
+			}
+			continue
+		}
+		if want := low.CDF(x) - high.CDF(x); got[i] != want {
+			t.Errorf("x %g: got %g want %g", x, got[i], want)
+		}
+	}
+	// Outside both ranges the CDFs agree, and in the middle of the overlap
+	// the lower digest leads by half its weight.
+	if got[0] != 0 || got[5] != 0 {
+		t.Errorf("unexpected delta outside the ranges, got %g and %g", got[0], got[5])
+	}
+	if math.Abs(got[3]-0.5) > 0.02 {
+		t.Errorf("unexpected delta at 75, got %g want 0.5", got[3])
+	}
+	if d := low.CDFDelta(New(), []float64{50}); !math.IsNaN(d[0]) {
+		t.Errorf("unexpected delta against an empty digest, got %g want NaN", d[0])
+	}
+}
@@ -0,0 +1,139 @@
+package tdigest
+
+import "math"
+
+// ToDDSketchBins maps the digest onto the logarithmically spaced buckets of a
+// DDSketch with the given relative accuracy, returning the bucket indices in
+// ascending order along with the weight assigned to each.
+//
+// Bucket i covers (gamma^(i-1), gamma^i] where gamma = (1+a)/(1-a), matching
+// DDSketch's logarithmic mapping. Each centroid's whole weight is assigned to
+// the bucket containing its mean, so the conversion compounds two errors: the
+// t-digest's own rank error, and the DDSketch relative value error a. A value
+// reported by the resulting sketch can therefore be off by a relative a from
+// the centroid mean, and samples spread across several buckets but summarized
+// by one centroid all land in a single bucket, which coarsens the body of the
+// distribution when compression is low.
+//
+// DDSketch keeps zero and negative values in separate stores, so centroids
+// with a non-positive mean are omitted. It returns nil if relativeAccuracy is
+// not in (0, 1).
+func (t *TDigest) ToDDSketchBins(relativeAccuracy float64) (indices []int, counts []float64) {
+	if !(relativeAccuracy > 0 && relativeAccuracy < 1) {
+		return nil, nil
+	}
+	t.processForQuery()
+	logGamma := math.Log((1 + relativeAccuracy) / (1 - relativeAccuracy))
+	for _, c := range t.processed {
+		if c.Mean <= 0 {
+			continue
+		}
+		i := int(math.Ceil(math.Log(c.Mean) / logGamma))
+		if n := len(indices); n > 0 && indices[n-1] == i {
+			counts[n-1] += c.Weight
+			continue
+		}
+		indices = append(indices, i)
+		counts = append(counts, c.Weight)
+	}
+	return indices, counts
+}
+
+// FromColumns builds a digest with the given compression from centroids stored
+// as separate mean and weight columns, as in columnar formats such as Arrow or
+// Parquet. The columns need not be sorted. It returns ErrColumnLength if they
+// differ in length, or ErrInvalidMean or ErrInvalidWeight for the first
+// centroid with a non-finite mean or a weight that is not positive and finite.
+// Count reports the total weight rounded to an integer, treating weights as
+// sample counts.
+func FromColumns(compression float64, means, weights []float64) (*TDigest, error) {
+	if len(means) != len(weights) {
+		return nil, ErrColumnLength
+	}
+	t := NewWithCompression(compression)
+	var total compensatedSum
+	for i := range means {
+		c := Centroid{Mean: means[i], Weight: weights[i]}
+		if err := validateCentroid(c); err != nil {
+			return nil, err
+		}
+		t.addCentroid(c)
+		total.add(c.Weight)
+	}
+	t.process()
+	t.count = int64(math.Round(total.value()))
+	return t, nil
+}
+
+// FromReservoir builds a digest with the given compression from a weighted
+// sample of a population of populationSize values, scaling the weights so
+// that they sum to populationSize and Count reports it. Samples and weights
+// are validated as by FromColumns, and a populationSize that is not positive
+// and finite is reported as ErrInvalidWeight. An empty sample gives an empty
+// digest.
+//
+// The digest describes the sample, not the population: a quantile q is off by
+// sampling error of order sqrt(q(1-q)/n) in probability for n samples on top
+// of the digest's own error, quantiles beyond about 1/n of either end are
+// extrapolated from the sample's extremes, and Min and Max are those of the
+// sample.
+func FromReservoir(compression float64, samples, weights []float64, populationSize float64) (*TDigest, error) {
+	if !(populationSize > 0) || math.IsInf(populationSize, 1) {
+		return nil, ErrInvalidWeight
+	}
+	t, err := FromColumns(compression, samples, weights)
+	if err != nil {
+		return nil, err
+	}
+	if t.processedWeight > 0 {
+		t.scaleWeights(populationSize / t.processedWeight)
+		t.updateCumulative()
+		t.count = int64(math.Round(populationSize))
+	}
+	return t, nil
+}
+
+// FromOTelExponentialHistogram builds a digest with the given compression from
+// an OpenTelemetry exponential histogram data point. Positive bucket
+// positiveOffset+i counts values in (base^(positiveOffset+i),
+// base^(positiveOffset+i+1)], where base = 2^(2^-scale), and negative buckets
+// mirror them below zero; zeroCount values are exactly zero.
+//
+// Each bucket becomes one centroid at the geometric midpoint of its bounds,
+// which is within a relative (base-1)/2 of every value the bucket may hold,
+// so the digest inherits the histogram's resolution rather than recovering
+// the t-digest's own. It returns ErrInvalidMean if a bucket lies beyond the
+// float64 range.
+func FromOTelExponentialHistogram(compression float64, scale int32, zeroCount uint64, positiveOffset int32, positive []uint64, negativeOffset int32, negative []uint64) (*TDigest, error) {
+	t := NewWithCompression(compression)
+	var count uint64
+	width := math.Exp2(-float64(scale))
+	add := func(mean float64, n uint64) error {
+		if n == 0 {
+			return nil
+		}
+		c := Centroid{Mean: mean, Weight: float64(n)}
+		if err := validateCentroid(c); err != nil {
+			return err
+		}
+		t.addCentroid(c)
+		count += n
+		return nil
+	}
+	for i, n := range positive {
+		if err := add(math.Exp2((float64(positiveOffset)+float64(i)+0.5)*width), n); err != nil {
+			return nil, err
+		}
+	}
+	for i, n := range negative {
+		if err := add(-math.Exp2((float64(negativeOffset)+float64(i)+0.5)*width), n); err != nil {
+			return nil, err
+		}
+	}
+	if err := add(0, zeroCount); err != nil {
+		return nil, err
+	}
+	t.process()
+	t.count = int64(count)
+	return t, nil
+}
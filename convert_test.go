@@ -0,0 +1,189 @@
+package tdigest
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestToDDSketchBins(t *testing.T) {
+	td := NewWithCompression(1000)
+	for _, x := range []float64{-1, 0, 1, 1, 2, 4, 100} {
+		td.Add(x, 1)
+	}
+	indices, counts := td.ToDDSketchBins(0.01)
+	gamma := 1.01 / 0.99
+	var wantIndices []int
+	for _, x := range []float64{1, 2, 4, 100} {
+		wantIndices = append(wantIndices, int(math.Ceil(math.Log(x)/math.Log(gamma))))
+	}
+	wantCounts := []float64{2, 1, 1, 1}
+	if !reflect.DeepEqual(indices, wantIndices) {
+		t.Errorf("unexpected indices, got %v want %v", indices, wantIndices)
+	}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("unexpected counts, got %v want %v", counts, wantCounts)
+	}
+
+	for i := 1; i < len(indices); i++ {
+		if indices[i] <= indices[i-1] {
+			t.Errorf("indices not strictly increasing: %v", indices)
+		}
+	}
+
+	if i, c := td.ToDDSketchBins(1); i != nil || c != nil {
+		t.Errorf("expected nil bins for invalid accuracy, got %v %v", i, c)
+	}
+}
+
+func TestFromColumns(t *testing.T) {
+	means := make([]float64, 0, NormalDigest.processed.Len())
+	weights := make([]float64, 0, NormalDigest.processed.Len())
+	// reversed, to check that the columns are sorted
+	for i := NormalDigest.processed.Len() - 1; i >= 0; i-- {
+		means = append(means, NormalDigest.processed[i].Mean)
+		weights = append(weights, NormalDigest.processed[i].Weight)
+	}
+	td, err := FromColumns(1000, means, weights)
+	if err != nil {
+		t.Fatalf("FromColumns err: %v", err)
+	}
+	if got := td.Count(); got != N {
+		t.Errorf("unexpected count, got %d want %d", got, int64(N))
+	}
+	for _, q := range []float64{0.01, 0.5, 0.99} {
+		if got, want := td.Quantile(q), NormalDigest.Quantile(q); math.Abs(got-want) > 0.001*Sigma {
+			t.Errorf("unexpected quantile %g, got %g want %g", q, got, want)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		means, weights []float64
+		want           error
+	}{
+		{name: "lengths", means: []float64{1, 2}, weights: []float64{1}, want: ErrColumnLength},
+		{name: "nan mean", means: []float64{1, math.NaN()}, weights: []float64{1, 1}, want: ErrInvalidMean},
+		{name: "zero weight", means: []float64{1, 2}, weights: []float64{1, 0}, want: ErrInvalidWeight},
+		{name: "empty", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := FromColumns(100, tt.means, tt.weights); err != tt.want {
+				t.Errorf("unexpected err, got %v want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromOTelExponentialHistogram(t *testing.T) {
+	// Bucket the positive part of the normal data at scale 5, whose buckets
+	// are about 2% wide, keeping the rest as negatives and zeros.
+	const scale = 5
+	index := func(x float64) int {
+		return int(math.Ceil(math.Log2(x)*math.Exp2(scale))) - 1
+	}
+	var zeros uint64
+	positive := make(map[int]uint64)
+	negative := make(map[int]uint64)
+	for _, x := range NormalData {
+		x -= Mu - Sigma
+		switch {
+		case x > 0:
+			positive[index(x)]++
+		case x < 0:
+			negative[index(-x)]++
+		default:
+			zeros++
+		}
+	}
+	dense := func(m map[int]uint64) (int32, []uint64) {
+		lo, hi := math.MaxInt32, math.MinInt32
+		for i := range m {
+			if i < lo {
+				lo = i
+			}
+			if i > hi {
+				hi = i
+			}
+		}
+		counts := make([]uint64, hi-lo+1)
+		for i, n := range m {
+			counts[i-lo] = n
+		}
+		return int32(lo), counts
+	}
+	posOffset, pos := dense(positive)
+	negOffset, neg := dense(negative)
+
+	td, err := FromOTelExponentialHistogram(1000, scale, zeros, posOffset, pos, negOffset, neg)
+	if err != nil {
+		t.Fatalf("FromOTelExponentialHistogram err: %v", err)
+	}
+	if got := td.Count(); got != N {
+		t.Errorf("unexpected count, got %d want %d", got, int64(N))
+	}
+	for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99} {
+		want := NormalDigest.Quantile(q) - (Mu - Sigma)
+		if got := td.Quantile(q); math.Abs(got-want) > 0.02*math.Abs(want)+0.01 {
+			t.Errorf("unexpected quantile %g, got %g want %g", q, got, want)
+		}
+	}
+
+	if _, err := FromOTelExponentialHistogram(100, 0, 0, 2000, []uint64{1}, 0, nil); err != ErrInvalidMean {
+		t.Errorf("unexpected err for an overflowing bucket, got %v want %v", err, ErrInvalidMean)
+	}
+	empty, err := FromOTelExponentialHistogram(100, 0, 0, 0, nil, 0, nil)
+	if err != nil || empty.Count() != 0 {
+		t.Errorf("unexpected empty conversion, got count %d err %v", empty.Count(), err)
+	}
+}
+
+func TestFromReservoir(t *testing.T) {
+	// Every hundredth value, half of them sampled at twice the weight.
+	var samples, weights []float64
+	for i := 0; i < N; i += 100 {
+		samples = append(samples, NormalData[i])
+		weights = append(weights, float64(1+i/100%2))
+	}
+	td, err := FromReservoir(1000, samples, weights, N)
+	if err != nil {
+		t.Fatalf("FromReservoir err: %v", err)
+	}
+	if got := td.Count(); got != N {
+		t.Errorf("unexpected count, got %d want %d", got, int64(N))
+	}
+	if got := td.processedWeight; math.Abs(got-N) > 1e-6 {
+		t.Errorf("unexpected total weight, got %g want %g", got, float64(N))
+	}
+	for _, q := range []float64{0.1, 0.5, 0.9} {
+		want := NormalDigest.Quantile(q)
+		if got := td.Quantile(q); math.Abs(got-want) > 0.1*Sigma {
+			t.Errorf("unexpected quantile %g, got %g want %g", q, got, want)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		samples    []float64
+		weights    []float64
+		population float64
+		want       error
+	}{
+		{"length", []float64{1, 2}, []float64{1}, 10, ErrColumnLength},
+		{"weight", []float64{1}, []float64{0}, 10, ErrInvalidWeight},
+		{"mean", []float64{math.NaN()}, []float64{1}, 10, ErrInvalidMean},
+		{"zero population", []float64{1}, []float64{1}, 0, ErrInvalidWeight},
+		{"infinite population", []float64{1}, []float64{1}, math.Inf(1), ErrInvalidWeight},
+		{"NaN population", []float64{1}, []float64{1}, math.NaN(), ErrInvalidWeight},
+	}
+	for _, tt := range tests {
+		if _, err := FromReservoir(100, tt.samples, tt.weights, tt.population); err != tt.want {
+			t.Errorf("%s: unexpected err, got %v want %v", tt.name, err, tt.want)
+		}
+	}
+	empty, err := FromReservoir(100, nil, nil, 10)
+	if err != nil || empty.Count() != 0 {
+		t.Errorf("unexpected empty reservoir, got count %d err %v", empty.Count(), err)
+	}
+}
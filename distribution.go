@@ -0,0 +1,56 @@
+package tdigest
+
+import (
+	mathrand "math/rand"
+
+	"golang.org/x/exp/rand"
+	"gonum.org/v1/gonum/stat/distuv"
+)
+
+// distributions maps each name accepted by NewFromDistribution to its
+// standard form drawing from src.
+var distributions = map[string]func(src rand.Source) distuv.Rander{
+	"normal":      func(src rand.Source) distuv.Rander { return distuv.Normal{Mu: 0, Sigma: 1, Src: src} },
+	"uniform":     func(src rand.Source) distuv.Rander { return distuv.Uniform{Min: 0, Max: 1, Src: src} },
+	"exponential": func(src rand.Source) distuv.Rander { return distuv.Exponential{Rate: 1, Src: src} },
+	"lognormal":   func(src rand.Source) distuv.Rander { return distuv.LogNormal{Mu: 0, Sigma: 1, Src: src} },
+}
+
+// NewFromDistribution returns a digest with the given compression holding n
+// values drawn from the named distribution in its standard form: "normal"
+// with mean 0 and standard deviation 1, "uniform" on [0, 1), "exponential"
+// with rate 1, or "lognormal" whose logarithm is standard normal. The same
+// seed always gives the same digest, which makes it suited to fixtures and
+// examples. It returns ErrUnknownDistribution for any other name; an n of
+// zero or less gives an empty digest.
+func NewFromDistribution(compression float64, name string, n int, seed uint64) (*TDigest, error) {
+	newDist, ok := distributions[name]
+	if !ok {
+		return nil, ErrUnknownDistribution
+	}
+	dist := newDist(rand.NewSource(seed))
+	t := NewWithCompression(compression)
+	for i := 0; i < n; i++ {
+		t.Add(dist.Rand(), 1)
+	}
+	return t, nil
+}
+
+// SampleN draws n values from the distribution t describes, by inverting the
+// digest's quantile function at uniform variates from rng. Within each
+// centroid's span values are interpolated as by Quantile, and the extreme
+// centroids extend to Min and Max, so draws never leave the observed range.
+// The digest is processed once for all n draws, and the same rng state always
+// gives the same values. It returns nil for an empty digest or an n of zero
+// or less.
+func (t *TDigest) SampleN(rng *mathrand.Rand, n int) []float64 {
+	t.processForQuery()
+	if n <= 0 || t.processed.Len() == 0 {
+		return nil
+	}
+	samples := make([]float64, n)
+	for i := range samples {
+		samples[i] = t.quantile(rng.Float64())
+	}
+	return samples
+}
@@ -0,0 +1,85 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"gonum.org/v1/gonum/stat/distuv"
+)
+
+func TestNewFromDistribution(t *testing.T) {
+	tests := []struct {
+		name string
+		dist distuv.Quantiler
+	}{
+		{"normal", distuv.UnitNormal},
+		{"uniform", distuv.Uniform{Min: 0, Max: 1}},
+		{"exponential", distuv.Exponential{Rate: 1}},
+		{"lognormal", distuv.LogNormal{Mu: 0, Sigma: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			td, err := NewFromDistribution(1000, tt.name, 100000, 1)
+			if err != nil {
+				t.Fatalf("NewFromDistribution err: %v", err)
+			}
+			again, _ := NewFromDistribution(1000, tt.name, 100000, 1)
+			if !reflect.DeepEqual(td, again) {
+				t.Errorf("same seed gave a different digest")
+			}
+			other, _ := NewFromDistribution(1000, tt.name, 100000, 2)
+			if reflect.DeepEqual(td, other) {
+				t.Errorf("different seeds gave the same digest")
+			}
+			if got := td.Count(); got != 100000 {
+				t.Errorf("unexpected count, got %d want 100000", got)
+			}
+			for _, q := range []float64{0.1, 0.5, 0.9} {
+				want := tt.dist.Quantile(q)
+				if got := td.Quantile(q); math.Abs(got-want) > 0.02*math.Max(1, want) {
+					t.Errorf("unexpected quantile %g, got %g want %g", q, got, want)
+				}
+			}
+		})
+	}
+
+	if _, err := NewFromDistribution(1000, "cauchy", 10, 1); err != ErrUnknownDistribution {
+		t.Errorf("unexpected err, got %v want %v", err, ErrUnknownDistribution)
+	}
+	if td, err := NewFromDistribution(1000, "normal", 0, 1); err != nil || td.Count() != 0 {
+		t.Errorf("unexpected empty digest, got count %d err %v", td.Count(), err)
+	}
+}
+
+func TestSampleN(t *testing.T) {
+	samples := NormalDigest.SampleN(rand.New(rand.NewSource(1)), 100000)
+	if len(samples) != 100000 {
+		t.Fatalf("unexpected number of samples %d", len(samples))
+	}
+	again := NormalDigest.SampleN(rand.New(rand.NewSource(1)), 100000)
+	if !reflect.DeepEqual(samples, again) {
+		t.Errorf("same seed gave different samples")
+	}
+	td := New()
+	for _, x := range samples {
+		if x < NormalDigest.Min() || x > NormalDigest.Max() {
+			t.Fatalf("sample %g outside [%g, %g]", x, NormalDigest.Min(), NormalDigest.Max())
+		}
+		td.Add(x, 1)
+	}
+	// Sampling error at the 1st and 99th percentiles is about 0.035.
+	for _, q := range []float64{0.01, 0.25, 0.5, 0.75, 0.99} {
+		if got, want := td.Quantile(q), NormalDigest.Quantile(q); math.Abs(got-want) > 0.15 {
+			t.Errorf("quantile %g of the samples: got %g want %g", q, got, want)
+		}
+	}
+
+	if got := New().SampleN(rand.New(rand.NewSource(1)), 10); got != nil {
+		t.Errorf("empty digest: got %v", got)
+	}
+	if got := NormalDigest.SampleN(rand.New(rand.NewSource(1)), 0); got != nil {
+		t.Errorf("zero samples: got %v", got)
+	}
+}
@@ -0,0 +1,73 @@
+package tdigest
+
+import "math"
+
+// ewmRescaleAbove bounds the weight given to new values by an EWMQuantile
+// before the digest is rescaled, far enough below the float64 range that no
+// sum of weights can overflow.
+const ewmRescaleAbove = 1e100
+
+// EWMQuantile is an exponentially weighted moving digest: every add ages the
+// weight of all prior values by alpha, so the digest describes a smoothly
+// sliding window of about 1/(1-alpha) recent values. Unlike NewWithDecay,
+// which ages the digest in steps every decayEvery adds, aging is continuous.
+//
+// Rather than touching every centroid on each add, new values are given
+// weights growing by 1/alpha per add and the digest is rescaled only when
+// they grow large. Quantile and CDF depend only on relative weights and need
+// no adjustment. It is not safe for concurrent use.
+type EWMQuantile struct {
+	digest *TDigest
+	alpha  float64
+	next   float64 // weight of the next value in the digest's units
+}
+
+// NewEWMQuantile returns an EWMQuantile with the given compression, aging
+// prior values by alpha on every add. It returns ErrInvalidFactor if alpha is
+// not in (0, 1]; an alpha of 1 never ages anything.
+func NewEWMQuantile(compression, alpha float64) (*EWMQuantile, error) {
+	if !(alpha > 0 && alpha <= 1) {
+		return nil, ErrInvalidFactor
+	}
+	return &EWMQuantile{digest: NewWithCompression(compression), alpha: alpha, next: 1}, nil
+}
+
+// Add ages all prior values by alpha and adds x with weight one. NaN values
+// are ignored and age nothing.
+func (e *EWMQuantile) Add(x float64) {
+	if math.IsNaN(x) {
+		return
+	}
+	e.digest.Add(x, e.next)
+	e.next /= e.alpha
+	if e.next > ewmRescaleAbove {
+		// DecayAndMerge only fails for factors that are not positive
+		_ = e.digest.DecayAndMerge(1/e.next, nil)
+		e.next = 1
+	}
+}
+
+// Quantile returns the estimated value at quantile q of the weighted window.
+func (e *EWMQuantile) Quantile(q float64) float64 {
+	return e.digest.Quantile(q)
+}
+
+// CDF returns the estimated fraction of the weighted window at or below x.
+func (e *EWMQuantile) CDF(x float64) float64 {
+	return e.digest.CDF(x)
+}
+
+// Weight returns the total weight of the window, with the newest value
+// weighing one. Under steady input it converges to 1/(1-alpha).
+func (e *EWMQuantile) Weight() float64 {
+	return (e.digest.processedWeight + e.digest.unprocessedWeight) / (e.next * e.alpha)
+}
+
+// Digest returns a copy of the window as an ordinary digest whose weights are
+// in the units of Weight, for queries EWMQuantile does not provide. Count
+// reports the number of values ever added.
+func (e *EWMQuantile) Digest() *TDigest {
+	d := e.digest.Clone()
+	_ = d.DecayAndMerge(1/(e.next*e.alpha), nil)
+	return d
+}
@@ -0,0 +1,65 @@
+package tdigest
+
+import (
+	"math"
+	"testing"
+
+	"golang.org/x/exp/rand"
+)
+
+func TestEWMQuantile(t *testing.T) {
+	for _, alpha := range []float64{0.999, 0.99} {
+		e, err := NewEWMQuantile(1000, alpha)
+		if err != nil {
+			t.Fatalf("NewEWMQuantile err: %v", err)
+		}
+		src := rand.New(rand.NewSource(1))
+		// Long enough for 0.99 to rescale several times.
+		for i := 0; i < 100000; i++ {
+			e.Add(src.NormFloat64())
+		}
+		if got, want := e.Weight(), 1/(1-alpha); math.Abs(got-want) > 1e-6*want {
+			t.Errorf("alpha %g: unexpected weight, got %g want %g", alpha, got, want)
+		}
+
+		// After a shift the old values' share of the weight decays as
+		// alpha^k, so the median crosses over after ln(2)/(1-alpha) adds.
+		for k := 1; k <= 3000; k++ {
+			e.Add(10 + src.NormFloat64())
+			if k%500 != 0 {
+				continue
+			}
+			want := math.Pow(alpha, float64(k))
+			if got := e.CDF(5); math.Abs(got-want) > 0.02 {
+				t.Errorf("alpha %g: unexpected weight of old values after %d adds, got %g want %g", alpha, k, got, want)
+			}
+		}
+		if got := e.Quantile(0.5); math.Abs(got-10) > 0.2 {
+			t.Errorf("alpha %g: median did not follow the shift, got %g want 10", alpha, got)
+		}
+
+		d := e.Digest()
+		if got, want := d.processedWeight, e.Weight(); math.Abs(got-want) > 1e-9*want {
+			t.Errorf("alpha %g: unexpected digest weight, got %g want %g", alpha, got, want)
+		}
+		if got := d.Count(); got != 103000 {
+			t.Errorf("alpha %g: unexpected count, got %d want 103000", alpha, got)
+		}
+		if got, want := d.Quantile(0.9), e.Quantile(0.9); math.Abs(got-want) > 1e-9 {
+			t.Errorf("alpha %g: digest disagrees, got %g want %g", alpha, got, want)
+		}
+	}
+
+	e, _ := NewEWMQuantile(100, 0.5)
+	e.Add(1)
+	e.Add(math.NaN())
+	e.Add(2)
+	if got := e.Weight(); got != 1.5 {
+		t.Errorf("unexpected weight, got %g want 1.5", got)
+	}
+	for _, alpha := range []float64{0, -1, 1.5, math.NaN()} {
+		if _, err := NewEWMQuantile(100, alpha); err != ErrInvalidFactor {
+			t.Errorf("alpha %g: unexpected err, got %v want %v", alpha, err, ErrInvalidFactor)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package tdigest
+
+import "math"
+
+// KeepExactTotals makes t keep a compensated running sum of every value added
+// times its weight, and of the weights themselves, for callers such as
+// billing that need exact aggregates alongside approximate quantiles. Unlike
+// Sum, the totals are not affected by decay or eviction, and their rounding
+// error stays within an ulp however many values are added. Existing values
+// are counted from Sum and the total weight when the mode is enabled. The
+// totals are serialized by MarshalBinary, in a format that older readers
+// reject. Passing false drops them.
+func (t *TDigest) KeepExactTotals(keep bool) {
+	if keep == t.keepExact {
+		return
+	}
+	t.keepExact = keep
+	t.exactSum, t.exactCount = compensatedSum{}, compensatedSum{}
+	if keep {
+		t.exactSum.add(t.Sum())
+		t.exactCount.add(t.totalWeight())
+	}
+}
+
+// ExactSum returns the compensated sum of every value added times its
+// weight. It returns NaN unless KeepExactTotals is enabled.
+func (t *TDigest) ExactSum() float64 {
+	if !t.keepExact {
+		return math.NaN()
+	}
+	return t.exactSum.value()
+}
+
+// ExactCount returns the compensated sum of the weights of every value added,
+// which is the number of adds when every weight is one. It returns NaN unless
+// KeepExactTotals is enabled.
+func (t *TDigest) ExactCount() float64 {
+	if !t.keepExact {
+		return math.NaN()
+	}
+	return t.exactCount.value()
+}
+
+// addExact counts c in the exact totals, if they are kept.
+func (t *TDigest) addExact(c Centroid) {
+	if t.keepExact {
+		t.exactSum.add(c.Mean * c.Weight)
+		t.exactCount.add(c.Weight)
+	}
+}
+
+// mergeExact adds other's exact totals to t's, if t keeps them. A digest
+// without exact totals contributes its Sum and total weight instead.
+func (t *TDigest) mergeExact(other *TDigest) {
+	if !t.keepExact {
+		return
+	}
+	if other.keepExact {
+		t.exactSum.add(other.exactSum.sum)
+		t.exactSum.add(other.exactSum.c)
+		t.exactCount.add(other.exactCount.sum)
+		t.exactCount.add(other.exactCount.c)
+		return
+	}
+	t.exactSum.add(other.Sum())
+	t.exactCount.add(other.totalWeight())
+}
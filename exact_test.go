@@ -0,0 +1,115 @@
+package tdigest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestExactTotals(t *testing.T) {
+	td := NewWithDecay(100, 0.5, 100)
+	if !math.IsNaN(td.ExactSum()) || !math.IsNaN(td.ExactCount()) {
+		t.Errorf("exact totals reported without KeepExactTotals")
+	}
+	td.KeepExactTotals(true)
+	// Small values added to a huge one are lost to a plain float64 sum.
+	td.Add(1e16, 1)
+	for i := 0; i < 1000; i++ {
+		td.Add(1, 1)
+	}
+	if got, want := td.ExactSum(), 1e16+1000; got != want {
+		t.Errorf("unexpected exact sum, got %.0f want %.0f", got, want)
+	}
+	// Decay shrinks the weights but not the exact totals.
+	if got := td.ExactCount(); got != 1001 {
+		t.Errorf("unexpected exact count, got %g want 1001", got)
+	}
+	if td.Sum() >= td.ExactSum() {
+		t.Errorf("decayed sum %g is not below the exact sum %g", td.Sum(), td.ExactSum())
+	}
+	if err := td.AddSafe(math.NaN(), 1); err == nil || td.ExactCount() != 1001 {
+		t.Errorf("rejected value changed the exact count")
+	}
+
+	b, err := td.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+	got := new(TDigest)
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary err: %v", err)
+	}
+	if got.ExactSum() != td.ExactSum() || got.ExactCount() != td.ExactCount() || got.exactSum != td.exactSum {
+		t.Errorf("exact totals did not round trip")
+	}
+
+	// Digests without exact totals contribute their Sum.
+	plain := New()
+	plain.Add(2, 3)
+	got.Merge(plain).Merge(td)
+	if want := 2*(1e16+1000) + 6; got.ExactSum() != want {
+		t.Errorf("unexpected merged exact sum, got %.0f want %.0f", got.ExactSum(), want)
+	}
+	if want := 2*1001.0 + 3; got.ExactCount() != want {
+		t.Errorf("unexpected merged exact count, got %g want %g", got.ExactCount(), want)
+	}
+
+	got.ClearKeepingCapacity()
+	if got.ExactSum() != 0 || got.ExactCount() != 0 {
+		t.Errorf("clear kept the exact totals")
+	}
+	plain.KeepExactTotals(true)
+	if plain.ExactSum() != 6 || plain.ExactCount() != 3 {
+		t.Errorf("enabling did not count existing values, got %g and %g", plain.ExactSum(), plain.ExactCount())
+	}
+	plain.KeepExactTotals(false)
+	if !math.IsNaN(plain.ExactSum()) {
+		t.Errorf("exact totals kept after disabling")
+	}
+
+	// Timestamps and exact totals share the extended encoding.
+	both := New()
+	both.KeepTimestamps(true)
+	both.KeepExactTotals(true)
+	for i := 0; i < 100; i++ {
+		both.Add(float64(i), 1)
+	}
+	b, err = both.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+	decoded := new(TDigest)
+	if err := decoded.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary err: %v", err)
+	}
+	if !decoded.keepTimes || len(decoded.processedTimes) != decoded.processed.Len() || decoded.ExactSum() != 4950 {
+		t.Errorf("extended encoding did not round trip")
+	}
+
+	// Every encoding carries the extended state.
+	for name, marshal := range map[string]func() ([]byte, error){
+		"float32":  both.MarshalBinaryFloat32,
+		"checksum": both.MarshalBinaryChecksummed,
+		"delta":    both.MarshalBinaryDelta,
+		"max size": func() ([]byte, error) { return both.MarshalBinaryMaxSize(1000) },
+	} {
+		b, err := marshal()
+		if err != nil {
+			t.Fatalf("%s: marshal err: %v", name, err)
+		}
+		decoded := new(TDigest)
+		if err := decoded.UnmarshalBinary(b); err != nil {
+			t.Fatalf("%s: UnmarshalBinary err: %v", name, err)
+		}
+		if !decoded.keepTimes || len(decoded.processedTimes) != decoded.processed.Len() || decoded.ExactSum() != 4950 {
+			t.Errorf("%s: extended state did not round trip", name)
+		}
+	}
+	b, err = both.MarshalBinaryChecksummed()
+	if err != nil {
+		t.Fatalf("MarshalBinaryChecksummed err: %v", err)
+	}
+	b[len(b)-5] ^= 1
+	if err := new(TDigest).UnmarshalBinary(b); err != ErrChecksumMismatch {
+		t.Errorf("corrupt exact totals: got err %v want %v", err, ErrChecksumMismatch)
+	}
+}
@@ -0,0 +1,140 @@
+package tdigest
+
+import (
+	"math"
+	"sort"
+)
+
+// KeepExamples makes each centroid retain up to perCentroid of the values
+// that were merged into it, so that Examples can return concrete samples near
+// a quantile. Values added before the call have no examples. Examples are not
+// serialized. A perCentroid of zero or less disables the mode and drops any
+// retained examples.
+func (t *TDigest) KeepExamples(perCentroid int) {
+	if perCentroid <= 0 {
+		t.resumePending()
+		t.exampleLimit = 0
+		t.processedExamples = nil
+		return
+	}
+	t.resumePending()
+	t.exampleLimit = perCentroid
+	for i, e := range t.processedExamples {
+		if len(e) > perCentroid {
+			t.processedExamples[i] = thinExamples(e, perCentroid)
+		}
+	}
+}
+
+// Examples returns up to k retained sample values closest to Quantile(q), in
+// ascending order. It returns nil unless KeepExamples is enabled.
+func (t *TDigest) Examples(q float64, k int) []float64 {
+	t.processForQuery()
+	if t.exampleLimit <= 0 || k <= 0 || t.processed.Len() == 0 {
+		return nil
+	}
+	v := t.Quantile(q)
+	if math.IsNaN(v) {
+		return nil
+	}
+	t.padExamples()
+
+	// Walk outwards from v one centroid each side at a time until k examples
+	// are gathered, then take one more step so the nearest values on both
+	// sides are considered.
+	hi := sort.Search(t.processed.Len(), func(i int) bool {
+		return t.processed[i].Mean >= v
+	})
+	lo := hi - 1
+	var found []float64
+	for (lo >= 0 || hi < t.processed.Len()) && len(found) < k {
+		if lo >= 0 {
+			found = append(found, t.processedExamples[lo]...)
+			lo--
+		}
+		if hi < t.processed.Len() {
+			found = append(found, t.processedExamples[hi]...)
+			hi++
+		}
+	}
+	if lo >= 0 {
+		found = append(found, t.processedExamples[lo]...)
+	}
+	if hi < t.processed.Len() {
+		found = append(found, t.processedExamples[hi]...)
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return math.Abs(found[i]-v) < math.Abs(found[j]-v)
+	})
+	if len(found) > k {
+		found = found[:k]
+	}
+	sort.Float64s(found)
+	return found
+}
+
+// padExamples makes processedExamples line up with processed, for centroids
+// that existed before KeepExamples was enabled.
+func (t *TDigest) padExamples() {
+	for len(t.processedExamples) < t.processed.Len() {
+		t.processedExamples = append(t.processedExamples, nil)
+	}
+}
+
+// pendingExamples returns the examples for unprocessed followed by processed,
+// in the order processIt appends them. Buffered centroids are their own
+// example.
+func (t *TDigest) pendingExamples() [][]float64 {
+	t.padExamples()
+	examples := make([][]float64, 0, t.unprocessed.Len()+t.processed.Len())
+	for _, c := range t.unprocessed {
+		examples = append(examples, []float64{c.Mean})
+	}
+	return append(examples, t.processedExamples...)
+}
+
+// mergeExamples combines two example sets, thinning the result to at most
+// limit values.
+func mergeExamples(dst, src []float64, limit int) []float64 {
+	dst = append(dst, src...)
+	if len(dst) <= limit {
+		return dst
+	}
+	return thinExamples(dst, limit)
+}
+
+// thinExamples keeps limit values spread evenly across the sorted range of e,
+// always including the smallest and largest.
+func thinExamples(e []float64, limit int) []float64 {
+	sort.Float64s(e)
+	if limit == 1 {
+		e[0] = e[len(e)/2]
+		return e[:1]
+	}
+	n := len(e) - 1
+	for j := 0; j < limit; j++ {
+		e[j] = e[j*n/(limit-1)]
+	}
+	return e[:limit]
+}
+
+// centroidSorter sorts a centroid list together with its examples and
+// timestamps, either of which may be nil.
+type centroidSorter struct {
+	list     CentroidList
+	examples [][]float64
+	times    []int64
+}
+
+func (s *centroidSorter) Len() int           { return len(s.list) }
+func (s *centroidSorter) Less(i, j int) bool { return s.list.Less(i, j) }
+func (s *centroidSorter) Swap(i, j int) {
+	s.list[i], s.list[j] = s.list[j], s.list[i]
+	if s.examples != nil {
+		s.examples[i], s.examples[j] = s.examples[j], s.examples[i]
+	}
+	if s.times != nil {
+		s.times[i], s.times[j] = s.times[j], s.times[i]
+	}
+}
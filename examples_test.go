@@ -0,0 +1,69 @@
+package tdigest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestExamples(t *testing.T) {
+	td := NewWithCompression(100)
+	td.KeepExamples(3)
+	seen := make(map[float64]bool)
+	for _, x := range UniformData[:100000] {
+		td.Add(x, 1)
+		seen[x] = true
+	}
+
+	for _, q := range []float64{0, 0.5, 0.99, 1} {
+		got := td.Examples(q, 5)
+		if len(got) != 5 {
+			t.Fatalf("quantile %g: expected 5 examples, got %v", q, got)
+		}
+		v := td.Quantile(q)
+		for i, x := range got {
+			if !seen[x] {
+				t.Errorf("quantile %g: example %g was never added", q, x)
+			}
+			if math.Abs(x-v) > 2 {
+				t.Errorf("quantile %g: example %g too far from %g", q, x, v)
+			}
+			if i > 0 && x < got[i-1] {
+				t.Errorf("quantile %g: examples not sorted: %v", q, got)
+			}
+		}
+	}
+
+	for i, e := range td.processedExamples {
+		if len(e) > 3 {
+			t.Errorf("centroid %d retained %d examples, want at most 3", i, len(e))
+		}
+	}
+
+	td.KeepExamples(0)
+	if got := td.Examples(0.5, 5); got != nil {
+		t.Errorf("expected no examples once disabled, got %v", got)
+	}
+	if got := New().Examples(0.5, 5); got != nil {
+		t.Errorf("expected no examples by default, got %v", got)
+	}
+}
+
+func TestExamplesClustering(t *testing.T) {
+	td := NewWithAlgorithm(100, Clustering)
+	td.KeepExamples(2)
+	for _, x := range NormalData[:50000] {
+		td.Add(x, 1)
+	}
+	if len(td.processedExamples) != td.processed.Len() {
+		t.Fatalf("examples out of step with centroids, %d vs %d", len(td.processedExamples), td.processed.Len())
+	}
+	got := td.Examples(0.5, 4)
+	if len(got) != 4 {
+		t.Fatalf("expected 4 examples, got %v", got)
+	}
+	for _, x := range got {
+		if math.Abs(x-Mu) > 0.5 {
+			t.Errorf("example %g too far from the median", x)
+		}
+	}
+}
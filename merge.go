@@ -0,0 +1,277 @@
+package tdigest
+
+import "math"
+
+// DecayAndMerge scales the weights of t by factor and then merges other into
+// it, reprocessing only once. It is equivalent to decaying a rolling
+// accumulator and folding in the latest window. other is not modified.
+func (t *TDigest) DecayAndMerge(factor float64, other *TDigest) error {
+	if !(factor > 0) || math.IsInf(factor, 0) {
+		return ErrInvalidFactor
+	}
+	t.scaleWeights(factor)
+	if other != nil {
+		t.appendUnprocessed(other)
+	}
+	if t.unprocessed.Len() == 0 {
+		t.updateCumulative()
+	} else {
+		t.process()
+	}
+	return nil
+}
+
+// RollOver returns a snapshot of t and then scales t's weights by decayFactor,
+// so the next reporting window starts from a faded copy of the current shape
+// rather than from nothing. A decayFactor of 1 keeps everything; smaller
+// factors let new values dominate sooner. Count is not scaled. Factors above 1
+// are treated as 1, and factors of 0 or less, or NaN, as 0, which clears t as
+// ClearKeepingCapacity does so that the next window starts empty.
+func (t *TDigest) RollOver(decayFactor float64) *TDigest {
+	snap := t.Snapshot()
+	switch {
+	case !(decayFactor > 0):
+		t.ClearKeepingCapacity()
+	case decayFactor < 1:
+		t.DecayAndMerge(decayFactor, nil)
+	}
+	return snap
+}
+
+// scaleWeights multiplies every centroid weight by factor without
+// reprocessing. The cumulative weights are left stale.
+func (t *TDigest) scaleWeights(factor float64) {
+	t.resumePending()
+	for i := range t.processed {
+		t.processed[i].Weight *= factor
+	}
+	for i := range t.unprocessed {
+		t.unprocessed[i].Weight *= factor
+	}
+	t.processedWeight *= factor
+	t.unprocessedWeight *= factor
+	t.invalidateQuantiles()
+}
+
+// appendUnprocessed adds all of other's centroids to the unprocessed buffer of
+// t without triggering a process, so the caller decides when to pay for it.
+func (t *TDigest) appendUnprocessed(other *TDigest) {
+	if other == t {
+		// Appending t's buffers to themselves would read back centroids
+		// appended moments earlier, so merge a copy instead.
+		other = t.Clone()
+	}
+	t.resumePending()
+	if t.keepTimes {
+		t.unprocessedTimes = appendTimes(t.unprocessedTimes, other.processedTimes, other.processed.Len(), t.stamp())
+		t.unprocessedTimes = appendTimes(t.unprocessedTimes, other.unprocessedTimes, other.unprocessed.Len(), t.stamp())
+	}
+	t.unprocessed = append(t.unprocessed, other.processed...)
+	t.unprocessed = append(t.unprocessed, other.unprocessed...)
+	t.unprocessedWeight += other.processedWeight + other.unprocessedWeight
+	t.min = math.Min(t.min, other.min)
+	t.max = math.Max(t.max, other.max)
+	t.count += other.count
+	t.mergedFrom(other)
+}
+
+// Merge adds all of other's centroids to t and returns t, so merges can be
+// chained as in a.Clone().Merge(b).Merge(c). It modifies t in place; start the
+// chain from a Clone to keep the original. other is not modified and a nil
+// other is ignored.
+func (t *TDigest) Merge(other *TDigest) *TDigest {
+	if other != nil {
+		t.appendUnprocessed(other)
+		t.process()
+	}
+	return t
+}
+
+// MergeUnique merges other into t like Merge unless id is already in seen,
+// recording it there, so that a shard delivered twice by retries is counted
+// once. It reports whether other was merged. Ids are compared exactly, so
+// callers choose what identifies a shard's digest, such as its name and
+// window. seen must not be nil.
+func (t *TDigest) MergeUnique(other *TDigest, id string, seen map[string]bool) bool {
+	if seen[id] {
+		return false
+	}
+	seen[id] = true
+	t.Merge(other)
+	return true
+}
+
+// MergeDownsampling merges other into t and re-clusters the result at
+// targetCompression in a single pass, which is cheaper than a Merge followed
+// by a separate recompression. t keeps targetCompression afterwards, so each
+// tier of a hierarchical aggregation can bound its memory below that of the
+// tier feeding it. Raising the compression does not restore resolution that
+// was already merged away. It returns ErrInvalidCompression, leaving t
+// unchanged, if targetCompression is not positive and finite; a nil other is
+// ignored.
+func (t *TDigest) MergeDownsampling(other *TDigest, targetCompression float64) error {
+	if !(targetCompression > 0) || math.IsInf(targetCompression, 1) {
+		return ErrInvalidCompression
+	}
+	if other != nil {
+		t.appendUnprocessed(other)
+	}
+	t.Compression = targetCompression
+	t.tailFrom, t.tailCompression = 0, 0
+	t.maxUnprocessed = unprocessedSize(0, targetCompression)
+	// Force a pass over the processed centroids even when nothing is
+	// buffered, so that those formed at the old compression are re-clustered.
+	t.maxProcessed = 0
+	t.process()
+	t.maxProcessed = t.Scaler.MaxCentroids(targetCompression, math.Inf(1))
+	return nil
+}
+
+// MergePreferTail merges other into t like Merge, except that centroids at or
+// above other's quantile q, and any t holds there, are clustered at other's
+// compression rather than t's. Merging a fine recent digest into a coarse
+// long-running one then keeps the recent digest's tail resolution while the
+// body below the split is merged as usual. The tail stays pinned at the finer
+// compression through later adds and merges, so a rolling aggregate keeps it;
+// each call lowers the split to other's quantile if that is below it, and
+// Clear and MergeDownsampling drop it. The pinned tail takes up to
+// MaxCentroids of the finer compression on top of the body's. It returns
+// ErrInvalidQuantile if q is outside [0, 1]; a nil other is ignored.
+func (t *TDigest) MergePreferTail(other *TDigest, q float64) error {
+	if !(q >= 0 && q <= 1) {
+		return ErrInvalidQuantile
+	}
+	if other == nil {
+		return nil
+	}
+	x := other.Quantile(q)
+	if math.IsNaN(x) {
+		return nil
+	}
+	compression := math.Max(t.Compression, other.Compression)
+	if t.tailCompression > 0 {
+		x = math.Min(x, t.tailFrom)
+		compression = math.Max(compression, t.tailCompression)
+	}
+	t.resumePending()
+	t.pinTail(x, compression)
+	t.Merge(other)
+	return nil
+}
+
+// MergeBalanced returns a new digest with the given compression holding the
+// union of digests. Each input contributes its total weight, so a shard that
+// saw a million samples outweighs one that saw a thousand by the same ratio,
+// as if every sample had been added to a single digest. This differs from
+// averaging the shards' quantiles or CDFs, which treats every shard as equally
+// likely regardless of its traffic. Decayed inputs contribute their decayed
+// weight. Nil digests are skipped and the inputs are not modified.
+func MergeBalanced(compression float64, digests ...*TDigest) *TDigest {
+	t := NewWithCompression(compression)
+	for _, d := range digests {
+		if d == nil {
+			continue
+		}
+		t.appendUnprocessed(d)
+		t.process()
+	}
+	return t
+}
+
+// CombinedQuantile estimates quantile q of the union of digests without
+// merging them. It inverts the union's CDF, the average of each digest's CDF
+// weighted by its total weight, by bisection over the combined range.
+//
+// The estimate is less accurate than the quantile of a true merge, since each
+// digest interpolates independently, but each step costs one CDF lookup per
+// digest rather than a pass over every centroid. Nil and empty digests are
+// skipped; it returns NaN if q is outside [0, 1] or there is no weight.
+func CombinedQuantile(q float64, digests ...*TDigest) float64 {
+	if q < 0 || q > 1 {
+		return math.NaN()
+	}
+	var total float64
+	lo, hi := math.Inf(1), math.Inf(-1)
+	live := make([]*TDigest, 0, len(digests))
+	for _, d := range digests {
+		if d == nil {
+			continue
+		}
+		d.processForQuery()
+		if d.processedWeight <= 0 {
+			continue
+		}
+		live = append(live, d)
+		total += d.processedWeight
+		lo = math.Min(lo, d.min)
+		hi = math.Max(hi, d.max)
+	}
+	if len(live) == 0 {
+		return math.NaN()
+	}
+	if q == 0 {
+		return lo
+	}
+	if q == 1 {
+		return hi
+	}
+
+	cdf := func(x float64) float64 {
+		var w float64
+		for _, d := range live {
+			w += d.cdf(x) * d.processedWeight
+		}
+		return w / total
+	}
+	for i := 0; i < 100 && lo < hi; i++ {
+		mid := lo/2 + hi/2
+		if mid <= lo || mid >= hi {
+			break
+		}
+		if cdf(mid) < q {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi
+}
+
+// ConvolveShift returns a new digest merging t with a copy of itself whose
+// values are moved by shift and whose weights are scaled by weight, to model
+// jitter added to the recorded values. The result is the distribution of
+// X + J, with X drawn from t and J a jitter of shift with probability
+// weight/(1+weight) and 0 otherwise: an exact convolution with that two-point
+// jitter, up to the usual merge error at t's compression. Smoother jitter can
+// be approximated by chaining calls with small shifts, at the cost of a merge
+// each. Total weight and Count grow by a factor of 1+weight. Shifted
+// centroids keep their timestamps but not their examples. Like a query, it
+// leaves how t clusters later values as it was. It returns nil if shift is not finite or weight is not positive
+// and finite.
+func (t *TDigest) ConvolveShift(shift, weight float64) *TDigest {
+	if math.IsNaN(shift) || math.IsInf(shift, 0) || !(weight > 0) || math.IsInf(weight, 1) {
+		return nil
+	}
+	t.processForQuery()
+	shifted := &TDigest{
+		processed:       make(CentroidList, t.processed.Len()),
+		processedWeight: t.processedWeight * weight,
+		min:             t.min + shift,
+		max:             t.max + shift,
+		count:           int64(math.Round(float64(t.count) * weight)),
+		Compression:     t.Compression,
+		processedTimes:  t.processedTimes,
+
+		effectiveCompression: t.effectiveCompression,
+	}
+	for i, c := range t.processed {
+		shifted.processed[i] = Centroid{Mean: c.Mean + shift, Weight: c.Weight * weight}
+	}
+	// Clone would merge t's buffer for good, so copy the query's state.
+	base := &TDigest{
+		processed:   make(CentroidList, 0, t.maxProcessed),
+		unprocessed: make(CentroidList, 0, t.maxUnprocessed+1),
+	}
+	t.cloneInto(base)
+	return base.Merge(shifted)
+}
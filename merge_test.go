@@ -0,0 +1,495 @@
+package tdigest
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDecayAndMerge(t *testing.T) {
+	acc := NewWithCompression(1000)
+	for i := 0; i < 100; i++ {
+		acc.Add(float64(i), 1)
+	}
+	window := NewWithCompression(1000)
+	for i := 100; i < 200; i++ {
+		window.Add(float64(i), 1)
+	}
+
+	if err := acc.DecayAndMerge(0.5, window); err != nil {
+		t.Fatalf("DecayAndMerge err: %v", err)
+	}
+	if acc.unprocessed.Len() != 0 {
+		t.Errorf("expected digest to be processed, %d centroids pending", acc.unprocessed.Len())
+	}
+	if got := acc.processedWeight; got != 150 {
+		t.Errorf("unexpected total weight, got %g want 150", got)
+	}
+	// The decayed half holds a third of the weight.
+	if got := acc.CDF(99.5); math.Abs(got-1.0/3.0) > 0.01 {
+		t.Errorf("unexpected CDF at window boundary, got %g want %g", got, 1.0/3.0)
+	}
+	if acc.Min() != 0 || acc.Max() != 199 {
+		t.Errorf("unexpected range, got [%g, %g] want [0, 199]", acc.Min(), acc.Max())
+	}
+	if window.processedWeight+window.unprocessedWeight != 100 {
+		t.Errorf("merged digest was modified")
+	}
+
+	for _, factor := range []float64{0, -1, math.Inf(1), math.NaN()} {
+		if err := acc.DecayAndMerge(factor, window); err != ErrInvalidFactor {
+			t.Errorf("factor %g: unexpected err, got %v want %v", factor, err, ErrInvalidFactor)
+		}
+	}
+}
+
+func TestRollOver(t *testing.T) {
+	td := NewWithCompression(1000)
+	for i := 0; i < 100; i++ {
+		td.Add(float64(i), 1)
+	}
+	snap := td.RollOver(0.25)
+	if got := snap.processedWeight; got != 100 {
+		t.Errorf("unexpected snapshot weight, got %g want 100", got)
+	}
+	if got := td.processedWeight; got != 25 {
+		t.Errorf("unexpected faded weight, got %g want 25", got)
+	}
+	if a, b := td.Quantile(0.5), snap.Quantile(0.5); a != b {
+		t.Errorf("fading changed the shape, got median %g want %g", a, b)
+	}
+
+	// The next window dominates the faded prior.
+	for i := 0; i < 100; i++ {
+		td.Add(float64(i+1000), 1)
+	}
+	if got := td.CDF(500); math.Abs(got-0.2) > 0.01 {
+		t.Errorf("unexpected weight of the prior, got %g want 0.2", got)
+	}
+	if snap.Max() != 99 {
+		t.Errorf("snapshot saw writes after the roll over, max %g", snap.Max())
+	}
+
+	before := td.totalWeight()
+	if td.RollOver(1.5); td.totalWeight() != before {
+		t.Errorf("factor above 1 changed the weight from %g to %g", before, td.totalWeight())
+	}
+	for _, factor := range []float64{0, -1, math.NaN()} {
+		td.Add(1, 1)
+		if snap := td.RollOver(factor); snap.Count() == 0 || td.Count() != 0 || td.totalWeight() != 0 {
+			t.Errorf("factor %g: snapshot count %d, %d and weight %g left", factor, snap.Count(), td.Count(), td.totalWeight())
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	shards := make([]*TDigest, 3)
+	for i := range shards {
+		shards[i] = NewWithCompression(1000)
+	}
+	for i, x := range UniformData {
+		shards[i%len(shards)].Add(x, 1)
+	}
+
+	a := shards[0]
+	before := a.Count()
+	merged := a.Clone().Merge(shards[1]).Merge(nil).Merge(shards[2])
+	if a.Count() != before {
+		t.Errorf("chain starting from a clone modified the original")
+	}
+	if got := merged.Count(); got != N {
+		t.Errorf("unexpected count, got %d want %d", got, int64(N))
+	}
+	for _, q := range []float64{0.01, 0.5, 0.99} {
+		want := UniformDigest.Quantile(q)
+		if got := merged.Quantile(q); math.Abs(got-want) > 0.05 {
+			t.Errorf("unexpected quantile %g, got %g want %g", q, got, want)
+		}
+	}
+	if !merged.IsMonotonic(10000) {
+		t.Errorf("merged quantiles decrease")
+	}
+	if got := a.Merge(shards[1]); got != a {
+		t.Errorf("Merge did not return its receiver")
+	}
+}
+
+func TestMergeSelf(t *testing.T) {
+	for _, buffered := range []bool{false, true} {
+		a := NewWithCompression(100)
+		a.KeepExactTotals(true)
+		for _, x := range NormalData[:1000] {
+			a.Add(x, 1)
+		}
+		if !buffered {
+			a.ProcessNow()
+		}
+		median := a.Quantile(0.5)
+		a.Merge(a)
+		if a.Count() != 2000 || a.totalWeight() != 2000 || a.ExactCount() != 2000 {
+			t.Errorf("buffered %v: count %d, weight %g, exact count %g after merging with itself, want 2000",
+				buffered, a.Count(), a.totalWeight(), a.ExactCount())
+		}
+		if got := a.Quantile(0.5); math.Abs(got-median) > 0.05 {
+			t.Errorf("buffered %v: median moved from %g to %g", buffered, median, got)
+		}
+	}
+
+	a := NewWithCompression(100)
+	for _, x := range NormalData[:1000] {
+		a.Add(x, 1)
+	}
+	if err := a.DecayAndMerge(0.5, a); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.totalWeight(); got != 1000 {
+		t.Errorf("weight %g after decaying by half and merging with itself, want 1000", got)
+	}
+}
+
+func TestMergePreferTail(t *testing.T) {
+	sorted := append([]float64(nil), NormalData...)
+	sort.Float64s(sorted)
+	exact := func(q float64) float64 {
+		return sorted[int(q*float64(len(sorted)-1))]
+	}
+
+	coarse := NewWithCompression(20)
+	for _, x := range NormalData[:N/2] {
+		coarse.Add(x, 1)
+	}
+	fine := NewWithCompression(1000)
+	for _, x := range NormalData[N/2:] {
+		fine.Add(x, 1)
+	}
+
+	plain := coarse.Clone().Merge(fine)
+	preferred := coarse.Clone()
+	if err := preferred.MergePreferTail(fine, 0.99); err != nil {
+		t.Fatalf("MergePreferTail err: %v", err)
+	}
+	if got := preferred.Count(); got != N {
+		t.Errorf("unexpected count, got %d want %d", got, int64(N))
+	}
+	if got := preferred.processedWeight; got != N {
+		t.Errorf("unexpected total weight, got %g want %g", got, float64(N))
+	}
+	for i := 1; i < preferred.processed.Len(); i++ {
+		if preferred.processed[i].Mean < preferred.processed[i-1].Mean {
+			t.Fatalf("centroids out of order at %d", i)
+		}
+	}
+	for _, q := range []float64{0.995, 0.999, 0.9999} {
+		plainErr := math.Abs(plain.Quantile(q) - exact(q))
+		preferredErr := math.Abs(preferred.Quantile(q) - exact(q))
+		if preferredErr >= plainErr {
+			t.Errorf("quantile %g: tail not preserved, error %g, plain merge %g", q, preferredErr, plainErr)
+		}
+	}
+	if !preferred.IsMonotonic(10000) {
+		t.Errorf("quantiles decrease across the kept tail")
+	}
+	// The body is merged as usual.
+	if got, want := preferred.Quantile(0.5), exact(0.5); math.Abs(got-want) > 0.01*Sigma {
+		t.Errorf("unexpected median, got %g want %g", got, want)
+	}
+
+	// A rolling aggregate keeps adding after the merge, and the pinned tail
+	// must survive the reprocessing that follows.
+	for _, x := range NormalData[:N/10] {
+		plain.Add(x, 1)
+		preferred.Add(x, 1)
+	}
+	plain.ProcessNow()
+	preferred.ProcessNow()
+	for _, q := range []float64{0.995, 0.999} {
+		plainErr := math.Abs(plain.Quantile(q) - exact(q))
+		preferredErr := math.Abs(preferred.Quantile(q) - exact(q))
+		if preferredErr >= plainErr/2 {
+			t.Errorf("quantile %g: tail lost after more adds, error %g, plain merge %g", q, preferredErr, plainErr)
+		}
+	}
+	if !preferred.IsMonotonic(10000) {
+		t.Errorf("quantiles decrease after adding to the kept tail")
+	}
+	b, err := preferred.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+	decoded := new(TDigest)
+	if err := decoded.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary err: %v", err)
+	}
+	if decoded.tailFrom != preferred.tailFrom || decoded.tailCompression != preferred.tailCompression ||
+		decoded.maxProcessed != preferred.maxProcessed {
+		t.Errorf("pinned tail did not round trip")
+	}
+
+	for _, q := range []float64{-0.1, 1.1, math.NaN()} {
+		if err := preferred.MergePreferTail(fine, q); err != ErrInvalidQuantile {
+			t.Errorf("quantile %g: unexpected err, got %v want %v", q, err, ErrInvalidQuantile)
+		}
+	}
+}
+
+func TestMergeBalanced(t *testing.T) {
+	big := NewWithCompression(1000)
+	for _, x := range UniformData[:100000] {
+		big.Add(x, 1)
+	}
+	small := NewWithCompression(1000)
+	for i := 0; i < 100; i++ {
+		small.Add(1000, 1)
+	}
+
+	merged := MergeBalanced(1000, big, nil, small)
+	if got := merged.processedWeight; got != 100100 {
+		t.Errorf("unexpected total weight, got %g want 100100", got)
+	}
+	if got := merged.Count(); got != 100100 {
+		t.Errorf("unexpected count, got %d want 100100", got)
+	}
+	if got, want := merged.Quantile(0.5), big.Quantile(0.5); math.Abs(got-want) > 0.1 {
+		t.Errorf("unexpected median, got %g want %g", got, want)
+	}
+	// The small shard holds about a thousandth of the weight, all at the top.
+	if got := merged.CDF(100); math.Abs(got-100000.0/100100.0) > 1e-4 {
+		t.Errorf("unexpected CDF below the small shard, got %g want %g", got, 100000.0/100100.0)
+	}
+	if merged.Max() != 1000 || merged.Min() != big.Min() {
+		t.Errorf("unexpected range, got [%g, %g]", merged.Min(), merged.Max())
+	}
+	if small.processedWeight+small.unprocessedWeight != 100 {
+		t.Errorf("input digest was modified")
+	}
+	if got := MergeBalanced(100).Quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("unexpected quantile of empty merge, got %g want NaN", got)
+	}
+}
+
+func TestCombinedQuantile(t *testing.T) {
+	shards := make([]*TDigest, 4)
+	for i := range shards {
+		shards[i] = NewWithCompression(1000)
+	}
+	for i, x := range UniformData {
+		shards[i%len(shards)].Add(x, 1)
+	}
+	for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+		want := UniformDigest.Quantile(q)
+		if got := CombinedQuantile(q, shards...); math.Abs(got-want) > 0.05 {
+			t.Errorf("unexpected quantile %g, got %g want %g", q, got, want)
+		}
+	}
+
+	// Uneven shards are weighted by their total weight.
+	small := NewWithCompression(100)
+	small.Add(1000, 1)
+	if got, want := CombinedQuantile(0.5, UniformDigest, small, nil, New()), UniformDigest.Quantile(0.5); math.Abs(got-want) > 0.05 {
+		t.Errorf("unexpected quantile with uneven shards, got %g want %g", got, want)
+	}
+	if got := CombinedQuantile(1, UniformDigest, small); got != 1000 {
+		t.Errorf("unexpected max, got %g want 1000", got)
+	}
+	if got := CombinedQuantile(0.5); !math.IsNaN(got) {
+		t.Errorf("unexpected quantile of no digests, got %g want NaN", got)
+	}
+}
+
+func TestEffectiveCompression(t *testing.T) {
+	digest := func(compression float64) *TDigest {
+		td := NewWithCompression(compression)
+		for _, x := range UniformData[:1000] {
+			td.Add(x, 1)
+		}
+		return td
+	}
+
+	agg := digest(1000)
+	if got := agg.EffectiveCompression(); got != 1000 {
+		t.Errorf("unexpected effective compression of an unmerged digest, got %g want 1000", got)
+	}
+	agg.Merge(digest(2000))
+	if got := agg.EffectiveCompression(); got != 1000 {
+		t.Errorf("finer source lowered the effective compression to %g", got)
+	}
+
+	// Provenance survives intermediate merges, whichever path they take.
+	mid := MergeBalanced(500, digest(100), digest(300))
+	if got := mid.EffectiveCompression(); got != 100 {
+		t.Errorf("unexpected effective compression of a balanced merge, got %g want 100", got)
+	}
+	agg.Merge(mid)
+	if got := agg.EffectiveCompression(); got != 100 {
+		t.Errorf("unexpected effective compression, got %g want 100", got)
+	}
+	if got := agg.Clone().EffectiveCompression(); got != 100 {
+		t.Errorf("clone lost the effective compression, got %g want 100", got)
+	}
+	agg.Merge(NewWithCompression(10))
+	if got := agg.EffectiveCompression(); got != 100 {
+		t.Errorf("empty source lowered the effective compression to %g", got)
+	}
+	b, err := agg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+	decoded := new(TDigest)
+	if err := decoded.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary err: %v", err)
+	}
+	if got := decoded.EffectiveCompression(); got != 100 {
+		t.Errorf("decoding lost the effective compression, got %g want 100", got)
+	}
+	tail := digest(1000)
+	if err := tail.MergePreferTail(digest(50), 0.9); err != nil {
+		t.Fatalf("MergePreferTail err: %v", err)
+	}
+	if got := tail.EffectiveCompression(); got != 50 {
+		t.Errorf("unexpected effective compression after MergePreferTail, got %g want 50", got)
+	}
+
+	agg.ClearKeepingCapacity()
+	if got := agg.EffectiveCompression(); got != 1000 {
+		t.Errorf("unexpected effective compression after clearing, got %g want 1000", got)
+	}
+}
+
+func TestMergeDownsampling(t *testing.T) {
+	leaf := NewWithCompression(500)
+	for _, x := range NormalData[:N/2] {
+		leaf.Add(x, 1)
+	}
+	other := NewWithCompression(500)
+	for _, x := range NormalData[N/2:] {
+		other.Add(x, 1)
+	}
+
+	got := leaf.Clone()
+	if err := got.MergeDownsampling(other, 50); err != nil {
+		t.Fatalf("MergeDownsampling err: %v", err)
+	}
+	if got.Compression != 50 || got.Count() != N {
+		t.Errorf("compression %g, count %d after downsampling", got.Compression, got.Count())
+	}
+	want := NewWithCompression(50)
+	for _, x := range NormalData {
+		want.Add(x, 1)
+	}
+	if n := got.processed.Len(); n > want.processed.Len()+5 {
+		t.Errorf("%d centroids after downsampling to 50, a fresh digest has %d", n, want.processed.Len())
+	}
+	// Re-clustering coarse centroids is less accurate in the tails than
+	// building at the lower compression from the start.
+	for _, q := range []float64{0.01, 0.5, 0.99} {
+		if d := math.Abs(got.Quantile(q) - NormalDigest.Quantile(q)); d > 0.1 {
+			t.Errorf("quantile %g off by %g", q, d)
+		}
+	}
+
+	// Nothing buffered still re-clusters at the new compression.
+	alone := other.Clone()
+	if err := alone.MergeDownsampling(nil, 20); err != nil {
+		t.Fatalf("MergeDownsampling err: %v", err)
+	}
+	if n := alone.processed.Len(); n >= other.processed.Len()/2 {
+		t.Errorf("%d centroids after downsampling alone, had %d", n, other.processed.Len())
+	}
+
+	if err := leaf.MergeDownsampling(other, math.NaN()); err != ErrInvalidCompression {
+		t.Errorf("NaN compression err: %v", err)
+	}
+	if leaf.Compression != 500 || leaf.Count() != N/2 {
+		t.Errorf("failed call modified the digest")
+	}
+}
+
+func TestMergeUnique(t *testing.T) {
+	shard := NewWithCompression(100)
+	for _, x := range UniformData[:1000] {
+		shard.Add(x, 1)
+	}
+	other := NewWithCompression(100)
+	for _, x := range UniformData[1000:1500] {
+		other.Add(x, 1)
+	}
+
+	td := NewWithCompression(100)
+	seen := map[string]bool{}
+	for _, tc := range []struct {
+		digest *TDigest
+		id     string
+		merged bool
+		count  int64
+	}{
+		{shard, "a", true, 1000},
+		{shard, "a", false, 1000},
+		{other, "b", true, 1500},
+		{shard, "a", false, 1500},
+	} {
+		if got := td.MergeUnique(tc.digest, tc.id, seen); got != tc.merged {
+			t.Errorf("merging %q: got %v want %v", tc.id, got, tc.merged)
+		}
+		if td.Count() != tc.count {
+			t.Errorf("after %q: unexpected count, got %d want %d", tc.id, td.Count(), tc.count)
+		}
+	}
+	if len(seen) != 2 || !seen["a"] || !seen["b"] {
+		t.Errorf("unexpected seen set %v", seen)
+	}
+}
+
+func TestConvolveShift(t *testing.T) {
+	src := NewWithCompression(200)
+	for _, x := range UniformData[:100000] {
+		src.Add(x, 1)
+	}
+	before := src.Quantile(0.5)
+
+	// Shifting every value with probability 1/2 by 100 moves the lower half
+	// of the mixture to [0, 100) and the upper half to [100, 200).
+	got := src.ConvolveShift(100, 1)
+	if got.Count() != 200000 || got.Min() != src.Min() || got.Max() != src.Max()+100 {
+		t.Errorf("unexpected summary, count %d range [%g, %g]", got.Count(), got.Min(), got.Max())
+	}
+	for _, q := range []float64{0.1, 0.25, 0.5, 0.75, 0.9} {
+		if v, want := got.Quantile(q), 200*q; math.Abs(v-want) > 0.5 {
+			t.Errorf("quantile %g: got %g want %g", q, v, want)
+		}
+	}
+	if math.Abs(got.Mean()-(src.Mean()+50)) > 1e-6 {
+		t.Errorf("unexpected mean %g, want %g", got.Mean(), src.Mean()+50)
+	}
+
+	// A small, light jitter nudges the tail, not the body.
+	jittered := src.ConvolveShift(5, 0.1)
+	if math.Abs(jittered.CDF(50)-(src.CDF(50)*10+src.CDF(45))/11) > 1e-3 {
+		t.Errorf("unexpected jittered CDF at 50, got %g", jittered.CDF(50))
+	}
+	if src.Quantile(0.5) != before || src.Count() != 100000 {
+		t.Errorf("source digest was modified")
+	}
+	for _, args := range [][2]float64{{math.NaN(), 1}, {math.Inf(1), 1}, {1, 0}, {1, -1}, {1, math.Inf(1)}} {
+		if src.ConvolveShift(args[0], args[1]) != nil {
+			t.Errorf("expected nil for shift %g and weight %g", args[0], args[1])
+		}
+	}
+
+	// With values buffered, a decaying digest clusters later values as
+	// though it had not been convolved.
+	quiet := NewWithDecay(100, 0.9, 1<<30)
+	convolved := NewWithDecay(100, 0.9, 1<<30)
+	for i, x := range NormalData[:5000] {
+		quiet.Add(x, 1)
+		convolved.Add(x, 1)
+		if i%100 == 0 {
+			convolved.ConvolveShift(1, 1)
+		}
+	}
+	quiet.ProcessNow()
+	convolved.ProcessNow()
+	if !reflect.DeepEqual(quiet.processed, convolved.processed) {
+		t.Errorf("convolving changed how later values were clustered")
+	}
+}
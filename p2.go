@@ -0,0 +1,199 @@
+package tdigest
+
+import (
+	"math"
+	"sort"
+)
+
+// Estimator is the query and update surface shared by the estimators in this
+// package, so callers can swap a TDigest for a cheaper P2 and back.
+type Estimator interface {
+	Add(x, w float64)
+	Quantile(q float64) float64
+	CDF(x float64) float64
+}
+
+var (
+	_ Estimator = (*TDigest)(nil)
+	_ Estimator = (*P2)(nil)
+)
+
+// P2 estimates a fixed set of quantiles with the P² algorithm of Jain and
+// Chlamtac, extended to several quantiles as described by Raatikainen. It
+// keeps 2m+3 markers for m quantiles, so memory is constant regardless of how
+// many values are added, at the cost of only being accurate near the
+// configured quantiles.
+type P2 struct {
+	p      []float64 // quantile each marker tracks
+	h      []float64 // marker heights
+	n      []float64 // marker positions
+	np     []float64 // desired marker positions
+	weight float64
+}
+
+// NewP2 returns a P2 estimator tracking the given quantiles. Quantiles
+// outside (0, 1) are ignored.
+func NewP2(quantiles []float64) *P2 {
+	qs := make([]float64, 0, len(quantiles))
+	for _, q := range quantiles {
+		if q > 0 && q < 1 {
+			qs = append(qs, q)
+		}
+	}
+	sort.Float64s(qs)
+
+	p := make([]float64, 0, 2*len(qs)+3)
+	p = append(p, 0)
+	prev := 0.0
+	for _, q := range qs {
+		if q == prev {
+			continue
+		}
+		p = append(p, (prev+q)/2.0, q)
+		prev = q
+	}
+	p = append(p, (prev+1.0)/2.0, 1)
+
+	return &P2{
+		p:  p,
+		h:  make([]float64, 0, len(p)),
+		n:  make([]float64, 0, len(p)),
+		np: make([]float64, len(p)),
+	}
+}
+
+// Add adds x with weight w. Weights advance the marker positions by w rather
+// than by one, which keeps the estimate unbiased but makes the parabolic
+// adjustment coarser when individual weights are large. NaN values and
+// non-positive weights are ignored.
+func (e *P2) Add(x, w float64) {
+	if math.IsNaN(x) || !(w > 0) {
+		return
+	}
+	e.weight += w
+
+	if len(e.h) < len(e.p) {
+		e.addInitial(x, w)
+		return
+	}
+
+	last := len(e.h) - 1
+	var k int
+	switch {
+	case x < e.h[0]:
+		e.h[0] = x
+		k = 0
+	case x >= e.h[last]:
+		e.h[last] = x
+		k = last - 1
+	default:
+		k = sort.Search(last, func(i int) bool {
+			return e.h[i+1] > x
+		})
+	}
+	for i := k + 1; i <= last; i++ {
+		e.n[i] += w
+	}
+	for i := range e.np {
+		e.np[i] += w * e.p[i]
+	}
+
+	for i := 1; i < last; i++ {
+		e.adjust(i)
+	}
+}
+
+// addInitial inserts x into the markers while there are fewer values than
+// markers, keeping heights sorted and positions cumulative.
+func (e *P2) addInitial(x, w float64) {
+	i := sort.Search(len(e.h), func(i int) bool {
+		return e.h[i] > x
+	})
+	e.h = append(e.h, 0)
+	copy(e.h[i+1:], e.h[i:])
+	e.h[i] = x
+
+	e.n = append(e.n, 0)
+	prev := 0.0
+	if i > 0 {
+		prev = e.n[i-1]
+	}
+	copy(e.n[i+1:], e.n[i:])
+	e.n[i] = prev
+	for j := i; j < len(e.n); j++ {
+		e.n[j] += w
+	}
+
+	if len(e.h) == len(e.p) {
+		for j := range e.np {
+			e.np[j] = 1 + (e.weight-1)*e.p[j]
+		}
+	}
+}
+
+func (e *P2) adjust(i int) {
+	d := e.np[i] - e.n[i]
+	if (d >= 1 && e.n[i+1]-e.n[i] > 1) || (d <= -1 && e.n[i-1]-e.n[i] < -1) {
+		ds := math.Copysign(1, d)
+		h := e.parabolic(i, ds)
+		if e.h[i-1] < h && h < e.h[i+1] {
+			e.h[i] = h
+		} else {
+			e.h[i] = e.linear(i, ds)
+		}
+		e.n[i] += ds
+	}
+}
+
+func (e *P2) parabolic(i int, d float64) float64 {
+	n0, n1, n2 := e.n[i-1], e.n[i], e.n[i+1]
+	h0, h1, h2 := e.h[i-1], e.h[i], e.h[i+1]
+	return h1 + d/(n2-n0)*((n1-n0+d)*(h2-h1)/(n2-n1)+(n2-n1-d)*(h1-h0)/(n1-n0))
+}
+
+func (e *P2) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return e.h[i] + d*(e.h[j]-e.h[i])/(e.n[j]-e.n[i])
+}
+
+// Quantile returns the estimated value at quantile q, interpolating between
+// markers. Estimates are only reliable for the quantiles passed to NewP2.
+func (e *P2) Quantile(q float64) float64 {
+	if q < 0 || q > 1 || len(e.h) == 0 {
+		return math.NaN()
+	}
+	last := len(e.h) - 1
+	pos := 1 + (e.weight-1)*q
+	if pos <= e.n[0] {
+		return e.h[0]
+	}
+	if pos >= e.n[last] {
+		return e.h[last]
+	}
+	i := sort.Search(last, func(i int) bool {
+		return e.n[i+1] > pos
+	})
+	return e.h[i] + (pos-e.n[i])/(e.n[i+1]-e.n[i])*(e.h[i+1]-e.h[i])
+}
+
+// CDF returns the estimated fraction of weight at or below x.
+func (e *P2) CDF(x float64) float64 {
+	if len(e.h) == 0 {
+		return 0.0
+	}
+	last := len(e.h) - 1
+	if x < e.h[0] {
+		return 0.0
+	}
+	if x >= e.h[last] || e.weight <= 1 {
+		return 1.0
+	}
+	i := sort.Search(last, func(i int) bool {
+		return e.h[i+1] > x
+	})
+	pos := e.n[i]
+	if e.h[i+1] > e.h[i] {
+		pos += (x - e.h[i]) / (e.h[i+1] - e.h[i]) * (e.n[i+1] - e.n[i])
+	}
+	return math.Max(0, math.Min(1, (pos-1)/(e.weight-1)))
+}
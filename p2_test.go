@@ -0,0 +1,91 @@
+package tdigest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestP2_Quantile(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []float64
+		quantile float64
+		want     float64
+		epsilon  float64
+	}{
+		{
+			name:     "increasing",
+			quantile: 0.5,
+			data:     []float64{1, 2, 3, 4, 5},
+			want:     3,
+		},
+		{
+			name:     "small",
+			quantile: 0.5,
+			data:     []float64{1, 2, 3, 4, 5, 5, 4, 3, 2, 1},
+			want:     3,
+			epsilon:  0.5,
+		},
+		{
+			name:     "normal 50",
+			quantile: 0.5,
+			data:     NormalData,
+			want:     Mu,
+			epsilon:  0.05,
+		},
+		{
+			name:     "normal 90",
+			quantile: 0.9,
+			data:     NormalData,
+			want:     13.84,
+			epsilon:  0.05,
+		},
+		{
+			name:     "uniform 99",
+			quantile: 0.99,
+			data:     UniformData,
+			want:     99,
+			epsilon:  0.1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewP2([]float64{0.5, 0.9, 0.99})
+			for _, x := range tt.data {
+				e.Add(x, 1)
+			}
+			got := e.Quantile(tt.quantile)
+			if math.Abs(got-tt.want) > tt.epsilon {
+				t.Errorf("unexpected quantile %f, got %g want %g", tt.quantile, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestP2_CDF(t *testing.T) {
+	e := NewP2([]float64{0.1, 0.5, 0.9})
+	for _, x := range UniformData {
+		e.Add(x, 1)
+	}
+	for _, x := range []float64{10, 50, 90} {
+		if got := e.CDF(x); math.Abs(got-x/100) > 0.005 {
+			t.Errorf("unexpected CDF %f, got %g want %g", x, got, x/100)
+		}
+	}
+	if got := e.CDF(-1); got != 0 {
+		t.Errorf("unexpected CDF below min, got %g want 0", got)
+	}
+	if got := e.CDF(101); got != 1 {
+		t.Errorf("unexpected CDF above max, got %g want 1", got)
+	}
+}
+
+func TestP2_Empty(t *testing.T) {
+	e := NewP2([]float64{0.5})
+	if got := e.Quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("unexpected quantile of empty estimator, got %g want NaN", got)
+	}
+	if got := e.CDF(0); got != 0 {
+		t.Errorf("unexpected CDF of empty estimator, got %g want 0", got)
+	}
+}
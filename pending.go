@@ -0,0 +1,115 @@
+package tdigest
+
+// pendingMerge holds a decaying digest's centroids and buffer as they stood
+// before a query merged the buffer early. The next change to the digest
+// resumes from them, so the centroids only ever advance by merges at the
+// points an unqueried digest would make them: when the buffer fills, on decay,
+// and on merges, clones, serialization and ProcessNow. The slices are kept
+// between queries as scratch, so querying a digest allocates nothing once
+// they have grown.
+type pendingMerge struct {
+	active            bool
+	processed         CentroidList
+	unprocessed       CentroidList
+	cumulative        []float64
+	processedWeight   float64
+	unprocessedWeight float64
+	processedTimes    []int64
+	unprocessedTimes  []int64
+	processedExamples [][]float64
+}
+
+// processForQuery brings the centroids up to date for a read-only query like
+// process. On a decaying digest it remembers the state before the merge, so
+// that the query leaves no trace on how later values are clustered and decay
+// stays tied to the add count alone. Other digests merge for good, as they
+// always have, which keeps repeated queries on a growing buffer cheap.
+func (t *TDigest) processForQuery() {
+	if !t.Dirty() {
+		return
+	}
+	if t.decayValue <= 0 {
+		t.process()
+		return
+	}
+	t.resumePending()
+	p := t.pending
+	if p == nil {
+		p = &pendingMerge{}
+		t.pending = p
+	}
+	p.active = true
+	p.processed = copyCentroids(p.processed, t.processed)
+	p.unprocessed = copyCentroids(p.unprocessed, t.unprocessed)
+	p.cumulative = append(p.cumulative[:0], t.cumulative...)
+	p.processedWeight = t.processedWeight
+	p.unprocessedWeight = t.unprocessedWeight
+	p.processedTimes = copyTimes(p.processedTimes, t.processedTimes)
+	p.unprocessedTimes = copyTimes(p.unprocessedTimes, t.unprocessedTimes)
+	// Merging rewrites example sets in place, so copy each of them. Only
+	// the sets within the scratch's length are its own; those past it may
+	// be stale aliases of them.
+	if t.processedExamples == nil {
+		p.processedExamples = nil
+	} else {
+		examples := p.processedExamples
+		for i, e := range t.processedExamples {
+			if i < len(examples) {
+				examples[i] = append(examples[i][:0], e...)
+			} else {
+				examples = append(examples, append([]float64(nil), e...))
+			}
+		}
+		p.processedExamples = examples[:len(t.processedExamples)]
+	}
+	t.processIt(true)
+}
+
+// resumePending discards the result of the last query's merge and restores
+// the state it started from. Values buffered since then follow the restored
+// buffer, as they would have had the query not merged it. Every path that
+// changes the centroids or the buffer calls it first. The merged slices are
+// swapped into p as scratch for the next query.
+func (t *TDigest) resumePending() {
+	p := t.pending
+	if p == nil || !p.active {
+		return
+	}
+	p.active = false
+	t.processed, p.processed = p.processed, t.processed
+	t.cumulative, p.cumulative = p.cumulative, t.cumulative
+	t.processedWeight = p.processedWeight
+	t.processedTimes, p.processedTimes = p.processedTimes, t.processedTimes
+	t.processedExamples, p.processedExamples = p.processedExamples, t.processedExamples
+	p.unprocessed = append(p.unprocessed, t.unprocessed...)
+	t.unprocessed, p.unprocessed = p.unprocessed, t.unprocessed[:0]
+	t.unprocessedWeight += p.unprocessedWeight
+	if p.unprocessedTimes != nil {
+		p.unprocessedTimes = append(p.unprocessedTimes, t.unprocessedTimes...)
+		t.unprocessedTimes, p.unprocessedTimes = p.unprocessedTimes, t.unprocessedTimes[:0]
+	}
+	t.invalidateQuantiles()
+}
+
+// copyCentroids copies src into dst's storage, giving it src's capacity if
+// it is nil or too small, and keeps a nil src nil.
+func copyCentroids(dst, src CentroidList) CentroidList {
+	if src == nil {
+		return nil
+	}
+	if dst == nil || cap(dst) < len(src) {
+		dst = make(CentroidList, 0, cap(src))
+	}
+	return append(dst[:0], src...)
+}
+
+// copyTimes is copyCentroids for timestamps.
+func copyTimes(dst, src []int64) []int64 {
+	if src == nil {
+		return nil
+	}
+	if dst == nil || cap(dst) < len(src) {
+		dst = make([]int64, 0, cap(src))
+	}
+	return append(dst[:0], src...)
+}
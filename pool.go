@@ -0,0 +1,47 @@
+package tdigest
+
+import "sync"
+
+var digestPool = sync.Pool{
+	New: func() interface{} { return new(TDigest) },
+}
+
+// NewPooled is like NewWithCompression but reuses the buffers of a digest
+// previously returned with Release, when one is available.
+func NewPooled(compression float64) *TDigest {
+	t := digestPool.Get().(*TDigest)
+	t.reset(compression)
+	return t
+}
+
+// Release returns t to the pool used by NewPooled. t, and anything sharing
+// its buffers, must not be used after Release.
+func (t *TDigest) Release() {
+	digestPool.Put(t)
+}
+
+// QuantileOf returns the quantile q of data, as estimated by a digest with the
+// given compression. The digest is taken from an internal pool and processed
+// exactly once, so repeated calls allocate little beyond the first.
+func QuantileOf(compression float64, q float64, data []float64) float64 {
+	t := oneShot(compression, data)
+	defer t.Release()
+	return t.Quantile(q)
+}
+
+// CDFOf returns the CDF of data at x, as estimated by a digest with the given
+// compression. See QuantileOf.
+func CDFOf(compression float64, x float64, data []float64) float64 {
+	t := oneShot(compression, data)
+	defer t.Release()
+	return t.CDF(x)
+}
+
+func oneShot(compression float64, data []float64) *TDigest {
+	t := NewPooled(compression)
+	for _, x := range data {
+		t.Add(x, 1)
+	}
+	t.process()
+	return t
+}
@@ -0,0 +1,73 @@
+package tdigest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestQuantileOf(t *testing.T) {
+	for _, q := range []float64{0.1, 0.5, 0.9, 0.99} {
+		want := UniformDigest.Quantile(q)
+		if got := QuantileOf(1000, q, UniformData); got != want {
+			t.Errorf("unexpected quantile %f, got %g want %g", q, got, want)
+		}
+	}
+	// A second call must not see values left over from the pooled digest.
+	if got := QuantileOf(1000, 0.5, []float64{1, 2, 3, 4, 5}); got != 3 {
+		t.Errorf("unexpected quantile from reused digest, got %g want 3", got)
+	}
+}
+
+func TestCDFOf(t *testing.T) {
+	for _, x := range []float64{10, 50, 90} {
+		want := UniformDigest.CDF(x)
+		if got := CDFOf(1000, x, UniformData); got != want {
+			t.Errorf("unexpected CDF %f, got %g want %g", x, got, want)
+		}
+	}
+	if got := CDFOf(100, 4, []float64{1, 2, 3, 4, 5, 5, 4, 3, 2, 1}); got != 0.75 {
+		t.Errorf("unexpected CDF from reused digest, got %g want 0.75", got)
+	}
+}
+
+func BenchmarkQuantileOf(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		QuantileOf(benchmarkCompression, 0.99, NormalData[:10000])
+	}
+}
+
+func TestNewPooled(t *testing.T) {
+	td := NewPooled(100)
+	for _, x := range UniformData[:10000] {
+		td.Add(x, 1)
+	}
+	td.Release()
+
+	td = NewPooled(100)
+	if td.Count() != 0 || td.processed.Len() != 0 || td.unprocessed.Len() != 0 {
+		t.Fatalf("expected an empty digest from the pool")
+	}
+	for _, x := range []float64{1, 2, 3, 4, 5} {
+		td.Add(x, 1)
+	}
+	if got := td.Quantile(0.5); got != 3 {
+		t.Errorf("unexpected quantile from pooled digest, got %g want 3", got)
+	}
+	td.Release()
+
+	td = NewPooled(10)
+	if td.Compression != 10 || td.maxProcessed != td.Scaler.MaxCentroids(10, math.Inf(1)) {
+		t.Errorf("pooled digest not resized for new compression")
+	}
+}
+
+func BenchmarkNewPooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		td := NewPooled(benchmarkCompression)
+		td.Add(NormalData[i%len(NormalData)], 1)
+		td.Quantile(0.5)
+		td.Release()
+	}
+}
@@ -0,0 +1,70 @@
+package tdigest
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// quantileCacheSize bounds how many distinct quantiles are remembered between
+// changes to a digest. Callers typically query a handful of fixed quantiles.
+const quantileCacheSize = 8
+
+// quantileCache holds recent Quantile results for one processed state. It is
+// never modified once stored, so concurrent readers of a Snapshot can share it
+// and a miss replaces it with an extended copy.
+type quantileCache struct {
+	q, v []float64
+}
+
+func (c *quantileCache) lookup(q float64) (float64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	for i, cq := range c.q {
+		if cq == q {
+			return c.v[i], true
+		}
+	}
+	return 0, false
+}
+
+// with returns a copy of c that also holds q, dropping the oldest entry when
+// the cache is full.
+func (c *quantileCache) with(q, v float64) *quantileCache {
+	n := &quantileCache{
+		q: make([]float64, 0, quantileCacheSize),
+		v: make([]float64, 0, quantileCacheSize),
+	}
+	if c != nil {
+		start := 0
+		if len(c.q) == quantileCacheSize {
+			start = 1
+		}
+		n.q = append(n.q, c.q[start:]...)
+		n.v = append(n.v, c.v[start:]...)
+	}
+	n.q = append(n.q, q)
+	n.v = append(n.v, v)
+	return n
+}
+
+// missedBefore reports whether q recently missed the cache, recording it if
+// not. Only quantiles asked for more than once are cached, so that a stream of
+// distinct queries does not allocate a new cache on every call.
+func (t *TDigest) missedBefore(q float64) bool {
+	bits := math.Float64bits(q)
+	for i := range t.quantileMisses {
+		if atomic.LoadUint64(&t.quantileMisses[i]) == bits {
+			return true
+		}
+	}
+	i := atomic.AddUint32(&t.quantileMissNext, 1) % quantileCacheSize
+	atomic.StoreUint64(&t.quantileMisses[i], bits)
+	return false
+}
+
+// invalidateQuantiles forgets cached quantiles. It must be called whenever
+// the processed centroids, their weights or the bounds change.
+func (t *TDigest) invalidateQuantiles() {
+	t.quantiles = atomic.Value{}
+}
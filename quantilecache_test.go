@@ -0,0 +1,91 @@
+package tdigest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestQuantileCache(t *testing.T) {
+	td := New()
+	for _, x := range UniformData[:10000] {
+		td.Add(x, 1)
+	}
+	td.ProcessNow()
+	want := td.quantile(0.99)
+	for i := 0; i < 3; i++ {
+		if got := td.Quantile(0.99); got != want {
+			t.Fatalf("unexpected cached quantile, got %g want %g", got, want)
+		}
+	}
+	if _, ok := cachedQuantile(td, 0.99); !ok {
+		t.Errorf("expected repeated quantile to be cached")
+	}
+
+	for i := 0; i < 1000; i++ {
+		td.Add(1000, 1)
+	}
+	if got := td.Quantile(0.99); got == want {
+		t.Errorf("cached quantile survived an add, got %g", got)
+	}
+
+	td.Quantile(0.5)
+	td.Quantile(0.5)
+	if err := td.DecayAndMerge(2, nil); err != nil {
+		t.Fatalf("DecayAndMerge err: %v", err)
+	}
+	if _, ok := cachedQuantile(td, 0.5); ok {
+		t.Errorf("cached quantile survived rescaling")
+	}
+
+	for _, q := range []float64{-1, 2} {
+		td.Quantile(q)
+		if got := td.Quantile(q); !math.IsNaN(got) {
+			t.Errorf("unexpected quantile %g, got %g want NaN", q, got)
+		}
+	}
+}
+
+func TestQuantileCacheEviction(t *testing.T) {
+	td := New()
+	for _, x := range UniformData[:10000] {
+		td.Add(x, 1)
+	}
+	td.ProcessNow()
+	for i := 0; i < 2*quantileCacheSize; i++ {
+		q := float64(i) / (2 * quantileCacheSize)
+		for j := 0; j < 2; j++ {
+			if got, want := td.Quantile(q), td.quantile(q); got != want {
+				t.Errorf("unexpected quantile %g, got %g want %g", q, got, want)
+			}
+		}
+	}
+	if c := td.quantiles.Load().(*quantileCache); len(c.q) != quantileCacheSize {
+		t.Errorf("unexpected cache size, got %d want %d", len(c.q), quantileCacheSize)
+	}
+}
+
+func cachedQuantile(td *TDigest, q float64) (float64, bool) {
+	c, _ := td.quantiles.Load().(*quantileCache)
+	return c.lookup(q)
+}
+
+func BenchmarkQuantileRepeated(b *testing.B) {
+	td := NewWithCompression(benchmarkCompression)
+	for _, x := range NormalData[:100000] {
+		td.Add(x, 1)
+	}
+	td.ProcessNow()
+
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			td.Quantile(0.99)
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			td.quantile(0.99)
+		}
+	})
+}
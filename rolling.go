@@ -0,0 +1,71 @@
+package tdigest
+
+// RollingMerge aggregates the most recent windows of a batch pipeline. Digests
+// cannot subtract, so rather than removing the oldest window's values from a
+// running total, it keeps each live window and merges them on demand. Windows
+// advance only by Push, never by time. It is not safe for concurrent use.
+type RollingMerge struct {
+	windows []*TDigest
+	next    int
+	merged  *TDigest
+}
+
+// NewRollingMerge returns an aggregate over the last windows pushed digests.
+// A windows of less than one is treated as one.
+func NewRollingMerge(windows int) *RollingMerge {
+	if windows < 1 {
+		windows = 1
+	}
+	return &RollingMerge{windows: make([]*TDigest, windows)}
+}
+
+// Push adds a copy of window as the newest window, dropping the oldest once
+// the ring is full. window is not modified and may be reused after the call.
+// A nil window counts as an empty one, so a batch without data still ages the
+// others out.
+func (r *RollingMerge) Push(window *TDigest) {
+	if window != nil {
+		window = window.Clone()
+	}
+	r.windows[r.next] = window
+	r.next = (r.next + 1) % len(r.windows)
+	r.merged = nil
+}
+
+// Merged returns the union of the live windows, at the compression of the
+// newest one. It is computed once per Push and shared by later calls until the
+// next, so Clone it before adding to it. With no windows it is an empty
+// digest.
+func (r *RollingMerge) Merged() *TDigest {
+	if r.merged != nil {
+		return r.merged
+	}
+	compression := 1000.0
+	live := make([]*TDigest, 0, len(r.windows))
+	for i := range r.windows {
+		// oldest first, so the newest window sets the compression
+		w := r.windows[(r.next+i)%len(r.windows)]
+		if w == nil {
+			continue
+		}
+		live = append(live, w)
+		compression = w.Compression
+	}
+	r.merged = MergeBalanced(compression, live...)
+	return r.merged
+}
+
+// Quantile returns quantile q of the live windows combined.
+func (r *RollingMerge) Quantile(q float64) float64 {
+	return r.Merged().Quantile(q)
+}
+
+// CDF returns the CDF at x of the live windows combined.
+func (r *RollingMerge) CDF(x float64) float64 {
+	return r.Merged().CDF(x)
+}
+
+// Count returns the number of values in the live windows.
+func (r *RollingMerge) Count() int64 {
+	return r.Merged().Count()
+}
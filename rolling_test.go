@@ -0,0 +1,61 @@
+package tdigest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRollingMerge(t *testing.T) {
+	window := func(lo int) *TDigest {
+		td := NewWithCompression(1000)
+		for i := lo; i < lo+100; i++ {
+			td.Add(float64(i), 1)
+		}
+		return td
+	}
+
+	r := NewRollingMerge(3)
+	if got := r.Count(); got != 0 {
+		t.Errorf("unexpected count of no windows, got %d", got)
+	}
+	if got := r.Quantile(0.5); !math.IsNaN(got) {
+		t.Errorf("unexpected quantile of no windows, got %g want NaN", got)
+	}
+
+	w := window(0)
+	r.Push(w)
+	w.Add(1e6, 1)
+	if got := r.Merged().Max(); got != 99 {
+		t.Errorf("pushed window aliased the caller's digest, max %g", got)
+	}
+	r.Push(window(100))
+	r.Push(window(200))
+	if got := r.Count(); got != 300 {
+		t.Errorf("unexpected count, got %d want 300", got)
+	}
+	if got := r.Quantile(0.5); math.Abs(got-150) > 1 {
+		t.Errorf("unexpected median, got %g want 150", got)
+	}
+
+	// The fourth window evicts the first.
+	r.Push(window(300))
+	if got := r.Merged().Min(); got != 100 {
+		t.Errorf("oldest window not evicted, min %g want 100", got)
+	}
+	if got := r.CDF(200); math.Abs(got-1.0/3.0) > 0.01 {
+		t.Errorf("unexpected CDF, got %g want %g", got, 1.0/3.0)
+	}
+	if r.Merged() != r.Merged() {
+		t.Errorf("merged view recomputed without a Push")
+	}
+
+	// Empty batches age the rest out.
+	r.Push(nil)
+	r.Push(nil)
+	if got := r.Count(); got != 100 {
+		t.Errorf("unexpected count after empty windows, got %d want 100", got)
+	}
+	if got := NewRollingMerge(0).windows; len(got) != 1 {
+		t.Errorf("unexpected ring size for 0 windows, got %d want 1", len(got))
+	}
+}
@@ -2,31 +2,127 @@ package tdigest
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"math"
+	"sort"
 )
 
 const (
 	magic           = int16(0xc80)
 	encodingVersion = int32(1)
+
+	// encodingVersionFloat32 is encodingVersion with centroid weights and
+	// means stored as float32 and without the cumulative weights, which
+	// are recomputed on decoding.
+	encodingVersionFloat32 = int32(2)
+
+	// encodingVersionChecksum is encodingVersion followed by the CRC-32
+	// (IEEE) of all preceding bytes, as a little-endian uint32.
+	encodingVersionChecksum = int32(3)
+
+	// encodingVersionTimestamps is encodingVersion followed by the number of
+	// centroid timestamps, as an int32, and each one as UnixNano int64.
+	encodingVersionTimestamps = int32(4)
+
+	// encodingVersionExtended is encodingVersion followed by a uint8 set of
+	// extendedTimestamps, extendedExactTotals, extendedPinnedTail and
+	// extendedEffectiveCompression flags, then the timestamps as in
+	// encodingVersionTimestamps, the exact totals as four float64s, the sum
+	// and compensation of ExactSum and then of ExactCount, the start and
+	// compression of the tail pinned by MergePreferTail as two float64s, and
+	// EffectiveCompression as a float64, each only if flagged. The float32,
+	// checksum and delta versions end with the same flags and sections,
+	// before any checksum, when any flag is set.
+	encodingVersionExtended = int32(5)
+
+	// encodingVersionDelta is encodingVersion with each centroid mean stored
+	// as a uint64 delta, modulo 2^64, from the previous mean's sortable bits,
+	// see sortableBits, starting from zero.
+	encodingVersionDelta = int32(6)
+
+	extendedTimestamps  = uint8(1)
+	extendedExactTotals = uint8(2)
+	extendedPinnedTail  = uint8(4)
+
+	extendedEffectiveCompression = uint8(8)
+
+	// namedMagic starts a MarshalNamed blob, distinguishing it from a single
+	// digest.
+	namedMagic = int16(0xc81)
+)
+
+var (
+	_ encoding.BinaryMarshaler   = (*TDigest)(nil)
+	_ encoding.BinaryUnmarshaler = (*TDigest)(nil)
 )
 
 func marshalBinary(d *TDigest) ([]byte, error) {
+	switch flags := extensionFlags(d); {
+	case flags&^extendedTimestamps != 0:
+		return marshalBinaryVersion(d, encodingVersionExtended)
+	case flags != 0:
+		return marshalBinaryVersion(d, encodingVersionTimestamps)
+	}
+	return marshalBinaryVersion(d, encodingVersion)
+}
+
+// extensionFlags returns the extended sections needed to encode all of d.
+func extensionFlags(d *TDigest) uint8 {
+	var flags uint8
+	if d.keepTimes {
+		flags |= extendedTimestamps
+	}
+	if d.keepExact {
+		flags |= extendedExactTotals
+	}
+	if d.tailCompression > 0 {
+		flags |= extendedPinnedTail
+	}
+	if d.EffectiveCompression() < d.Compression {
+		flags |= extendedEffectiveCompression
+	}
+	return flags
+}
+
+func marshalBinaryVersion(d *TDigest, version int32) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
 	w := &binaryBufferWriter{buf: buf}
 	w.writeValue(magic)
-	w.writeValue(encodingVersion)
+	w.writeValue(version)
 	w.writeValue(d.Compression)
 	w.writeValue(int32(len(d.processed)))
+	var prev uint64
 	for _, c := range d.processed {
+		if version == encodingVersionFloat32 {
+			wt, m := float32(c.Weight), float32(c.Mean)
+			if math.IsInf(float64(wt), 0) {
+				return nil, fmt.Errorf("centroid weight %v overflows float32", c.Weight)
+			}
+			if math.IsInf(float64(m), 0) {
+				return nil, fmt.Errorf("centroid mean %v overflows float32", c.Mean)
+			}
+			w.writeValue(wt)
+			w.writeValue(m)
+			continue
+		}
 		w.writeValue(c.Weight)
-		w.writeValue(c.Mean)
+		if version == encodingVersionDelta {
+			bits := sortableBits(c.Mean)
+			w.writeValue(bits - prev)
+			prev = bits
+		} else {
+			w.writeValue(c.Mean)
+		}
 	}
-	w.writeValue(int32(len(d.cumulative)))
-	for _, c := range d.cumulative {
-		w.writeValue(c)
+	if version != encodingVersionFloat32 {
+		w.writeValue(int32(len(d.cumulative)))
+		for _, c := range d.cumulative {
+			w.writeValue(c)
+		}
 	}
 	w.writeValue(d.decayCount)
 	w.writeValue(d.decayEvery)
@@ -34,6 +130,43 @@ func marshalBinary(d *TDigest) ([]byte, error) {
 	w.writeValue(d.count)
 	w.writeValue(d.min)
 	w.writeValue(d.max)
+	var flags uint8
+	switch version {
+	case encodingVersionTimestamps:
+		flags = extendedTimestamps
+	case encodingVersionExtended:
+		flags = extensionFlags(d)
+		w.writeValue(flags)
+	case encodingVersionFloat32, encodingVersionChecksum, encodingVersionDelta:
+		// These carry the extended sections after the summary only when
+		// there is something to put in them, so that plain digests encode
+		// as they always have.
+		if flags = extensionFlags(d); flags != 0 {
+			w.writeValue(flags)
+		}
+	}
+	if flags&extendedTimestamps != 0 {
+		w.writeValue(int32(len(d.processedTimes)))
+		for _, at := range d.processedTimes {
+			w.writeValue(at)
+		}
+	}
+	if flags&extendedExactTotals != 0 {
+		w.writeValue(d.exactSum.sum)
+		w.writeValue(d.exactSum.c)
+		w.writeValue(d.exactCount.sum)
+		w.writeValue(d.exactCount.c)
+	}
+	if flags&extendedPinnedTail != 0 {
+		w.writeValue(d.tailFrom)
+		w.writeValue(d.tailCompression)
+	}
+	if flags&extendedEffectiveCompression != 0 {
+		w.writeValue(d.EffectiveCompression())
+	}
+	if version == encodingVersionChecksum {
+		w.writeValue(crc32.ChecksumIEEE(buf.Bytes()))
+	}
 
 	if w.err != nil {
 		return nil, w.err
@@ -59,15 +192,36 @@ func unmarshalBinary(d *TDigest, p []byte) error {
 	if r.err != nil {
 		return r.err
 	}
-	if ev != encodingVersion {
+	switch ev {
+	case encodingVersion, encodingVersionFloat32, encodingVersionTimestamps, encodingVersionExtended, encodingVersionDelta:
+	case encodingVersionChecksum:
+		// Verify the whole blob before trusting any of it, and stop the
+		// reader short of the trailer.
+		read := len(p) - r.r.Len()
+		if r.r.Len() < 4 {
+			return io.ErrUnexpectedEOF
+		}
+		body, trailer := p[:len(p)-4], p[len(p)-4:]
+		if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(trailer) {
+			return ErrChecksumMismatch
+		}
+		r.r = bytes.NewReader(body[read:])
+	default:
 		return fmt.Errorf("data corruption detected: invalid encoding version %d", ev)
 	}
-	r.readValue(&d.Compression)
-	d.maxProcessed = processedSize(0, d.Compression)
-	d.maxUnprocessed = unprocessedSize(0, d.Compression)
-	d.processed = make([]Centroid, 0, d.maxProcessed)
-	d.unprocessed = make([]Centroid, 0, d.maxUnprocessed+1)
-	d.cumulative = make([]float64, 0, d.maxProcessed+1)
+	var compression float64
+	r.readValue(&compression)
+	if r.err != nil {
+		return r.err
+	}
+	// The buffers are sized from the compression, so check it before
+	// allocating them.
+	if !(compression > 0 && compression <= maxCompression) {
+		return fmt.Errorf("data corruption detected: invalid compression %v", compression)
+	}
+	// Start from an empty digest, so that values buffered in d before the
+	// call cannot leak into the next Add.
+	d.reset(compression)
 	r.readValue(&n)
 	if r.err != nil {
 		return r.err
@@ -79,10 +233,25 @@ func unmarshalBinary(d *TDigest, p []byte) error {
 	if n > 1<<20 {
 		return fmt.Errorf("invalid n, cannot be greater than 2^20: %v", n)
 	}
+	var prev uint64
 	for i := 0; i < int(n); i++ {
 		c := Centroid{}
-		r.readValue(&c.Weight)
-		r.readValue(&c.Mean)
+		switch ev {
+		case encodingVersionDelta:
+			var delta uint64
+			r.readValue(&c.Weight)
+			r.readValue(&delta)
+			prev += delta
+			c.Mean = fromSortableBits(prev)
+		case encodingVersionFloat32:
+			var wt, m float32
+			r.readValue(&wt)
+			r.readValue(&m)
+			c.Weight, c.Mean = float64(wt), float64(m)
+		default:
+			r.readValue(&c.Weight)
+			r.readValue(&c.Mean)
+		}
 		if r.err != nil {
 			return r.err
 		}
@@ -107,7 +276,124 @@ func unmarshalBinary(d *TDigest, p []byte) error {
 		}
 		d.processedWeight += c.Weight
 	}
+	// match the compensated total that process and decay leave behind
+	d.processedWeight = sumWeights(d.processed)
+
+	if ev != encodingVersionFloat32 {
+		if err := readCumulative(r, d); err != nil {
+			return err
+		}
+	} else if d.processed.Len() > 0 {
+		d.updateCumulative()
+	}
+
+	r.readValue(&d.decayCount)
+	if r.err != nil {
+		return r.err
+	}
+	r.readValue(&d.decayEvery)
+	if r.err != nil {
+		return r.err
+	}
+	r.readValue(&d.decayValue)
+	if r.err != nil {
+		return r.err
+	}
+	r.readValue(&d.count)
+	if r.err != nil {
+		return r.err
+	}
+	r.readValue(&d.min)
+	if r.err != nil {
+		return r.err
+	}
+	r.readValue(&d.max)
+	if r.err != nil {
+		return r.err
+	}
+	if ev == encodingVersionFloat32 && d.min <= d.max {
+		// Rounding to float32 can carry the extreme means just past the
+		// exact min and max, which stay float64.
+		for i := range d.processed {
+			d.processed[i].Mean = math.Max(d.min, math.Min(d.max, d.processed[i].Mean))
+		}
+	}
+	var flags uint8
+	switch ev {
+	case encodingVersionTimestamps:
+		flags = extendedTimestamps
+	case encodingVersionExtended, encodingVersionFloat32, encodingVersionChecksum, encodingVersionDelta:
+		if ev != encodingVersionExtended && r.r.Len() == 0 {
+			break
+		}
+		r.readValue(&flags)
+		if r.err != nil {
+			return r.err
+		}
+		if flags&^(extendedTimestamps|extendedExactTotals|extendedPinnedTail|extendedEffectiveCompression) != 0 {
+			return fmt.Errorf("data corruption detected: unknown extension flags 0x%02x", flags)
+		}
+	}
+	if flags&extendedTimestamps != 0 {
+		r.readValue(&n)
+		if r.err != nil {
+			return r.err
+		}
+		if int(n) != d.processed.Len() {
+			return fmt.Errorf("data corruption detected: %d timestamps for %d centroids", n, d.processed.Len())
+		}
+		d.processedTimes = make([]int64, n)
+		for i := range d.processedTimes {
+			r.readValue(&d.processedTimes[i])
+		}
+		if r.err != nil {
+			return r.err
+		}
+		d.keepTimes = true
+	}
+	if flags&extendedExactTotals != 0 {
+		r.readValue(&d.exactSum.sum)
+		r.readValue(&d.exactSum.c)
+		r.readValue(&d.exactCount.sum)
+		r.readValue(&d.exactCount.c)
+		if r.err != nil {
+			return r.err
+		}
+		d.keepExact = true
+	}
+	if flags&extendedPinnedTail != 0 {
+		var from, compression float64
+		r.readValue(&from)
+		r.readValue(&compression)
+		if r.err != nil {
+			return r.err
+		}
+		if math.IsNaN(from) || !(compression > 0) || math.IsInf(compression, 1) {
+			return fmt.Errorf("data corruption detected: invalid pinned tail from %v at compression %v", from, compression)
+		}
+		d.pinTail(from, compression)
+	}
+	if flags&extendedEffectiveCompression != 0 {
+		r.readValue(&d.effectiveCompression)
+		if r.err != nil {
+			return r.err
+		}
+		if !(d.effectiveCompression > 0) || math.IsInf(d.effectiveCompression, 1) {
+			return fmt.Errorf("data corruption detected: invalid effective compression %v", d.effectiveCompression)
+		}
+	}
+
+	if n := r.r.Len(); n > 0 {
+		return fmt.Errorf("found %d unexpected bytes trailing the tdigest", n)
+	}
 
+	return nil
+}
+
+// readCumulative reads the count of cumulative weights and the weights into
+// d.
+func readCumulative(r *binaryReader, d *TDigest) error {
+	var n int32
 	r.readValue(&n)
 	if r.err != nil {
 		return r.err
@@ -130,36 +416,232 @@ func unmarshalBinary(d *TDigest, p []byte) error {
 		}
 		d.cumulative = append(d.cumulative, v)
 	}
+	return nil
+}
 
-	r.readValue(&d.decayCount)
-	if r.err != nil {
-		return r.err
+// sortableBits maps x to a uint64 that orders as x does, by flipping all the
+// bits of a negative value and only the sign bit of a positive one, so that
+// the sorted means of a digest have small, mostly zero, differences.
+func sortableBits(x float64) uint64 {
+	b := math.Float64bits(x)
+	if b>>63 != 0 {
+		return ^b
 	}
-	r.readValue(&d.decayEvery)
-	if r.err != nil {
-		return r.err
+	return b | 1<<63
+}
+
+// fromSortableBits inverts sortableBits.
+func fromSortableBits(b uint64) float64 {
+	if b>>63 != 0 {
+		return math.Float64frombits(b &^ (1 << 63))
 	}
-	r.readValue(&d.decayValue)
-	if r.err != nil {
-		return r.err
+	return math.Float64frombits(^b)
+}
+
+// maxCompression is the largest compression UnmarshalBinary accepts, far above
+// any useful setting but small enough that the buffers sized from it fit in
+// memory.
+const maxCompression = 1 << 16
+
+// checkCumulative returns an error unless d's cumulative weights are those
+// its centroids imply, so that a query cannot index past them.
+func checkCumulative(d *TDigest) error {
+	if len(d.processed) == 0 && len(d.cumulative) == 0 {
+		return nil
 	}
-	r.readValue(&d.count)
-	if r.err != nil {
-		return r.err
+	if len(d.cumulative) != len(d.processed)+1 {
+		return fmt.Errorf("data corruption detected: %d cumulative weights for %d centroids", len(d.cumulative), len(d.processed))
 	}
-	r.readValue(&d.min)
+	var prev compensatedSum
+	for i, c := range d.processed {
+		mid := prev
+		mid.add(c.Weight / 2)
+		prev.add(c.Weight)
+		if math.Abs(d.cumulative[i]-mid.value()) > 1e-9*d.processedWeight {
+			return fmt.Errorf("data corruption detected: cumulative weight %d is %v, want %v", i, d.cumulative[i], mid.value())
+		}
+	}
+	if last := d.cumulative[len(d.processed)]; math.Abs(last-prev.value()) > 1e-9*d.processedWeight {
+		return fmt.Errorf("data corruption detected: total cumulative weight is %v, want %v", last, prev.value())
+	}
+	return nil
+}
+
+// checkSizeBounds returns an error for the first centroid of weight above one
+// that spans more of the scaler than merging would ever build: one unit of
+// integratedLocation, as at the default MergeThreshold. Single values are
+// exempt, since even one can exceed the bound at the extreme tails.
+func checkSizeBounds(d *TDigest) error {
+	var before compensatedSum
+	for i, c := range d.processed {
+		start := before.value()
+		before.add(c.Weight)
+		if c.Weight <= 1 {
+			continue
+		}
+		k := d.Scaler.integratedLocation(start/d.processedWeight, d.Compression)
+		bound := d.processedWeight*d.Scaler.integratedQ(k+1, d.Compression) - start
+		if c.Weight > bound+1e-9*d.processedWeight {
+			return fmt.Errorf("data corruption detected: centroid %d has weight %v, more than the %v permitted at quantile %v", i, c.Weight, bound, start/d.processedWeight)
+		}
+	}
+	return nil
+}
+
+// MarshalNamed serializes a collection of digests keyed by name as a single
+// blob, suitable to be deserialized later with UnmarshalNamed. Each digest is
+// stored in the MarshalBinary format, framed by its name and length, with
+// names in sorted order so that equal collections encode identically.
+func MarshalNamed(m map[string]*TDigest) ([]byte, error) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.NewBuffer(nil)
+	w := &binaryBufferWriter{buf: buf}
+	w.writeValue(namedMagic)
+	w.writeValue(int32(len(names)))
+	for _, name := range names {
+		d := m[name]
+		if d == nil {
+			return nil, fmt.Errorf("digest %q is nil", name)
+		}
+		b, err := d.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("digest %q: %v", name, err)
+		}
+		w.writeValue(int32(len(name)))
+		w.writeValue([]byte(name))
+		w.writeValue(int32(len(b)))
+		w.writeValue(b)
+	}
+
+	if w.err != nil {
+		return nil, w.err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalNamed deserializes a blob written by MarshalNamed. Each digest is
+// checked for corruption as by UnmarshalBinary, and errors name the digest
+// at fault.
+func UnmarshalNamed(p []byte) (map[string]*TDigest, error) {
+	var (
+		mv int16
+		n  int32
+	)
+	r := &binaryReader{r: bytes.NewReader(p)}
+	r.readValue(&mv)
 	if r.err != nil {
-		return r.err
+		return nil, r.err
 	}
-	r.readValue(&d.max)
+	if mv != namedMagic {
+		return nil, fmt.Errorf("data corruption detected: invalid named header magic value 0x%04x", mv)
+	}
+	r.readValue(&n)
 	if r.err != nil {
-		return r.err
+		return nil, r.err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("data corruption detected: number of digests cannot be negative, have %v", n)
+	}
+
+	m := make(map[string]*TDigest)
+	for i := 0; i < int(n); i++ {
+		name, err := r.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.readFrame()
+		if err != nil {
+			return nil, fmt.Errorf("digest %q: %v", name, err)
+		}
+		if _, ok := m[string(name)]; ok {
+			return nil, fmt.Errorf("data corruption detected: duplicate digest %q", name)
+		}
+		d := new(TDigest)
+		if err := d.UnmarshalBinary(b); err != nil {
+			return nil, fmt.Errorf("digest %q: %v", name, err)
+		}
+		m[string(name)] = d
 	}
 
 	if n := r.r.Len(); n > 0 {
-		return fmt.Errorf("found %d unexpected bytes trailing the tdigest", n)
+		return nil, fmt.Errorf("found %d unexpected bytes trailing the named tdigests", n)
 	}
+	return m, nil
+}
 
+// BinaryEqual reports whether two encodings, in any format UnmarshalBinary
+// reads, hold the same digest up to a relative difference of epsilon, so that
+// a migration between formats can be checked blob by blob. The digests must
+// have the same compression, count and number of centroids, and each
+// centroid mean and weight, and the min and max, must agree within epsilon of
+// the larger magnitude; an epsilon of 0 requires exact equality. Decay
+// settings and anything else outside the distribution are not compared. It
+// returns an error, naming which blob is at fault, if either does not decode.
+func BinaryEqual(a, b []byte, epsilon float64) (bool, error) {
+	da, db := new(TDigest), new(TDigest)
+	if err := da.UnmarshalBinary(a); err != nil {
+		return false, fmt.Errorf("first digest: %v", err)
+	}
+	if err := db.UnmarshalBinary(b); err != nil {
+		return false, fmt.Errorf("second digest: %v", err)
+	}
+	return equalWithin(da, db, epsilon), nil
+}
+
+// equalWithin reports whether processed digests a and b agree as BinaryEqual
+// describes.
+func equalWithin(a, b *TDigest, epsilon float64) bool {
+	near := func(x, y float64) bool {
+		return x == y || math.Abs(x-y) <= epsilon*math.Max(math.Abs(x), math.Abs(y))
+	}
+	if a.Compression != b.Compression || a.count != b.count || a.processed.Len() != b.processed.Len() {
+		return false
+	}
+	if a.processed.Len() > 0 && !(near(a.min, b.min) && near(a.max, b.max)) {
+		return false
+	}
+	for i, c := range a.processed {
+		if !near(c.Mean, b.processed[i].Mean) || !near(c.Weight, b.processed[i].Weight) {
+			return false
+		}
+	}
+	return true
+}
+
+// MergeJavaCentroids reads centroids from r until EOF and merges them into t.
+// The stream holds no header, just big-endian float64 pairs of mean and then
+// weight, as Java's DataOutput.writeDouble produces. Every centroid is
+// validated before any is merged, so on error t is unchanged; a trailing
+// partial pair is reported as io.ErrUnexpectedEOF. Count grows by the total
+// weight rounded to an integer.
+func (t *TDigest) MergeJavaCentroids(r io.Reader) error {
+	var (
+		list  CentroidList
+		total compensatedSum
+		pair  [2]float64
+	)
+	for i := 0; ; i++ {
+		err := binary.Read(r, binary.BigEndian, &pair)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		c := Centroid{Mean: pair[0], Weight: pair[1]}
+		if err := validateCentroid(c); err != nil {
+			return fmt.Errorf("centroid %d: %v", i, err)
+		}
+		list = append(list, c)
+		total.add(c.Weight)
+	}
+	t.AddCentroidList(list)
+	t.count += int64(math.Round(total.value()))
 	return nil
 }
 
@@ -189,3 +671,21 @@ func (r *binaryReader) readValue(v interface{}) {
 		r.err = io.ErrUnexpectedEOF
 	}
 }
+
+// readFrame reads an int32 length followed by that many bytes.
+func (r *binaryReader) readFrame() ([]byte, error) {
+	var n int32
+	r.readValue(&n)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if n < 0 || int(n) > r.r.Len() {
+		return nil, fmt.Errorf("data corruption detected: invalid frame length %v", n)
+	}
+	b := make([]byte, n)
+	r.readValue(b)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return b, nil
+}
@@ -1,12 +1,23 @@
 package tdigest
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding"
+	"encoding/binary"
 	"errors"
+	"flag"
+	"fmt"
 	"io"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/davecgh/go-spew/spew"
+	"golang.org/x/exp/rand"
 )
 
 // add the values [0,n) to a centroid set, equal weights
@@ -48,6 +59,221 @@ func TestMarshalRoundTrip(t *testing.T) {
 	t.Run("1, 1, 0 input", testcase(d))
 }
 
+func TestAddAfterUnmarshal(t *testing.T) {
+	in := NewWithDecay(1000, 0.9, 5000)
+	for _, x := range NormalData[:N/2] {
+		in.Add(x, 1)
+	}
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+
+	// A digest reused for the checkpoint must not carry its own pending
+	// values or settings into the loaded state.
+	reused := NewWithCompression(1000)
+	reused.KeepExamples(2)
+	for i := 0; i < 100; i++ {
+		reused.Add(1e6, 1)
+	}
+	for name, out := range map[string]*TDigest{"new": new(TDigest), "reused": reused} {
+		if err := out.UnmarshalBinary(b); err != nil {
+			t.Fatalf("%s: UnmarshalBinary err: %v", name, err)
+		}
+		if !reflect.DeepEqual(out, in) {
+			t.Errorf("%s: unmarshaled digest differs from the original", name)
+		}
+		want := in.Clone()
+		for _, x := range NormalData[N/2:] {
+			want.Add(x, 1)
+			out.Add(x, 1)
+		}
+		if out.Count() != want.Count() || out.Max() != want.Max() {
+			t.Errorf("%s: unexpected state, got count %d max %g want count %d max %g", name, out.Count(), out.Max(), want.Count(), want.Max())
+		}
+		for _, q := range []float64{0, 0.001, 0.1, 0.5, 0.9, 0.999, 1} {
+			if got, want := out.Quantile(q), want.Quantile(q); got != want {
+				t.Errorf("%s: unexpected quantile %g, got %g want %g", name, q, got, want)
+			}
+		}
+	}
+}
+
+func TestMarshalChecksummed(t *testing.T) {
+	in := simpleTDigest(1000)
+	b, err := in.MarshalBinaryChecksummed()
+	if err != nil {
+		t.Fatalf("MarshalBinaryChecksummed err: %v", err)
+	}
+	plain, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+	if len(b) != len(plain)+4 || !bytes.Equal(b[6:len(b)-4], plain[6:]) {
+		t.Errorf("checksummed encoding is not the plain encoding with a trailer")
+	}
+	out := new(TDigest)
+	if err := out.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary err: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("marshaling round trip resulted in changes")
+	}
+
+	// A flip anywhere after the header, centroid weights included, is caught
+	// even where it leaves the structure valid.
+	for _, i := range []int{6, 20, len(b) / 2, len(b) - 20, len(b) - 1} {
+		corrupt := append([]byte(nil), b...)
+		corrupt[i] ^= 0x10
+		if err := new(TDigest).UnmarshalBinary(corrupt); err != ErrChecksumMismatch {
+			t.Errorf("flip at %d: unexpected err, got %v want %v", i, err, ErrChecksumMismatch)
+		}
+	}
+	if err := new(TDigest).UnmarshalBinary(b[:len(b)-1]); err != ErrChecksumMismatch {
+		t.Errorf("unexpected err for a truncated blob, got %v want %v", err, ErrChecksumMismatch)
+	}
+	if err := new(TDigest).UnmarshalBinary(b[:7]); err != io.ErrUnexpectedEOF {
+		t.Errorf("unexpected err for a blob shorter than its trailer, got %v want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestUnmarshalBinaryStrict(t *testing.T) {
+	decayed := NewWithDecay(100, 0.5, 1000)
+	for _, x := range NormalData[:10000] {
+		decayed.Add(x, 1)
+	}
+	for name, in := range map[string]*TDigest{
+		"normal":  NormalDigest,
+		"uniform": UniformDigest,
+		"decayed": decayed,
+		"small":   simpleTDigest(10),
+		"empty":   New(),
+	} {
+		b, err := in.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: MarshalBinary err: %v", name, err)
+		}
+		if err := new(TDigest).UnmarshalBinaryStrict(b); err != nil {
+			t.Errorf("%s: unexpected err: %v", name, err)
+		}
+	}
+
+	// Inflate a body centroid, fixing up the totals so that the structure
+	// stays valid.
+	in := NewWithCompression(100)
+	for _, x := range UniformData[:10000] {
+		in.Add(x, 1)
+	}
+	in.ProcessNow()
+	mid := in.processed.Len() / 2
+	in.processed[mid].Weight *= 10
+	in.updateCumulative()
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+	if err := new(TDigest).UnmarshalBinary(b); err != nil {
+		t.Errorf("UnmarshalBinary rejected the oversized centroid: %v", err)
+	}
+	out := simpleTDigest(10)
+	err = out.UnmarshalBinaryStrict(b)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("centroid %d has weight", mid)) {
+		t.Errorf("unexpected err for an oversized centroid, got %v", err)
+	}
+	if !reflect.DeepEqual(out, simpleTDigest(10)) {
+		t.Errorf("rejected digest changed the receiver, count %d", out.Count())
+	}
+	if err := out.UnmarshalBinaryStrict(b[:len(b)-1]); err == nil || !reflect.DeepEqual(out, simpleTDigest(10)) {
+		t.Errorf("truncated digest: err %v, count %d", err, out.Count())
+	}
+
+	// The compression follows the int16 magic and the int32 version.
+	small := NewWithCompression(100)
+	for _, x := range []float64{1, 2, 3} {
+		small.Add(x, 1)
+	}
+	good, err := small.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+	for _, c := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), -100, 0, 1e300} {
+		b := append([]byte(nil), good...)
+		binary.LittleEndian.PutUint64(b[6:], math.Float64bits(c))
+		if err := new(TDigest).UnmarshalBinary(b); err == nil {
+			t.Errorf("compression %v: UnmarshalBinary accepted it", c)
+		}
+		if err := out.UnmarshalBinaryStrict(b); err == nil || !reflect.DeepEqual(out, simpleTDigest(10)) {
+			t.Errorf("compression %v: err %v, count %d", c, err, out.Count())
+		}
+	}
+
+	for name, cumulative := range map[string][]float64{
+		"missing":  nil,
+		"short":    {0.5, 1.5, 3},
+		"unsorted": {0.5, 2.5, 1.5, 3},
+		"wrong":    {0.5, 1.5, 2.5, 4},
+	} {
+		bad := small.Clone()
+		bad.cumulative = cumulative
+		b, err := bad.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: MarshalBinary err: %v", name, err)
+		}
+		err = out.UnmarshalBinaryStrict(b)
+		if err == nil || !strings.Contains(err.Error(), "cumulative") || !reflect.DeepEqual(out, simpleTDigest(10)) {
+			t.Errorf("%s cumulative weights: err %v, count %d", name, err, out.Count())
+		}
+	}
+}
+
+func TestMarshalBinaryMaxSize(t *testing.T) {
+	full, err := NormalDigest.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+	if got, err := NormalDigest.MarshalBinaryMaxSize(len(full)); err != nil || !bytes.Equal(got, full) {
+		t.Errorf("digest within budget was not encoded as is, err %v", err)
+	}
+
+	before := NormalDigest.processed.Len()
+	for _, budget := range []int{94, 500, 2000, 10000, len(full) - 1} {
+		b, err := NormalDigest.MarshalBinaryMaxSize(budget)
+		if err != nil {
+			t.Fatalf("budget %d: MarshalBinaryMaxSize err: %v", budget, err)
+		}
+		if len(b) > budget {
+			t.Errorf("budget %d: encoding too large, got %d bytes", budget, len(b))
+		}
+		if budget >= 2000 && len(b) < budget/2 {
+			t.Errorf("budget %d: encoding wastes the budget, got %d bytes", budget, len(b))
+		}
+		out := new(TDigest)
+		if err := out.UnmarshalBinary(b); err != nil {
+			t.Fatalf("budget %d: UnmarshalBinary err: %v", budget, err)
+		}
+		if !out.IsMonotonic(1000) {
+			t.Errorf("budget %d: downsampled quantiles decrease", budget)
+		}
+		if out.Count() != N || out.Min() != NormalDigest.Min() || out.Max() != NormalDigest.Max() {
+			t.Errorf("budget %d: summary not preserved", budget)
+		}
+		if budget >= 2000 {
+			if got, want := out.Quantile(0.5), NormalDigest.Quantile(0.5); math.Abs(got-want) > 0.05*Sigma {
+				t.Errorf("budget %d: unexpected median, got %g want %g", budget, got, want)
+			}
+		}
+	}
+	if NormalDigest.processed.Len() != before {
+		t.Errorf("downsampling modified the digest")
+	}
+
+	for _, budget := range []int{0, 93} {
+		if _, err := NormalDigest.MarshalBinaryMaxSize(budget); err != ErrSizeBudget {
+			t.Errorf("budget %d: unexpected err, got %v want %v", budget, err, ErrSizeBudget)
+		}
+	}
+}
+
 func TestUnmarshalErrors(t *testing.T) {
 	testcase := func(in []byte, wantErr error) func(*testing.T) {
 		return func(t *testing.T) {
@@ -268,3 +494,374 @@ func testUnmarshal(t *testing.T) {
 		},
 	))
 }
+
+func TestMarshalFloat32RoundTrip(t *testing.T) {
+	in := simpleTDigest(1000)
+	full, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+	b, err := in.MarshalBinaryFloat32()
+	if err != nil {
+		t.Fatalf("MarshalBinaryFloat32 err: %v", err)
+	}
+	// Each centroid shrinks from 24 bytes to 8, and the cumulative count
+	// goes too.
+	if want := len(full) - 16*len(in.processed) - 8 - 4; len(b) != want {
+		t.Errorf("unexpected encoded size, got %d want %d", len(b), want)
+	}
+	out := new(TDigest)
+	if err := out.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary err: %v", err)
+	}
+	for i, c := range in.processed {
+		if out.processed[i].Weight != float64(float32(c.Weight)) {
+			t.Errorf("centroid %d: unexpected weight, got %g want %g", i, out.processed[i].Weight, c.Weight)
+		}
+		if out.processed[i].Mean != float64(float32(c.Mean)) {
+			t.Errorf("centroid %d: unexpected mean, got %g want %g", i, out.processed[i].Mean, c.Mean)
+		}
+	}
+	if err := checkCumulative(out); err != nil {
+		t.Errorf("recomputed cumulative weights: %v", err)
+	}
+	for _, q := range []float64{0.1, 0.5, 0.99} {
+		want := in.Quantile(q)
+		if got := out.Quantile(q); math.Abs(got-want) > math.Abs(want)*1e-6 {
+			t.Errorf("unexpected quantile %g, got %g want %g", q, got, want)
+		}
+	}
+
+	// 0.7 rounds down and 1.1 up as float32, past the exact min and max.
+	edges := New()
+	for _, x := range []float64{0.7, 1, 1.1} {
+		edges.Add(x, 1)
+	}
+	b, err = edges.MarshalBinaryFloat32()
+	if err != nil {
+		t.Fatalf("MarshalBinaryFloat32 err: %v", err)
+	}
+	out = new(TDigest)
+	if err := out.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary err: %v", err)
+	}
+	for i, c := range out.processed {
+		if c.Mean < out.Min() || c.Mean > out.Max() {
+			t.Errorf("centroid %d: mean %g outside [%g, %g]", i, c.Mean, out.Min(), out.Max())
+		}
+	}
+
+	big := New()
+	big.Add(math.MaxFloat64, 1)
+	if _, err := big.MarshalBinaryFloat32(); err == nil {
+		t.Errorf("expected error for mean overflowing float32")
+	}
+}
+
+func TestMarshalDeltaRoundTrip(t *testing.T) {
+	gzipped := func(b []byte) int {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Len()
+	}
+
+	in := NewWithCompression(100)
+	for i := 0; i < 10000; i++ {
+		in.Add(50+float64(i%1000)/1000, 1)
+	}
+	in.Add(-3, 1)
+	in.Add(math.Copysign(0, -1), 1)
+	in.Add(0, 1)
+	full, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+	b, err := in.MarshalBinaryDelta()
+	if err != nil {
+		t.Fatalf("MarshalBinaryDelta err: %v", err)
+	}
+	if len(b) != len(full) {
+		t.Errorf("unexpected encoded size, got %d want %d", len(b), len(full))
+	}
+	if gzipped(b) >= gzipped(full) {
+		t.Errorf("delta encoding gzips to %d bytes, plain to %d", gzipped(b), gzipped(full))
+	}
+	out := new(TDigest)
+	if err := out.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary err: %v", err)
+	}
+	if !reflect.DeepEqual(in.processed, out.processed) {
+		t.Errorf("centroids did not round trip exactly")
+	}
+
+	ordered := []float64{math.Inf(-1), -math.MaxFloat64, -1, math.Copysign(0, -1), 0, math.SmallestNonzeroFloat64, 1, math.MaxFloat64, math.Inf(1)}
+	for i, x := range ordered {
+		if got := fromSortableBits(sortableBits(x)); math.Float64bits(got) != math.Float64bits(x) {
+			t.Errorf("sortable bits of %g decoded to %g", x, got)
+		}
+		if i > 0 && sortableBits(ordered[i-1]) >= sortableBits(x) {
+			t.Errorf("sortable bits of %g not below those of %g", ordered[i-1], x)
+		}
+	}
+}
+
+func TestBinaryEqual(t *testing.T) {
+	in := NewWithCompression(100)
+	for _, x := range NormalData[:1000] {
+		in.Add(x, 1)
+	}
+	full, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+	reduced, err := in.MarshalBinaryFloat32()
+	if err != nil {
+		t.Fatalf("MarshalBinaryFloat32 err: %v", err)
+	}
+	checked, err := in.MarshalBinaryChecksummed()
+	if err != nil {
+		t.Fatalf("MarshalBinaryChecksummed err: %v", err)
+	}
+	other := in.Clone()
+	other.Add(Mu, 1)
+	different, err := other.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		a, b    []byte
+		epsilon float64
+		want    bool
+	}{
+		{"checksummed", full, checked, 0, true},
+		{"float32 exact", full, reduced, 0, false},
+		{"float32 within rounding", full, reduced, 1e-7, true},
+		{"different digests", full, different, 1e-3, false},
+	}
+	for _, tt := range tests {
+		got, err := BinaryEqual(tt.a, tt.b, tt.epsilon)
+		if err != nil {
+			t.Errorf("%s: unexpected err: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := BinaryEqual(full, full[:10], 0); err == nil || !strings.HasPrefix(err.Error(), "second digest") {
+		t.Errorf("unexpected err for a truncated blob: %v", err)
+	}
+}
+
+func TestMarshalDeterministic(t *testing.T) {
+	data := make([]Centroid, 6000)
+	for i := range data {
+		data[i] = Centroid{Mean: float64(i % 10), Weight: float64(i%3 + 1)}
+	}
+	// All values fit in the buffer, so the digest is processed once and the
+	// result depends only on the sort.
+	build := func(seed uint64) []byte {
+		d := NewWithCompression(1000)
+		for _, i := range rand.New(rand.NewSource(seed)).Perm(len(data)) {
+			d.Add(data[i].Mean, data[i].Weight)
+		}
+		b, err := d.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary err: %v", err)
+		}
+		return b
+	}
+	want := build(1)
+	for seed := uint64(2); seed < 10; seed++ {
+		if got := build(seed); !bytes.Equal(got, want) {
+			t.Errorf("seed %d: serialization differs for shuffled input", seed)
+		}
+	}
+}
+
+func TestBinaryMarshalerInterfaces(t *testing.T) {
+	var m encoding.BinaryMarshaler = simpleTDigest(1000)
+	b, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary err: %v", err)
+	}
+	var u encoding.BinaryUnmarshaler = new(TDigest)
+	if err := u.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary err: %v", err)
+	}
+	if !reflect.DeepEqual(m, u) {
+		t.Errorf("round trip through encoding interfaces resulted in changes")
+	}
+}
+
+func TestMarshalNamed(t *testing.T) {
+	in := map[string]*TDigest{
+		"/api/users":  simpleTDigest(1000),
+		"/api/orders": simpleTDigest(10),
+		"":            New(),
+	}
+	b, err := MarshalNamed(in)
+	if err != nil {
+		t.Fatalf("MarshalNamed err: %v", err)
+	}
+	out, err := UnmarshalNamed(b)
+	if err != nil {
+		t.Fatalf("UnmarshalNamed err: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("named round trip resulted in changes")
+	}
+	if again, _ := MarshalNamed(out); !bytes.Equal(b, again) {
+		t.Errorf("named encoding is not deterministic")
+	}
+
+	if _, err := MarshalNamed(map[string]*TDigest{"nil": nil}); err == nil {
+		t.Errorf("expected an error marshaling a nil digest")
+	}
+	empty, err := MarshalNamed(nil)
+	if err != nil {
+		t.Fatalf("MarshalNamed err: %v", err)
+	}
+	if m, err := UnmarshalNamed(empty); err != nil || len(m) != 0 {
+		t.Errorf("unexpected empty round trip, got %v, %v", m, err)
+	}
+}
+
+func TestUnmarshalNamedErrors(t *testing.T) {
+	b, err := MarshalNamed(map[string]*TDigest{"a": simpleTDigest(10)})
+	if err != nil {
+		t.Fatalf("MarshalNamed err: %v", err)
+	}
+	// magic, count, name length and name precede the digest's own frame.
+	digestAt := 2 + 4 + 4 + 1 + 4
+	corrupt := append([]byte(nil), b...)
+	corrupt[digestAt] ^= 0xff
+
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{name: "nil", in: nil, want: io.ErrUnexpectedEOF.Error()},
+		{name: "single digest", in: mustMarshal(t, simpleTDigest(10)), want: "data corruption detected: invalid named header magic value 0x0c80"},
+		{name: "truncated", in: b[:len(b)-1], want: `digest "a": data corruption detected: invalid frame length 310`},
+		{name: "corrupt digest", in: corrupt, want: `digest "a": data corruption detected: invalid header magic value 0x0c7f`},
+		{name: "trailing bytes", in: append(append([]byte(nil), b...), 0), want: "found 1 unexpected bytes trailing the named tdigests"},
+		{name: "negative count", in: []byte{0x81, 0x0c, 0xff, 0xff, 0xff, 0xff}, want: "data corruption detected: number of digests cannot be negative, have -1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := UnmarshalNamed(tt.in)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("wrong error, want=%q, have=%v", tt.want, err)
+			}
+		})
+	}
+}
+
+func mustMarshal(tb testing.TB, d *TDigest) []byte {
+	b, err := d.MarshalBinary()
+	if err != nil {
+		tb.Fatalf("MarshalBinary err: %v", err)
+	}
+	return b
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenTDigest has only unmerged centroids with exactly representable
+// weights and means, so building it involves no rounding that could differ
+// between architectures.
+func goldenTDigest() *TDigest {
+	d := NewWithDecay(100, 0.5, 1000)
+	for _, x := range []float64{-1.5, 0, 0.25, 3, 1e10, 3} {
+		d.Add(x, 1)
+	}
+	d.Add(7, 2.5)
+	d.ProcessNow()
+	return d
+}
+
+func TestMarshalGolden(t *testing.T) {
+	tests := []struct {
+		file    string
+		marshal func(*TDigest) ([]byte, error)
+	}{
+		{file: "golden_v1.bin", marshal: (*TDigest).MarshalBinary},
+		{file: "golden_v2.bin", marshal: (*TDigest).MarshalBinaryFloat32},
+		{file: "golden_v3.bin", marshal: (*TDigest).MarshalBinaryChecksummed},
+		{file: "golden_v6.bin", marshal: (*TDigest).MarshalBinaryDelta},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join("testdata", tt.file)
+			have, err := tt.marshal(goldenTDigest())
+			if err != nil {
+				t.Fatalf("marshal err: %v", err)
+			}
+			if *updateGolden {
+				if err := os.WriteFile(path, have, 0644); err != nil {
+					t.Fatalf("writing golden file: %v", err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("reading golden file: %v", err)
+			}
+			if !bytes.Equal(have, want) {
+				t.Errorf("encoding changed, got\n% x\nwant\n% x", have, want)
+			}
+
+			out := new(TDigest)
+			if err := out.UnmarshalBinary(want); err != nil {
+				t.Fatalf("UnmarshalBinary err: %v", err)
+			}
+			if !reflect.DeepEqual(goldenTDigest(), out) {
+				t.Errorf("golden file decoded to a different digest")
+			}
+		})
+	}
+}
+
+func TestMergeJavaCentroids(t *testing.T) {
+	var buf bytes.Buffer
+	for _, c := range NormalDigest.processed {
+		binary.Write(&buf, binary.BigEndian, c.Mean)
+		binary.Write(&buf, binary.BigEndian, c.Weight)
+	}
+	stream := buf.Bytes()
+
+	td := New()
+	if err := td.MergeJavaCentroids(bytes.NewReader(stream)); err != nil {
+		t.Fatalf("MergeJavaCentroids err: %v", err)
+	}
+	if got := td.Count(); got != N {
+		t.Errorf("unexpected count, got %d want %d", got, int64(N))
+	}
+	for _, q := range []float64{0.01, 0.5, 0.99} {
+		if got, want := td.Quantile(q), NormalDigest.Quantile(q); math.Abs(got-want) > 0.001*Sigma {
+			t.Errorf("unexpected quantile %g, got %g want %g", q, got, want)
+		}
+	}
+
+	before := td.Count()
+	if err := td.MergeJavaCentroids(bytes.NewReader(stream[:len(stream)-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("unexpected err for a partial pair, got %v want %v", err, io.ErrUnexpectedEOF)
+	}
+	var bad bytes.Buffer
+	binary.Write(&bad, binary.BigEndian, [2]float64{1, 1})
+	binary.Write(&bad, binary.BigEndian, [2]float64{2, -1})
+	if err := td.MergeJavaCentroids(&bad); err == nil || err.Error() != "centroid 1: "+ErrInvalidWeight.Error() {
+		t.Errorf("unexpected err for a negative weight, got %v", err)
+	}
+	if td.Count() != before {
+		t.Errorf("failed merges modified the digest")
+	}
+	if err := td.MergeJavaCentroids(bytes.NewReader(nil)); err != nil {
+		t.Errorf("unexpected err for an empty stream: %v", err)
+	}
+}
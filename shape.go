@@ -0,0 +1,170 @@
+package tdigest
+
+import (
+	"math"
+	"sort"
+)
+
+// peakSmoothing is how many centroids either side are pooled into each
+// density estimate. Single centroids are too noisy for the local maxima to be
+// meaningful.
+const peakSmoothing = 3
+
+// DefaultPeakProminence is the relative prominence Peaks requires of a peak.
+const DefaultPeakProminence = 0.5
+
+// Peaks returns the locations of the density peaks whose relative prominence
+// is at least DefaultPeakProminence, in increasing order.
+func (t *TDigest) Peaks() []float64 {
+	return t.peaks(DefaultPeakProminence)
+}
+
+// IsBimodal reports whether the density has at least two peaks whose relative
+// prominence is at least minProminence. The prominence of a peak is how far
+// the density must fall from it before reaching a higher peak or the edge of
+// the data, as a fraction of the peak's height, so 0.5 requires the trough
+// between two modes to fall below half the lower mode.
+func (t *TDigest) IsBimodal(minProminence float64) bool {
+	return len(t.peaks(minProminence)) >= 2
+}
+
+// EstimateClusters returns the number of regions of the distribution
+// separated by low-density gaps. A gap is a run of adjacent centroids between
+// which the data is sparser than if it were spread evenly over [Min, Max], and
+// it separates two clusters when it spans at least minGapQuantiles more of
+// the range than of the quantiles: a gap holding 2% of the weight across 30%
+// of the range has an excess of 0.28. Sparse tails at either end separate
+// nothing. It returns 0 for an empty digest and 1 if it holds a single
+// centroid or value.
+func (t *TDigest) EstimateClusters(minGapQuantiles float64) int {
+	t.processForQuery()
+	n := t.processed.Len()
+	if n == 0 {
+		return 0
+	}
+	span := t.max - t.min
+	if !(span > 0) || math.IsInf(span, 0) {
+		return 1
+	}
+	clusters := 1
+	var excess float64
+	dense := false
+	for i := 0; i+1 < n; i++ {
+		width := (t.processed[i+1].Mean - t.processed[i].Mean) / span
+		mass := (t.cumulative[i+1] - t.cumulative[i]) / t.processedWeight
+		if mass >= width {
+			if dense && excess >= minGapQuantiles {
+				clusters++
+			}
+			dense = true
+			excess = 0
+			continue
+		}
+		excess += width - mass
+	}
+	return clusters
+}
+
+func (t *TDigest) peaks(minProminence float64) []float64 {
+	t.processForQuery()
+	means, density := t.densityProfile()
+	var peaks []float64
+	for i := range density {
+		if (i > 0 && density[i-1] >= density[i]) || (i+1 < len(density) && density[i+1] > density[i]) {
+			continue
+		}
+		// The deepest point separating this peak from a higher one on
+		// either side; the higher of the two bounds its prominence.
+		left := density[i]
+		for j := i - 1; j >= 0 && density[j] <= density[i]; j-- {
+			left = math.Min(left, density[j])
+		}
+		right := density[i]
+		for j := i + 1; j < len(density) && density[j] <= density[i]; j++ {
+			right = math.Min(right, density[j])
+		}
+		if (density[i]-math.Max(left, right))/density[i] >= minProminence {
+			peaks = append(peaks, means[i])
+		}
+	}
+	return peaks
+}
+
+// densityProfile returns the estimated density at each centroid, pooling
+// peakSmoothing neighbours either side. Centroids sharing a mean are skipped
+// since their density is unbounded.
+func (t *TDigest) densityProfile() (means, density []float64) {
+	n := t.processed.Len()
+	if n < 2*peakSmoothing+1 {
+		return nil, nil
+	}
+	means = make([]float64, 0, n-2*peakSmoothing)
+	density = make([]float64, 0, n-2*peakSmoothing)
+	for i := peakSmoothing; i < n-peakSmoothing; i++ {
+		lo, hi := t.processed[i-peakSmoothing], t.processed[i+peakSmoothing]
+		width := hi.Mean - lo.Mean
+		if !(width > 0) {
+			continue
+		}
+		// cumulative counts half of each centroid's own weight, so this
+		// approximates the weight lying between the two means.
+		weight := t.cumulative[i+peakSmoothing] - t.cumulative[i-peakSmoothing]
+		means = append(means, t.processed[i].Mean)
+		density = append(density, weight/width)
+	}
+	return means, density
+}
+
+// PDF returns the estimated probability density at each of xs, the slope of
+// CDF there. CDF interpolates linearly between neighbouring centroid means,
+// so the density is constant between them: half the weight of each of the
+// two centroids, over the gap between their means. Over [Min, Max] it
+// integrates to 1, less any weight sitting exactly at Min or Max, and it is 0
+// outside that range. A digest holding a single value reports +Inf at it.
+//
+// Where centroids hold few samples, as in the tails, or where the data has
+// little spread, neighbouring gaps vary enough for the density to jump from
+// step to step. For plotting, smooth it over bins wider than a few centroids,
+// for instance with MassBetweenValues divided by the bin width. It returns
+// NaN for an empty digest or a NaN x.
+func (t *TDigest) PDF(xs []float64) []float64 {
+	t.processForQuery()
+	densities := make([]float64, len(xs))
+	for i, x := range xs {
+		densities[i] = t.pdf(x)
+	}
+	return densities
+}
+
+func (t *TDigest) pdf(x float64) float64 {
+	n := t.processed.Len()
+	switch {
+	case n == 0 || math.IsNaN(x):
+		return math.NaN()
+	case x < t.min || x > t.max:
+		return 0
+	case !(t.max > t.min):
+		return math.Inf(1)
+	case n == 1:
+		return 1 / (t.max - t.min)
+	}
+	// Step i runs from the mean before it, or Min, to the mean after it, or
+	// Max. Take the step to the right of x, or to the left at Max, so that
+	// its width is never zero.
+	i := sort.Search(n, func(j int) bool {
+		if x == t.max {
+			return t.processed[j].Mean >= x
+		}
+		return t.processed[j].Mean > x
+	})
+	lo, hi := t.min, t.max
+	weight := t.cumulative[i]
+	if i > 0 {
+		lo = t.processed[i-1].Mean
+		weight -= t.cumulative[i-1]
+	}
+	if i < n {
+		hi = t.processed[i].Mean
+	}
+	return weight / t.processedWeight / (hi - lo)
+}
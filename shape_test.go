@@ -0,0 +1,146 @@
+package tdigest
+
+import (
+	"math"
+	"testing"
+
+	"golang.org/x/exp/rand"
+)
+
+func mixtureDigest(seed uint64, modes ...float64) *TDigest {
+	src := rand.New(rand.NewSource(seed))
+	td := New()
+	for i := 0; i < 100000; i++ {
+		td.Add(modes[i%len(modes)]+src.NormFloat64(), 1)
+	}
+	return td
+}
+
+func TestPeaks(t *testing.T) {
+	tests := []struct {
+		name   string
+		digest *TDigest
+		want   []float64
+	}{
+		{name: "normal", digest: NormalDigest, want: []float64{Mu}},
+		{name: "uniform", digest: UniformDigest},
+		{name: "bimodal", digest: mixtureDigest(1, 10, 30), want: []float64{10, 30}},
+		{name: "trimodal", digest: mixtureDigest(2, 0, 10, 20), want: []float64{0, 10, 20}},
+		{name: "empty", digest: New()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.digest.Peaks()
+			if len(got) != len(tt.want) {
+				t.Fatalf("unexpected peaks, got %v want %v", got, tt.want)
+			}
+			for i := range got {
+				if math.Abs(got[i]-tt.want[i]) > 0.5 {
+					t.Errorf("unexpected peak %d, got %g want %g", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIsBimodal(t *testing.T) {
+	tests := []struct {
+		name          string
+		digest        *TDigest
+		minProminence float64
+		want          bool
+	}{
+		{name: "normal", digest: NormalDigest, minProminence: 0.5, want: false},
+		{name: "uniform", digest: UniformDigest, minProminence: 0.5, want: false},
+		{name: "separated", digest: mixtureDigest(1, 10, 30), minProminence: 0.9, want: true},
+		// Modes two standard deviations apart leave only a shallow trough.
+		{name: "overlapping", digest: mixtureDigest(3, 10, 12), minProminence: 0.5, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.digest.IsBimodal(tt.minProminence); got != tt.want {
+				t.Errorf("unexpected bimodality, got %v want %v (peaks %v)", got, tt.want, tt.digest.peaks(tt.minProminence))
+			}
+		})
+	}
+}
+
+func TestEstimateClusters(t *testing.T) {
+	tests := []struct {
+		name            string
+		digest          *TDigest
+		minGapQuantiles float64
+		want            int
+	}{
+		{name: "normal", digest: NormalDigest, minGapQuantiles: 0.1, want: 1},
+		{name: "uniform", digest: UniformDigest, minGapQuantiles: 0.1, want: 1},
+		{name: "bimodal", digest: mixtureDigest(1, 10, 30), minGapQuantiles: 0.1, want: 2},
+		{name: "trimodal", digest: mixtureDigest(2, 0, 10, 20), minGapQuantiles: 0.1, want: 3},
+		{name: "four tiers", digest: mixtureDigest(4, 0, 20, 40, 100), minGapQuantiles: 0.1, want: 4},
+		// The gaps between the close tiers are too narrow to count.
+		{name: "four tiers coarse", digest: mixtureDigest(4, 0, 20, 40, 100), minGapQuantiles: 0.3, want: 2},
+		{name: "overlapping", digest: mixtureDigest(3, 10, 12), minGapQuantiles: 0.1, want: 1},
+		{name: "empty", digest: New(), minGapQuantiles: 0.1, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.digest.EstimateClusters(tt.minGapQuantiles); got != tt.want {
+				t.Errorf("unexpected clusters, got %d want %d", got, tt.want)
+			}
+		})
+	}
+
+	single := New()
+	single.Add(5, 3)
+	if got := single.EstimateClusters(0.1); got != 1 {
+		t.Errorf("unexpected clusters for a single value, got %d want 1", got)
+	}
+}
+
+func TestPDF(t *testing.T) {
+	// Integrating over a fine grid recovers the CDF.
+	xs := make([]float64, 0, 20001)
+	lo, hi := NormalDigest.Min(), NormalDigest.Max()
+	step := (hi - lo) / 20000
+	for x := lo; x <= hi; x += step {
+		xs = append(xs, x)
+	}
+	densities := NormalDigest.PDF(xs)
+	var integral float64
+	for i, d := range densities {
+		if d < 0 || math.IsInf(d, 0) || math.IsNaN(d) {
+			t.Fatalf("unexpected density %g at %g", d, xs[i])
+		}
+		if i > 0 && xs[i] <= Mu && math.Abs(integral-NormalDigest.CDF(xs[i])) > 1e-3 {
+			t.Fatalf("integral to %g is %g, CDF %g", xs[i], integral, NormalDigest.CDF(xs[i]))
+		}
+		integral += d * step
+	}
+	if math.Abs(integral-1) > 1e-3 {
+		t.Errorf("density integrates to %g", integral)
+	}
+	want := 1 / (Sigma * math.Sqrt(2*math.Pi))
+	if got := NormalDigest.PDF([]float64{Mu})[0]; math.Abs(got-want)/want > 0.1 {
+		t.Errorf("density at the mean: got %g want %g", got, want)
+	}
+	for _, x := range []float64{lo - 1, hi + 1} {
+		if got := NormalDigest.PDF([]float64{x})[0]; got != 0 {
+			t.Errorf("density outside the range at %g: got %g", x, got)
+		}
+	}
+	if got := NormalDigest.PDF([]float64{hi})[0]; !(got > 0) {
+		t.Errorf("density at the maximum: got %g", got)
+	}
+
+	lone := New()
+	lone.Add(3, 1)
+	if got := lone.PDF([]float64{3, 4}); !math.IsInf(got[0], 1) || got[1] != 0 {
+		t.Errorf("lone value: got %v", got)
+	}
+	if got := New().PDF([]float64{1}); !math.IsNaN(got[0]) {
+		t.Errorf("empty digest: got %v", got)
+	}
+	if got := NormalDigest.PDF([]float64{math.NaN()}); !math.IsNaN(got[0]) {
+		t.Errorf("NaN x: got %v", got)
+	}
+}
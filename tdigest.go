@@ -1,13 +1,47 @@
 package tdigest
 
 import (
+	"context"
+	"fmt"
 	"math"
 	"sort"
+	"sync/atomic"
+	"unsafe"
+
+	"gonum.org/v1/gonum/mathext"
 )
 
 type TDigest struct {
 	Scaler      scaler
 	Compression float64
+	Algorithm   Algorithm
+
+	// StrictMode makes Add, AddCentroid and AddCentroidList reject NaN or
+	// infinite means and non-positive or infinite weights, and verifies that
+	// centroid means are monotonic after every process. Rejected input is
+	// dropped and the first failure is reported by Err.
+	StrictMode bool
+
+	// MergeThreshold, when greater than 1, lets centroids in the body of the
+	// distribution span more of the scale function than those in the tails:
+	// up to MergeThreshold units at the median, tapering to the usual single
+	// unit at either extreme. Raising Compression together with
+	// MergeThreshold buys tail resolution without also splitting the body,
+	// where extra centroids add little accuracy. Values of 1 or less leave
+	// clustering to Compression alone.
+	MergeThreshold float64
+
+	// ProbabilityWeighted marks the weights as probabilities summing to
+	// about one rather than counts. CountBetween then returns the fraction
+	// of probability in the range and ValueAtRank takes a fraction in
+	// [0, 1], each normalized by the total weight, so that a total drifting
+	// from exactly one does not skew them. Quantile and CDF are unaffected,
+	// and Count still reports the number of adds.
+	ProbabilityWeighted bool
+
+	// CDFOutOfRange selects what CDF and PercentileRank report for values
+	// outside [Min, Max]. The default, OutOfRangeClamp, reports 0 below and 1 above.
+	CDFOutOfRange OutOfRange
 
 	maxProcessed      int
 	maxUnprocessed    int
@@ -22,6 +56,39 @@ type TDigest struct {
 	decayCount        int32
 	decayEvery        int32
 	decayValue        float64
+	decayCounts       bool
+	decayedCount      float64
+	err               error
+	exampleLimit      int
+	processedExamples [][]float64
+	quantiles         atomic.Value // *quantileCache for the current processed state
+	quantileMisses    [quantileCacheSize]uint64
+	quantileMissNext  uint32
+	tracker           quantileTracker
+
+	// effectiveCompression is the lowest EffectiveCompression of any digest
+	// merged into this one, or 0 if there has been none.
+	effectiveCompression float64
+
+	// tailFrom and tailCompression pin the centroids with means at or above
+	// tailFrom to the finer tailCompression, as MergePreferTail leaves them.
+	// A tailCompression of 0 means there is no pinned tail.
+	tailFrom        float64
+	tailCompression float64
+
+	alerts []quantileAlert
+
+	keepTimes        bool
+	processedTimes   []int64 // UnixNano of each processed centroid, if keepTimes
+	unprocessedTimes []int64
+	stampAt          int64 // time of the next add, if stampSet
+	stampSet         bool
+
+	keepExact  bool
+	exactSum   compensatedSum // of Mean*Weight over every add, if keepExact
+	exactCount compensatedSum // of Weight over every add, if keepExact
+
+	pending *pendingMerge // state before the last query's merge, if active
 }
 
 func New() *TDigest {
@@ -32,6 +99,15 @@ func NewWithCompression(c float64) *TDigest {
 	return NewWithDecay(c, 0, 0)
 }
 
+// NewWithDecay returns a digest whose weights are multiplied by decayValue
+// every decayEvery adds. Decay is applied by the Add that reaches the
+// boundary, never deferred to a later query, so the weight each value carries
+// depends only on how many adds followed it. On a decaying digest a query
+// that merges buffered values does so provisionally, and the next add resumes
+// from the centroids as they were before it, so digests fed the same adds
+// give identical results however queries interleave with them. Clone,
+// MarshalBinary, Merge and ProcessNow merge for good. The cost is that every
+// query following an add merges the whole buffer again.
 func NewWithDecay(compression, decayValue float64, decayEvery int32) *TDigest {
 	t := &TDigest{
 		Compression: compression,
@@ -39,7 +115,7 @@ func NewWithDecay(compression, decayValue float64, decayEvery int32) *TDigest {
 		decayValue:  decayValue,
 		decayEvery:  decayEvery,
 	}
-	t.maxProcessed = processedSize(0, t.Compression)
+	t.maxProcessed = t.Scaler.MaxCentroids(t.Compression, math.Inf(1))
 	t.maxUnprocessed = unprocessedSize(0, t.Compression)
 	t.processed = make([]Centroid, 0, t.maxProcessed)
 	t.unprocessed = make([]Centroid, 0, t.maxUnprocessed+1)
@@ -49,17 +125,155 @@ func NewWithDecay(compression, decayValue float64, decayEvery int32) *TDigest {
 	return t
 }
 
+// reset returns t to the empty state of NewWithCompression(compression),
+// reusing its buffers when the compression is unchanged.
+func (t *TDigest) reset(compression float64) {
+	if t.processed == nil || t.Compression != compression {
+		*t = *NewWithCompression(compression)
+		return
+	}
+	t.Scaler = &K1{}
+	t.Algorithm = Merging
+	t.StrictMode = false
+	t.maxProcessed = t.Scaler.MaxCentroids(compression, math.Inf(1))
+	t.MergeThreshold = 0
+	t.ProbabilityWeighted = false
+	t.CDFOutOfRange = OutOfRangeClamp
+	t.err = nil
+	t.exampleLimit = 0
+	t.processedExamples = nil
+	t.invalidateQuantiles()
+	t.quantileMisses = [quantileCacheSize]uint64{}
+	t.quantileMissNext = 0
+	t.tracker = quantileTracker{}
+	t.effectiveCompression = 0
+	t.tailFrom, t.tailCompression = 0, 0
+	t.alerts = nil
+	t.keepTimes = false
+	t.processedTimes = nil
+	t.unprocessedTimes = nil
+	t.keepExact = false
+	t.exactSum = compensatedSum{}
+	t.exactCount = compensatedSum{}
+	t.pending = nil
+	t.processed.Clear()
+	t.unprocessed.Clear()
+	t.cumulative = t.cumulative[:0]
+	t.processedWeight = 0
+	t.unprocessedWeight = 0
+	t.min = math.MaxFloat64
+	t.max = -math.MaxFloat64
+	t.count = 0
+	t.decayCount = 0
+	t.decayEvery = 0
+	t.decayValue = 0
+	t.decayCounts = false
+	t.decayedCount = 0
+}
+
+// ClearKeepingCapacity removes all values from t, keeping its compression,
+// scaler, decay and other settings, and truncates its buffers without
+// freeing them, so refilling it allocates nothing. Use it for scratch digests
+// reset in hot loops. The buffers are never shrunk, so a digest that once
+// held many centroids keeps their memory.
+func (t *TDigest) ClearKeepingCapacity() {
+	t.clear()
+	t.processed.Clear()
+	t.unprocessed.Clear()
+	t.cumulative = t.cumulative[:0]
+	t.processedExamples = t.processedExamples[:0]
+	t.processedTimes = t.processedTimes[:0]
+	t.unprocessedTimes = t.unprocessedTimes[:0]
+}
+
+// ClearReleasingMemory is like ClearKeepingCapacity but drops t's buffers, so
+// a long-lived idle digest retains only its fixed size. They are allocated
+// again as values are added.
+func (t *TDigest) ClearReleasingMemory() {
+	t.clear()
+	t.processed = nil
+	t.unprocessed = nil
+	t.cumulative = nil
+	t.processedExamples = nil
+	t.processedTimes = nil
+	t.unprocessedTimes = nil
+	t.pending = nil
+}
+
+// clear resets everything but the settings and buffers of t.
+func (t *TDigest) clear() {
+	t.tailFrom, t.tailCompression = 0, 0
+	t.maxProcessed = t.Scaler.MaxCentroids(t.Compression, math.Inf(1))
+	t.processedWeight = 0
+	t.unprocessedWeight = 0
+	t.min = math.MaxFloat64
+	t.max = -math.MaxFloat64
+	t.count = 0
+	t.decayCount = 0
+	t.decayedCount = 0
+	t.err = nil
+	if t.pending != nil {
+		// Keep the scratch buffers, like the digest's own.
+		t.pending.active = false
+	}
+	t.invalidateQuantiles()
+	t.quantileMisses = [quantileCacheSize]uint64{}
+	t.quantileMissNext = 0
+	t.tracker = quantileTracker{}
+	t.effectiveCompression = 0
+	t.exactSum = compensatedSum{}
+	t.exactCount = compensatedSum{}
+	for i := range t.alerts {
+		t.alerts[i].exceeded = false
+	}
+}
+
+// NewWithWindowedDecay is like NewWithDecay, but Count decays along with the
+// weights, so that it reports the effective number of recent samples rather
+// than the number ever added.
+//
+// Every decayEvery adds, both the weights and the count are multiplied by
+// decayValue. Each sample's contribution therefore shrinks by decayValue
+// per decayEvery adds, an exponentially weighted window whose total converges
+// to decayEvery / (1 - decayValue) under constant input: with decayValue 0.9
+// and decayEvery 1000, Count oscillates between 9000 just after a decay and
+// 10000 just before the next. The mode is not serialized.
+func NewWithWindowedDecay(compression, decayValue float64, decayEvery int32) *TDigest {
+	t := NewWithDecay(compression, decayValue, decayEvery)
+	t.decayCounts = true
+	return t
+}
+
 func (t *TDigest) Add(x, w float64) {
-	if math.IsNaN(x) {
+	// NaN is dropped silently, unless StrictMode is to report it.
+	if math.IsNaN(x) && !t.StrictMode {
+		return
+	}
+	if !t.addCentroid(Centroid{Mean: x, Weight: w}) {
 		return
 	}
-	t.AddCentroid(Centroid{Mean: x, Weight: w})
 
 	t.handleDecay()
 }
 
+// AddRepeated adds mean as though it had been added times times, as a single
+// centroid of weight times. The distribution is the same as calling
+// Add(mean, 1) repeatedly, but the value stays in one centroid that is never
+// split, so a very large repeat count can occupy more than a centroid's usual
+// share of the quantile range. Count and decay see a single add. It does
+// nothing if times is not positive.
+func (t *TDigest) AddRepeated(mean float64, times int) {
+	if times <= 0 {
+		return
+	}
+	t.Add(mean, float64(times))
+}
+
 func (t *TDigest) handleDecay() {
 	t.count++
+	if t.decayCounts {
+		t.decayedCount++
+	}
 	if t.decayValue > 0 {
 		t.decayCount++
 		if t.decayCount >= t.decayEvery {
@@ -69,87 +283,374 @@ func (t *TDigest) handleDecay() {
 	}
 }
 
+// AddCentroidList adds each centroid in c, processing whenever the buffer
+// fills so memory stays bounded regardless of len(c).
 func (t *TDigest) AddCentroidList(c CentroidList) {
-	l := c.Len()
-	for i := 0; i < l; i++ {
-		diff := l - i
-		room := t.maxUnprocessed - t.unprocessed.Len()
-		mid := i + diff
-		if room < diff {
-			mid = i + room
-		}
-		for i < mid {
-			t.AddCentroid(c[i])
-			i++
+	for _, x := range c {
+		t.addCentroid(x)
+	}
+}
+
+// ConsumeChannel adds each value received from ch with weight 1 until ch is
+// closed or done is closed, then processes the remaining buffered values.
+// Adds already go through the digest's unprocessed buffer, so values are
+// merged in batches without extra copying. t must not be used by other
+// goroutines until ConsumeChannel returns; after that it may be queried from
+// any goroutine that observes the return, for example by waiting on a
+// sync.WaitGroup.
+func (t *TDigest) ConsumeChannel(ch <-chan float64, done <-chan struct{}) {
+	defer t.process()
+	for {
+		select {
+		case <-done:
+			return
+		case x, ok := <-ch:
+			if !ok {
+				return
+			}
+			t.Add(x, 1)
 		}
 	}
 }
 
 func (t *TDigest) AddCentroid(c Centroid) {
+	t.addCentroid(c)
+}
+
+// addCentroid adds c to the unprocessed buffer, reporting false if StrictMode
+// rejected it.
+func (t *TDigest) addCentroid(c Centroid) bool {
+	if t.StrictMode {
+		if err := validateCentroid(c); err != nil {
+			t.setErr(err)
+			return false
+		}
+	}
+	t.resumePending()
 	t.unprocessed = append(t.unprocessed, c)
 	t.unprocessedWeight += c.Weight
+	if t.keepTimes {
+		t.unprocessedTimes = append(t.unprocessedTimes, t.stamp())
+	}
+	t.addExact(c)
+	// Track the extremes as values arrive, since the first and last
+	// centroids may later absorb their neighbours and move inwards.
+	if c.Mean < t.min {
+		t.min = c.Mean
+	}
+	if c.Mean > t.max {
+		t.max = c.Mean
+	}
 
 	if t.processed.Len() > t.maxProcessed ||
 		t.unprocessed.Len() > t.maxUnprocessed {
 		t.process()
 	}
+	return true
+}
+
+// AddSafe adds mean with the given weight after validating it, for callers
+// adding values from untrusted sources. Unlike Add it reports rather than
+// drops bad input: ErrInvalidMean for a NaN or infinite mean, ErrInvalidWeight
+// for a weight that is not positive and finite, and ErrWeightOverflow if the
+// total weight would become infinite. Rejected values leave t unchanged, so
+// no sequence of AddSafe calls can make CheckConsistency fail.
+func (t *TDigest) AddSafe(mean, weight float64) error {
+	c := Centroid{Mean: mean, Weight: weight}
+	if err := validateCentroid(c); err != nil {
+		return err
+	}
+	if math.IsInf(t.totalWeight()+weight, 0) {
+		return ErrWeightOverflow
+	}
+	if t.addCentroid(c) {
+		t.handleDecay()
+	}
+	return nil
+}
+
+// CheckConsistency verifies t's internal invariants: every centroid has a
+// finite mean and a positive, finite weight, processed means are in ascending
+// order, and the recorded total weights match the centroids. It returns the
+// first violation found, or nil.
+func (t *TDigest) CheckConsistency() error {
+	for _, l := range []CentroidList{t.processed, t.unprocessed} {
+		for _, c := range l {
+			if err := validateCentroid(c); err != nil {
+				return err
+			}
+		}
+	}
+	for i := 1; i < t.processed.Len(); i++ {
+		if t.processed[i].Mean < t.processed[i-1].Mean {
+			return ErrUnsortedCentroids
+		}
+	}
+	if !closeWeights(t.processedWeight, sumWeights(t.processed)) ||
+		!closeWeights(t.unprocessedWeight, sumWeights(t.unprocessed)) {
+		return ErrInconsistentWeight
+	}
+	return nil
+}
+
+// closeWeights reports whether two totals of the same weights agree to within
+// the rounding of summing them in different orders.
+func closeWeights(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func validateCentroid(c Centroid) error {
+	if math.IsNaN(c.Mean) || math.IsInf(c.Mean, 0) {
+		return ErrInvalidMean
+	}
+	if !(c.Weight > 0) || math.IsInf(c.Weight, 0) {
+		return ErrInvalidWeight
+	}
+	return nil
+}
+
+func (t *TDigest) setErr(err error) {
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// Err returns the first input rejected by StrictMode, or nil.
+func (t *TDigest) Err() error {
+	return t.err
 }
 
 func (t *TDigest) process() {
+	t.resumePending()
 	t.processIt(true)
 }
 
+// ProcessNow merges any buffered values into the centroids immediately, so the
+// cost is paid now rather than by the next query. Unlike the merge a query
+// makes on a decaying digest, it is permanent, so later values are clustered
+// with the result.
+func (t *TDigest) ProcessNow() {
+	t.process()
+}
+
+// Dirty reports whether values have been added since the centroids were last
+// merged, so that the next query will reprocess and may see a different
+// distribution than a result cached before the adds.
+func (t *TDigest) Dirty() bool {
+	return t.unprocessed.Len() > 0 || t.processed.Len() > t.maxProcessed
+}
+
 func (t *TDigest) processIt(updateCumulative bool) {
+	if updateCumulative && t.alerts != nil && t.Dirty() {
+		defer t.checkAlerts()
+	}
+	if t.Algorithm == Clustering && t.unprocessed.Len() > 0 {
+		t.cluster(updateCumulative)
+	}
 	if t.unprocessed.Len() > 0 ||
 		t.processed.Len() > t.maxProcessed {
 
+		t.invalidateQuantiles()
+		var examples [][]float64
+		if t.exampleLimit > 0 {
+			examples = t.pendingExamples()
+		}
+		var times []int64
+		if t.keepTimes {
+			times = append(t.unprocessedTimes, t.processedTimes...)
+		}
+
 		// Append all processed centroids to the unprocessed list and sort
 		t.unprocessed = append(t.unprocessed, t.processed...)
-		sort.Sort(&t.unprocessed)
+		if examples != nil || times != nil {
+			sort.Sort(&centroidSorter{list: t.unprocessed, examples: examples, times: times})
+		} else {
+			sort.Sort(&t.unprocessed)
+		}
 
 		// Reset processed list with first centroid
 		t.processed.Clear()
 		t.processed = append(t.processed, t.unprocessed[0])
+		if examples != nil {
+			t.processedExamples = append(t.processedExamples[:0], examples[0])
+		}
+		if times != nil {
+			t.processedTimes = append(t.processedTimes[:0], times[0])
+		}
 
-		t.processedWeight += t.unprocessedWeight
+		t.processedWeight = sumWeights(t.unprocessed)
 		t.unprocessedWeight = 0
-		soFar := t.unprocessed[0].Weight
-		limit := t.processedWeight * t.Scaler.integratedQ(1.0, t.Compression)
-		for _, centroid := range t.unprocessed[1:] {
-			projected := soFar + centroid.Weight
-			if projected <= limit {
+		// soFar is compensated like the total it is compared against, so
+		// that fractional weights which are not exact in binary, such as 0.1,
+		// do not drift the cluster boundaries over many centroids.
+		var soFar compensatedSum
+		soFar.add(t.unprocessed[0].Weight)
+		compression := t.compressionAt(t.unprocessed[0].Mean)
+		limit := t.processedWeight * t.Scaler.integratedQ(1.0, compression)
+		for i, centroid := range t.unprocessed[1:] {
+			projected := soFar
+			projected.add(centroid.Weight)
+			// A centroid never straddles the start of a pinned tail.
+			if projected.value() <= limit && t.compressionAt(centroid.Mean) == compression {
 				soFar = projected
-				(&t.processed[t.processed.Len()-1]).Add(centroid)
+				last := &t.processed[t.processed.Len()-1]
+				if times != nil {
+					at := &t.processedTimes[len(t.processedTimes)-1]
+					*at = mergeTimes(*at, last.Weight, times[i+1], centroid.Weight)
+				}
+				last.Add(centroid)
+				if examples != nil {
+					last := len(t.processedExamples) - 1
+					t.processedExamples[last] = mergeExamples(t.processedExamples[last], examples[i+1], t.exampleLimit)
+				}
 			} else {
-				k1 := t.Scaler.integratedLocation(soFar/t.processedWeight, t.Compression)
-				limit = t.processedWeight * t.Scaler.integratedQ(k1+1.0, t.Compression)
-				soFar += centroid.Weight
+				compression = t.compressionAt(centroid.Mean)
+				q := soFar.value() / t.processedWeight
+				k1 := t.Scaler.integratedLocation(q, compression)
+				limit = t.processedWeight * t.Scaler.integratedQ(k1+t.mergeStep(q), compression)
+				soFar.add(centroid.Weight)
 				t.processed = append(t.processed, centroid)
+				if examples != nil {
+					t.processedExamples = append(t.processedExamples, examples[i+1])
+				}
+				if times != nil {
+					t.processedTimes = append(t.processedTimes, times[i+1])
+				}
 			}
 		}
 		t.min = math.Min(t.min, t.processed[0].Mean)
 		t.max = math.Max(t.max, t.processed[t.processed.Len()-1].Mean)
+		if t.StrictMode {
+			for i := 1; i < t.processed.Len(); i++ {
+				if t.processed[i].Mean < t.processed[i-1].Mean {
+					t.setErr(ErrUnsortedCentroids)
+					break
+				}
+			}
+		}
 		if updateCumulative {
 			t.updateCumulative()
 		}
 		t.unprocessed.Clear()
+		t.unprocessedTimes = t.unprocessedTimes[:0]
 	}
 }
 
+// compressionAt returns the compression that bounds a centroid of the given
+// mean: tailCompression in a pinned tail and Compression elsewhere.
+func (t *TDigest) compressionAt(mean float64) float64 {
+	if t.tailCompression > 0 && mean >= t.tailFrom {
+		return t.tailCompression
+	}
+	return t.Compression
+}
+
+// pinTail makes every later merge cluster the centroids with means at or
+// above from at compression, and allows room for them.
+func (t *TDigest) pinTail(from, compression float64) {
+	t.tailFrom, t.tailCompression = from, compression
+	t.maxProcessed = t.Scaler.MaxCentroids(t.Compression, math.Inf(1)) + t.Scaler.MaxCentroids(compression, math.Inf(1))
+}
+
+// mergeStep returns how many units of the scale function a centroid starting
+// at quantile q may span, which is 1 unless MergeThreshold widens the body.
+func (t *TDigest) mergeStep(q float64) float64 {
+	if !(t.MergeThreshold > 1) {
+		return 1.0
+	}
+	return 1.0 + (t.MergeThreshold-1.0)*4.0*q*(1.0-q)
+}
+
+// updateCumulative rebuilds the cumulative weights and sets processedWeight to
+// their total, so that the two always agree.
 func (t *TDigest) updateCumulative() {
 	t.cumulative = t.cumulative[:0]
-	prev := 0.0
+	var prev compensatedSum
 	for _, centroid := range t.processed {
 		cur := centroid.Weight
-		t.cumulative = append(t.cumulative, prev+cur/2.0)
-		prev = prev + cur
+		mid := prev
+		mid.add(cur / 2.0)
+		t.cumulative = append(t.cumulative, mid.value())
+		prev.add(cur)
+	}
+	t.cumulative = append(t.cumulative, prev.value())
+	t.processedWeight = prev.value()
+}
+
+// compensatedSum is a Neumaier compensated running sum. Adding small weights
+// to a float64 total beyond 2^53 silently drops them; carrying the rounding
+// error keeps totals exact to within an ulp however many weights are added.
+type compensatedSum struct {
+	sum, c float64
+}
+
+func (s *compensatedSum) add(x float64) {
+	t := s.sum + x
+	if math.Abs(s.sum) >= math.Abs(x) {
+		s.c += (s.sum - t) + x
+	} else {
+		s.c += (x - t) + s.sum
+	}
+	s.sum = t
+}
+
+func (s compensatedSum) value() float64 {
+	return s.sum + s.c
+}
+
+func sumWeights(l CentroidList) float64 {
+	var s compensatedSum
+	for _, c := range l {
+		s.add(c.Weight)
 	}
-	t.cumulative = append(t.cumulative, prev)
+	return s.value()
 }
 
+// Quantile returns the estimated value at quantile q, or NaN if q is outside
+// [0, 1] or the digest is empty. A digest with a single centroid returns its
+// mean for every q. Results are remembered until the digest next changes, so
+// repeating a query between adds skips the search.
 func (t *TDigest) Quantile(q float64) float64 {
-	t.process()
-	if q < 0 || q > 1 || t.processed.Len() == 0 {
+	t.processForQuery()
+	c, _ := t.quantiles.Load().(*quantileCache)
+	if v, ok := c.lookup(q); ok {
+		return v
+	}
+	v := t.quantile(q)
+	if q >= 0 && q <= 1 && t.missedBefore(q) {
+		t.quantiles.Store(c.with(q, v))
+	}
+	return v
+}
+
+// quantilesCheckEvery is how many quantiles QuantilesContext evaluates
+// between checks for cancellation.
+const quantilesCheckEvery = 256
+
+// QuantilesContext returns Quantile(q) for each q in qs, giving up with
+// ctx.Err() once ctx is done. It checks ctx before merging any buffered
+// values, which cannot be interrupted, and then every quantilesCheckEvery
+// quantiles. Results are not added to the cache Quantile uses.
+func (t *TDigest) QuantilesContext(ctx context.Context, qs []float64) ([]float64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t.processForQuery()
+	values := make([]float64, len(qs))
+	for i, q := range qs {
+		if i%quantilesCheckEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		values[i] = t.quantile(q)
+	}
+	return values, nil
+}
+
+// quantile is Quantile without processing or caching.
+func (t *TDigest) quantile(q float64) float64 {
+	if !(q >= 0 && q <= 1) || t.processed.Len() == 0 {
 		return math.NaN()
 	}
 	if t.processed.Len() == 1 {
@@ -157,12 +658,10 @@ func (t *TDigest) Quantile(q float64) float64 {
 	}
 	index := q * t.processedWeight
 	if index <= t.processed[0].Weight/2.0 {
-		return t.min + 2.0*index/t.processed[0].Weight*(t.processed[0].Mean-t.min)
+		return interpolate(t.min, t.processed[0].Mean, 2.0*index/t.processed[0].Weight)
 	}
 
-	lower := sort.Search(len(t.cumulative), func(i int) bool {
-		return t.cumulative[i] >= index
-	})
+	lower := searchCumulative(t.cumulative, index)
 
 	if lower+1 != len(t.cumulative) {
 		z1 := index - t.cumulative[lower-1]
@@ -170,29 +669,441 @@ func (t *TDigest) Quantile(q float64) float64 {
 		return weightedAverage(t.processed[lower-1].Mean, z2, t.processed[lower].Mean, z1)
 	}
 
-	z1 := index - t.processedWeight - t.processed[lower-1].Weight/2.0
-	z2 := (t.processed[lower-1].Weight / 2.0) - z1
-	return weightedAverage(t.processed[t.processed.Len()-1].Mean, z1, t.max, z2)
+	// Past the last midpoint, run linearly up to the maximum as the lower
+	// tail runs from the minimum.
+	last := t.processed[lower-1]
+	return math.Min(t.max, interpolate(last.Mean, t.max, 2.0*(index-t.cumulative[lower-1])/last.Weight))
+}
+
+// QuantileDetailed returns Quantile(q) together with the two centroids it was
+// interpolated between, so a reported value can be traced back to the weights
+// behind it. In the tails, where the estimate interpolates between the
+// outermost centroid and the observed minimum or maximum, both centroids are
+// that outermost one; so are they for a digest with a single centroid. For an
+// empty digest or invalid q the value is NaN and the centroids are zero.
+func (t *TDigest) QuantileDetailed(q float64) (value float64, leftCentroid, rightCentroid Centroid) {
+	value = t.Quantile(q)
+	if q < 0 || q > 1 || t.processed.Len() == 0 {
+		return value, Centroid{}, Centroid{}
+	}
+	last := t.processed.Len() - 1
+	index := q * t.processedWeight
+	if last == 0 || index <= t.processed[0].Weight/2.0 {
+		return value, t.processed[0], t.processed[0]
+	}
+	lower := searchCumulative(t.cumulative, index)
+	if lower+1 != len(t.cumulative) {
+		return value, t.processed[lower-1], t.processed[lower]
+	}
+	return value, t.processed[last], t.processed[last]
+}
+
+// IsMonotonic reports whether Quantile does not decrease over steps+1 evenly
+// spaced quantiles from 0 to 1. Any decrease points to a corrupt digest or an
+// interpolation bug. An empty digest, or steps less than one, is trivially
+// monotonic.
+func (t *TDigest) IsMonotonic(steps int) bool {
+	t.processForQuery()
+	if steps < 1 || t.processed.Len() == 0 {
+		return true
+	}
+	prev := math.Inf(-1)
+	for i := 0; i <= steps; i++ {
+		v := t.quantile(float64(i) / float64(steps))
+		if !(v >= prev) {
+			return false
+		}
+		prev = v
+	}
+	return true
+}
+
+// QuantileBreakpoints returns the points at which the quantile function
+// changes slope: quantile 0 at the minimum, the cumulative fraction at each
+// centroid's midpoint paired with its mean, and quantile 1 at the maximum.
+// Quantile interpolates linearly between consecutive points, so a
+// piecewise-linear interpolator over them reproduces it without the digest.
+// A single centroid gives two points at its mean; an empty digest gives nil.
+func (t *TDigest) QuantileBreakpoints() (qs, values []float64) {
+	t.processForQuery()
+	n := t.processed.Len()
+	switch n {
+	case 0:
+		return nil, nil
+	case 1:
+		m := t.processed[0].Mean
+		return []float64{0, 1}, []float64{m, m}
+	}
+	qs = append(make([]float64, 0, n+2), 0)
+	qs = append(t.quantileBreakpoints(qs), 1)
+	values = append(make([]float64, 0, n+2), t.min)
+	for _, c := range t.processed {
+		values = append(values, c.Mean)
+	}
+	values = append(values, t.max)
+	return qs, values
+}
+
+// QuantileCubic is like Quantile but interpolates between the breakpoints
+// returned by QuantileBreakpoints with a monotone cubic (Fritsch-Butland)
+// rather than straight lines, so percentile curves drawn from a low
+// compression digest have no kinks at the centroids. It agrees with Quantile
+// at every breakpoint and never decreases in q.
+//
+// The curve is smoother, not more accurate: the digest records nothing about
+// the shape between two centroids, and both estimates stay within the same
+// pair of breakpoints. Where the true distribution is itself smooth the cubic
+// is usually closer; near sharp features it can be further off.
+func (t *TDigest) QuantileCubic(q float64) float64 {
+	t.processForQuery()
+	n := t.processed.Len()
+	if !(q >= 0 && q <= 1) || n == 0 {
+		return math.NaN()
+	}
+	if n == 1 {
+		return t.processed[0].Mean
+	}
+	// breakpoint j+1 is the first not below q, so [j, j+1] brackets it
+	j := searchCumulative(t.cumulative[:n], q*t.processedWeight)
+	q0, v0 := t.breakpoint(j)
+	q1, v1 := t.breakpoint(j + 1)
+	h := q1 - q0
+	if !(h > 0) {
+		return v0
+	}
+	d := (v1 - v0) / h
+	m0, m1 := d, d
+	if j > 0 {
+		qp, vp := t.breakpoint(j - 1)
+		m0 = monotoneTangent(q0-qp, (v0-vp)/(q0-qp), h, d)
+	}
+	if j < n {
+		qn, vn := t.breakpoint(j + 2)
+		m1 = monotoneTangent(h, d, qn-q1, (vn-v1)/(qn-q1))
+	}
+
+	s := (q - q0) / h
+	s2, s3 := s*s, s*s*s
+	v := (2*s3-3*s2+1)*v0 + (s3-2*s2+s)*h*m0 + (-2*s3+3*s2)*v1 + (s3-s2)*h*m1
+	return math.Max(v0, math.Min(v, v1))
+}
+
+// breakpoint returns the ith point returned by QuantileBreakpoints for a
+// processed digest of at least two centroids, without building the slices.
+func (t *TDigest) breakpoint(i int) (q, value float64) {
+	if i == 0 {
+		return 0, t.min
+	}
+	if i > t.processed.Len() {
+		return 1, t.max
+	}
+	return t.cumulative[i-1] / t.processedWeight, t.processed[i-1].Mean
+}
+
+// monotoneTangent returns the Fritsch-Butland tangent at a point joining an
+// interval of width h0 and slope d0 to one of width h1 and slope d1: a
+// weighted harmonic mean of the slopes, or zero at a local extremum, which
+// keeps the cubic monotone on both sides.
+func monotoneTangent(h0, d0, h1, d1 float64) float64 {
+	if !(d0 > 0 && d1 > 0) {
+		return 0
+	}
+	return 3 * (h0 + h1) / ((2*h1+h0)/d0 + (h1+2*h0)/d1)
+}
+
+// hdMaxWeight is the total weight above which QuantileHD returns Quantile.
+// The beta weighting then spans only about 1/sqrt(hdMaxWeight) of the
+// quantile range either side of q, a fraction of the digest's own error.
+const hdMaxWeight = 1e4
+
+// QuantileHD returns a Harrell-Davis estimate of quantile q: the average of
+// the quantile function weighted by a Beta(q(n+1), (1-q)(n+1)) density, where
+// n is the total weight taken as the sample size. Averaging over the
+// neighbouring order statistics rather than reading a single point makes the
+// estimate less noisy for small samples, at the cost of a bias towards the
+// median that shrinks with n.
+//
+// The quantile function averaged is the piecewise-linear one Quantile reads,
+// integrated exactly piece by piece, so it costs two incomplete beta
+// evaluations per centroid rather than a search. Above a total weight of
+// 10,000 the weighting is too narrow to matter and it returns Quantile(q).
+// It returns NaN if q is outside [0, 1] or the digest is empty.
+func (t *TDigest) QuantileHD(q float64) float64 {
+	t.processForQuery()
+	if !(q >= 0 && q <= 1) || t.processed.Len() == 0 {
+		return math.NaN()
+	}
+	n := t.processedWeight
+	if n > hdMaxWeight || q == 0 || q == 1 {
+		return t.quantile(q)
+	}
+	// Over a piece from (u0, v0) with slope s, the integral of
+	// (v0+s(u-u0))*Beta(u; a, b) is v0*dI(a, b) + s*(q*dI(a+1, b) - u0*dI(a, b)),
+	// since u*Beta(u; a, b) = q*Beta(u; a+1, b).
+	qs, values := t.QuantileBreakpoints()
+	a, b := q*(n+1), (1-q)*(n+1)
+	var sum compensatedSum
+	var i0, j0 float64
+	for k := 1; k < len(qs); k++ {
+		u0, u1 := qs[k-1], qs[k]
+		if !(u1 > u0) {
+			continue
+		}
+		i1, j1 := mathext.RegIncBeta(a, b, u1), mathext.RegIncBeta(a+1, b, u1)
+		s := (values[k] - values[k-1]) / (u1 - u0)
+		sum.add(values[k-1]*(i1-i0) + s*(q*(j1-j0)-u0*(i1-i0)))
+		i0, j0 = i1, j1
+	}
+	return math.Max(t.min, math.Min(sum.value(), t.max))
+}
+
+// QuantileInt returns Quantile(q) rounded to the nearest integer, with halves
+// rounded away from zero as by math.Round. It returns 0 where Quantile would
+// return NaN, and saturates at the int64 range.
+func (t *TDigest) QuantileInt(q float64) int64 {
+	v := math.Round(t.Quantile(q))
+	switch {
+	case math.IsNaN(v):
+		return 0
+	case v >= math.MaxInt64:
+		return math.MaxInt64
+	case v <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(v)
+}
+
+// ValueAtRank returns the estimated value below which rank weight lies, such
+// as the 1,000,000th smallest sample when every weight is one. The rank is
+// divided by the total weight rather than by Count, so it stays correct as
+// weights decay. It returns NaN if rank is outside [0, total weight]. If t is
+// ProbabilityWeighted, rank is a fraction and this is Quantile(rank).
+func (t *TDigest) ValueAtRank(rank float64) float64 {
+	t.processForQuery()
+	if t.ProbabilityWeighted {
+		return t.Quantile(rank)
+	}
+	if !(rank >= 0 && rank <= t.processedWeight) {
+		return math.NaN()
+	}
+	return t.Quantile(rank / t.processedWeight)
+}
+
+// ThresholdForTopN returns the value below which all but the largest n
+// weight lies, such as the latency threshold of the slowest 1000 requests
+// when every weight is one. Like ValueAtRank it measures n against the total
+// weight rather than Count, so it stays correct as weights decay. It returns
+// Min if n is at least the total weight, Max if n is zero or less, and NaN
+// for an empty digest or a NaN n.
+func (t *TDigest) ThresholdForTopN(n float64) float64 {
+	t.processForQuery()
+	if t.processed.Len() == 0 || math.IsNaN(n) {
+		return math.NaN()
+	}
+	switch {
+	case n >= t.processedWeight:
+		return t.min
+	case n <= 0:
+		return t.max
+	}
+	return t.Quantile(1 - n/t.processedWeight)
+}
+
+// OutOfRange selects how CDF treats values outside the observed range.
+type OutOfRange int
+
+const (
+	// OutOfRangeClamp reports 0 below Min and 1 above Max, treating the
+	// observed range as the whole distribution. It is the default.
+	OutOfRangeClamp OutOfRange = iota
+
+	// OutOfRangeNaN reports NaN below Min and above Max, and for an empty
+	// digest, so that callers extrapolating beyond the data can tell a value
+	// never seen from one known to be at an extreme.
+	OutOfRangeNaN
+)
+
+func (o OutOfRange) String() string {
+	switch o {
+	case OutOfRangeClamp:
+		return "clamp"
+	case OutOfRangeNaN:
+		return "nan"
+	}
+	return "unknown"
 }
 
+// CDF returns the estimated fraction of weight at or below x. A digest
+// holding a single value v returns 0 below v, 1 above it and 0.5 at v itself,
+// matching the midpoint convention used between centroids. Values outside
+// [Min, Max] are handled as CDFOutOfRange selects.
 func (t *TDigest) CDF(x float64) float64 {
-	t.process()
+	t.processForQuery()
+	return t.cdfInRange(x)
+}
+
+// cdfInRange is cdf with values outside [Min, Max] handled as CDFOutOfRange
+// selects.
+func (t *TDigest) cdfInRange(x float64) float64 {
+	if t.CDFOutOfRange == OutOfRangeNaN && !(x >= t.min && x <= t.max) {
+		return math.NaN()
+	}
+	return t.cdf(x)
+}
+
+// PercentileRank returns the percentage, from 0 to 100, of weight at or below
+// x. A value landing exactly on a centroid counts half of that centroid's
+// weight as below it, the same midpoint convention CDF uses, so a digest
+// holding only x reports 50. Otherwise the minimum reports 0 and the maximum
+// 100.
+func (t *TDigest) PercentileRank(x float64) float64 {
+	return t.CDF(x) * 100
+}
+
+// MeetsSLO reports whether quantile q is at or below threshold, so a p99 of
+// exactly 300ms meets a 300ms objective. An empty digest or invalid q never
+// meets it.
+func (t *TDigest) MeetsSLO(q, threshold float64) bool {
+	return t.Quantile(q) <= threshold
+}
+
+// SLOHeadroom returns how far quantile q is below threshold, negative when the
+// objective is missed. It is NaN for an empty digest or invalid q.
+func (t *TDigest) SLOHeadroom(q, threshold float64) float64 {
+	return threshold - t.Quantile(q)
+}
+
+// QuantileRatio returns Quantile(qHigh) / Quantile(qLow), such as p99/p50 as
+// a scale-free measure of tail weight. Both quantiles are read from the same
+// processed state. It is NaN if either quantile is, or if Quantile(qLow) is
+// zero.
+func (t *TDigest) QuantileRatio(qHigh, qLow float64) float64 {
+	t.processForQuery()
+	low := t.quantile(qLow)
+	if low == 0 {
+		return math.NaN()
+	}
+	return t.quantile(qHigh) / low
+}
+
+// CountBetween returns the estimated weight of values in [low, high), or its
+// fraction of the total if t is ProbabilityWeighted. Both ends are evaluated
+// against the same processed state.
+func (t *TDigest) CountBetween(low, high float64) float64 {
+	t.processForQuery()
+	if !(high > low) {
+		return 0
+	}
+	if t.ProbabilityWeighted {
+		return t.cdf(high) - t.cdf(low)
+	}
+	return (t.cdf(high) - t.cdf(low)) * t.processedWeight
+}
+
+// MassBetweenQuantiles returns the fraction of weight between quantiles qLow
+// and qHigh, which is qHigh - qLow with both clamped to [0, 1]. It is 0 for
+// an empty digest, a band with qHigh at or below qLow, or a NaN quantile, so
+// that it agrees with MassBetweenValues over the matching values.
+func (t *TDigest) MassBetweenQuantiles(qLow, qHigh float64) float64 {
+	if t.processed.Len()+t.unprocessed.Len() == 0 {
+		return 0
+	}
+	qLow = math.Max(0, math.Min(1, qLow))
+	qHigh = math.Max(0, math.Min(1, qHigh))
+	if !(qHigh > qLow) {
+		return 0
+	}
+	return qHigh - qLow
+}
+
+// MassBetweenValues returns the estimated fraction of weight in [low, high),
+// the same band CountBetween measures, from a single processed state. A band
+// in the upper half is measured from the largest centroid down, as Survival
+// is, so that narrow bands in the far tail are not lost to the difference of
+// two CDFs close to one. It is 0 for an empty digest, a band with high at or
+// below low, or a NaN bound.
+func (t *TDigest) MassBetweenValues(low, high float64) float64 {
+	t.processForQuery()
+	if t.processed.Len() == 0 || !(high > low) {
+		return 0
+	}
+	below := t.cdf(low)
+	if below > 0.5 {
+		return math.Max(0, t.Survival(low)-t.Survival(high))
+	}
+	return math.Max(0, t.cdf(high)-below)
+}
+
+// Survival returns the estimated fraction of weight above x, 1 - CDF(x).
+// Weight is accumulated from the largest centroid down, so in the far upper
+// tail the result keeps full relative precision instead of being the
+// difference of two numbers close to one.
+func (t *TDigest) Survival(x float64) float64 {
+	t.processForQuery()
+	n := t.processed.Len()
+	switch n {
+	case 0:
+		return 0.0
+	case 1:
+		return 1.0 - t.cdf(x)
+	}
+
+	if x <= t.min {
+		return 1.0
+	}
+	if x >= t.max {
+		return 0.0
+	}
+	// Left Tail
+	m0 := t.processed[0].Mean
+	if x <= m0 {
+		return 1.0 - t.cdf(x)
+	}
+	// Right Tail
+	mn := t.processed[n-1].Mean
+	if x >= mn {
+		if t.max-mn > 0.0 {
+			return fraction(x, t.max, mn) * t.processed[n-1].Weight / t.processedWeight / 2.0
+		}
+		return 0.0
+	}
+
+	upper := sort.Search(n, func(i int) bool {
+		return t.processed[i].Mean > x
+	})
+	var above float64
+	for _, c := range t.processed[upper+1:] {
+		above += c.Weight
+	}
+	aboveUpper := above + t.processed[upper].Weight/2.0
+	aboveLower := aboveUpper + t.processed[upper].Weight/2.0 + t.processed[upper-1].Weight/2.0
+
+	z1 := x - t.processed[upper-1].Mean
+	z2 := t.processed[upper].Mean - x
+	if math.IsInf(z1, 0) || math.IsInf(z2, 0) {
+		z1 = x/2 - t.processed[upper-1].Mean/2
+		z2 = t.processed[upper].Mean/2 - x/2
+	}
+	return weightedAverage(aboveLower, z2, aboveUpper, z1) / t.processedWeight
+}
+
+// cdf is CDF without processing; callers must process first.
+func (t *TDigest) cdf(x float64) float64 {
 	switch t.processed.Len() {
 	case 0:
 		return 0.0
 	case 1:
-		width := t.max - t.min
-		if x <= t.min {
+		if x < t.min {
 			return 0.0
 		}
-		if x >= t.max {
+		if x > t.max {
 			return 1.0
 		}
-		if (x - t.min) <= width {
-			// min and max are too close together to do any viable interpolation
+		if !(t.max > t.min) {
+			// a lone value, which is half below and half above itself
 			return 0.5
 		}
-		return (x - t.min) / width
+		return fraction(x, t.min, t.max)
 	}
 
 	if x <= t.min {
@@ -205,7 +1116,7 @@ func (t *TDigest) CDF(x float64) float64 {
 	// Left Tail
 	if x <= m0 {
 		if m0-t.min > 0 {
-			return (x - t.min) / (m0 - t.min) * t.processed[0].Weight / t.processedWeight / 2.0
+			return fraction(x, t.min, m0) * t.processed[0].Weight / t.processedWeight / 2.0
 		}
 		return 0.0
 	}
@@ -213,27 +1124,105 @@ func (t *TDigest) CDF(x float64) float64 {
 	mn := t.processed[t.processed.Len()-1].Mean
 	if x >= mn {
 		if t.max-mn > 0.0 {
-			return 1.0 - (t.max-x)/(t.max-mn)*t.processed[t.processed.Len()-1].Weight/t.processedWeight/2.0
+			return 1.0 - fraction(x, t.max, mn)*t.processed[t.processed.Len()-1].Weight/t.processedWeight/2.0
 		}
 		return 1.0
 	}
 
-	upper := sort.Search(t.processed.Len(), func(i int) bool {
-		return t.processed[i].Mean > x
-	})
+	upper := searchMeans(t.processed, x)
 
 	z1 := x - t.processed[upper-1].Mean
 	z2 := t.processed[upper].Mean - x
+	if math.IsInf(z1, 0) || math.IsInf(z2, 0) {
+		// Only the ratio of the distances matters, so halve them to avoid
+		// overflow between means of opposite sign.
+		z1 = x/2 - t.processed[upper-1].Mean/2
+		z2 = t.processed[upper].Mean/2 - x/2
+	}
 	return weightedAverage(t.cumulative[upper-1], z2, t.cumulative[upper], z1) / t.processedWeight
 }
 
 type scaler interface {
 	integratedQ(k, compression float64) float64
 	integratedLocation(q, compression float64) float64
+
+	// MaxCentroids returns the most centroids a fully processed digest with
+	// the given compression can hold after n values have been added, which
+	// bounds its memory. An infinite n gives the bound for any number of
+	// values.
+	MaxCentroids(compression, n float64) int
 }
 
 type K1 struct{}
 
+// scalers maps each name accepted by ScalerByName to a constructor. It is the
+// single list of supported scalers; AvailableScalers is derived from it.
+var scalers = map[string]func() scaler{
+	"k1": func() scaler { return &K1{} },
+}
+
+// AvailableScalers returns the names accepted by ScalerByName, sorted.
+func AvailableScalers() []string {
+	names := make([]string, 0, len(scalers))
+	for name := range scalers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ScalerByName returns a new scaler registered under name, or ErrUnknownScaler.
+func ScalerByName(name string) (scaler, error) {
+	newScaler, ok := scalers[name]
+	if !ok {
+		return nil, ErrUnknownScaler
+	}
+	return newScaler(), nil
+}
+
+// searchCumulative returns the first index i with cumulative[i] >= index, or
+// len(cumulative) if there is none, like sort.SearchFloat64s. The loop body
+// compiles to a conditional move rather than a branch, which the queries'
+// unpredictable comparisons would otherwise mispredict half the time.
+func searchCumulative(cumulative []float64, index float64) int {
+	n := len(cumulative)
+	if n == 0 {
+		return 0
+	}
+	base := 0
+	for n > 1 {
+		half := n / 2
+		base += half * b2i(cumulative[base+half] < index)
+		n -= half
+	}
+	return base + b2i(cumulative[base] < index)
+}
+
+// searchMeans returns the first index i with l[i].Mean > x, or len(l) if
+// there is none, searching like searchCumulative.
+func searchMeans(l CentroidList, x float64) int {
+	n := len(l)
+	if n == 0 {
+		return 0
+	}
+	base := 0
+	for n > 1 {
+		half := n / 2
+		base += half * b2i(l[base+half].Mean <= x)
+		n -= half
+	}
+	return base + b2i(l[base].Mean <= x)
+}
+
+// b2i returns 1 if c is true and 0 otherwise, which the compiler lowers to a
+// flag set rather than a branch.
+func b2i(c bool) int {
+	if c {
+		return 1
+	}
+	return 0
+}
+
 func (*K1) integratedQ(k, compression float64) float64 {
 	return (math.Sin(math.Min(k, compression)*math.Pi/compression-math.Pi/2.0) + 1.0) / 2.0
 }
@@ -242,6 +1231,18 @@ func (*K1) integratedLocation(q, compression float64) float64 {
 	return compression * (math.Asin(2.0*q-1.0) + math.Pi/2.0) / math.Pi
 }
 
+// MaxCentroids returns 2*ceil(compression), or ceil(n) if that is smaller.
+// K1 spans compression units of the scale function and a merging pass closes
+// a centroid only once it and the next value span more than one unit, so
+// every two adjacent centroids cover at least a unit.
+func (*K1) MaxCentroids(compression, n float64) int {
+	bound := 2 * math.Ceil(compression)
+	if n >= 0 && n < bound {
+		return int(math.Ceil(n))
+	}
+	return int(bound)
+}
+
 func weightedAverage(x1, w1, x2, w2 float64) float64 {
 	if x1 <= x2 {
 		return weightedAverageSorted(x1, w1, x2, w2)
@@ -251,14 +1252,31 @@ func weightedAverage(x1, w1, x2, w2 float64) float64 {
 
 func weightedAverageSorted(x1, w1, x2, w2 float64) float64 {
 	x := (x1*w1 + x2*w2) / (w1 + w2)
+	if math.IsInf(x, 0) || math.IsNaN(x) {
+		// The products overflowed; weight each value by its share instead.
+		x = x1*(w1/(w1+w2)) + x2*(w2/(w1+w2))
+	}
 	return math.Max(x1, math.Min(x, x2))
 }
 
-func processedSize(size int, compression float64) int {
-	if size == 0 {
-		return int(2 * math.Ceil(compression))
+// interpolate returns a + f*(b-a), falling back to a form that cannot
+// overflow when a and b are too far apart to subtract.
+func interpolate(a, b, f float64) float64 {
+	x := a + f*(b-a)
+	if math.IsInf(x, 0) || math.IsNaN(x) {
+		x = a*(1-f) + b*f
 	}
-	return size
+	return x
+}
+
+// fraction returns (x-lo)/(hi-lo), halving the operands when the differences
+// overflow.
+func fraction(x, lo, hi float64) float64 {
+	f := (x - lo) / (hi - lo)
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		f = (x/2 - lo/2) / (hi/2 - lo/2)
+	}
+	return f
 }
 
 func unprocessedSize(size int, compression float64) int {
@@ -278,29 +1296,27 @@ const decayLimit = 0.00002656139889
 // and similarly the ranking/selection will not be
 // (provided we use scale function which keeps small enough bins towards the top)
 func (t *TDigest) decay() {
-	t.processIt(false) // don't update cumulative as we'll do that below inline
-	var weight float64
+	t.resumePending()
+	t.processIt(false) // don't update cumulative as we'll do that below
 	var remove []int
-	t.cumulative = t.cumulative[:0]
-	prev := 0.0
 	for i := range t.processed {
 		c := &t.processed[i]
 		c.Weight = c.Weight * t.decayValue
 		if c.Weight < decayLimit {
 			remove = append(remove, i)
-		} else {
-			weight += c.Weight
-			// do cumulative work inline
-			t.cumulative = append(t.cumulative, prev+c.Weight/2.0)
-			prev = prev + c.Weight
 		}
 	}
-	t.cumulative = append(t.cumulative, prev)
 
 	if len(remove) > 0 {
 		for i, c := range remove {
 			calculated := c - i
 			t.processed = append(t.processed[:calculated], t.processed[calculated+1:]...)
+			if len(t.processedExamples) > calculated {
+				t.processedExamples = append(t.processedExamples[:calculated], t.processedExamples[calculated+1:]...)
+			}
+			if t.keepTimes {
+				t.processedTimes = append(t.processedTimes[:calculated], t.processedTimes[calculated+1:]...)
+			}
 		}
 		if len(t.processed) > 0 {
 			t.max = t.processed[len(t.processed)-1].Mean
@@ -311,40 +1327,106 @@ func (t *TDigest) decay() {
 		}
 	}
 
-	t.processedWeight = weight
+	// Rebuild the cumulative weights with the same compensated sums as
+	// process, so the total does not wander from the sum of the decayed
+	// weights over many cycles.
+	t.updateCumulative()
+	t.invalidateQuantiles()
+	if t.decayCounts {
+		t.decayedCount *= t.decayValue
+	}
+	t.checkAlerts()
 }
 
 func (t *TDigest) Clone() *TDigest {
-	t.process()
 	td := &TDigest{
-		Compression:       t.Compression,
-		maxProcessed:      t.maxProcessed,
-		maxUnprocessed:    t.maxUnprocessed,
-		processed:         make(CentroidList, 0, t.maxProcessed),
-		unprocessed:       make(CentroidList, 0, t.maxUnprocessed+1),
-		cumulative:        make([]float64, 0, t.maxUnprocessed+1),
-		processedWeight:   t.processedWeight,
-		unprocessedWeight: t.unprocessedWeight,
-		min:               t.min,
-		max:               t.max,
-		count:             t.count,
-		decayCount:        t.decayCount,
-		decayEvery:        t.decayEvery,
-		decayValue:        t.decayValue,
+		processed:   make(CentroidList, 0, t.maxProcessed),
+		unprocessed: make(CentroidList, 0, t.maxUnprocessed+1),
+		cumulative:  make([]float64, 0, t.maxUnprocessed+1),
 	}
+	t.CloneInto(td)
+	return td
+}
 
-	for _, c := range t.processed {
-		td.processed = append(td.processed, c)
+// CloneInto makes dst a copy of t like Clone, reusing dst's buffers and only
+// growing them if they are too small. Once dst has been sized by an earlier
+// copy, CloneInto does not allocate.
+func (t *TDigest) CloneInto(dst *TDigest) {
+	t.process()
+	t.cloneInto(dst)
+}
+
+// cloneInto is CloneInto for a t that has already been processed, for
+// instance for a query.
+func (t *TDigest) cloneInto(dst *TDigest) {
+	if dst == t {
+		return
 	}
+	processed := append(dst.processed[:0], t.processed...)
+	unprocessed := dst.unprocessed[:0]
+	cumulative := append(dst.cumulative[:0], t.cumulative...)
 
-	for _, c := range t.cumulative {
-		td.cumulative = append(td.cumulative, c)
+	examples := dst.processedExamples[:0]
+	for i, e := range t.processedExamples {
+		var reuse []float64
+		if i < cap(examples) {
+			reuse = examples[:i+1][i][:0]
+		}
+		examples = append(examples, append(reuse, e...))
 	}
+	if t.processedExamples == nil {
+		examples = nil
+	}
+	var times []int64
+	if t.processedTimes != nil {
+		times = append(dst.processedTimes[:0], t.processedTimes...)
+	}
+	unprocessedTimes := dst.unprocessedTimes[:0]
+
+	*dst = *t
+	dst.processed = processed
 	// we've processed so unprocessed will be empty
+	dst.unprocessed = unprocessed
+	dst.cumulative = cumulative
+	dst.processedExamples = examples
+	dst.processedTimes = times
+	dst.unprocessedTimes = unprocessedTimes
+	dst.alerts = nil
+	dst.pending = nil
+}
 
+// RescaleWith returns a new digest holding t's centroids re-clustered under the
+// scaler s, with t's compression and decay settings. The result is only an
+// approximation of a digest built from the raw data under s, since t's
+// centroids have already merged values that s might have kept apart, but it
+// allows comparing scalers on stored digests without re-ingesting the data.
+// Examples are not carried over and t is not modified.
+func (t *TDigest) RescaleWith(s scaler) *TDigest {
+	t.processForQuery()
+	td := NewWithDecay(t.Compression, t.decayValue, t.decayEvery)
+	td.Scaler = s
+	td.Algorithm = t.Algorithm
+	td.MergeThreshold = t.MergeThreshold
+	td.ProbabilityWeighted = t.ProbabilityWeighted
+	td.CDFOutOfRange = t.CDFOutOfRange
+	td.decayCount = t.decayCount
+	td.decayCounts = t.decayCounts
+	td.decayedCount = t.decayedCount
+	if t.tailCompression > 0 {
+		td.pinTail(t.tailFrom, t.tailCompression)
+	}
+	td.appendUnprocessed(t)
+	td.process()
 	return td
 }
 
+// Snapshot returns a fully processed copy of t that shares no mutable state
+// with it. As long as the snapshot itself is not added to, it may be queried
+// from many goroutines at once while t continues to accept writes.
+func (t *TDigest) Snapshot() *TDigest {
+	return t.Clone()
+}
+
 // MarshalBinary serializes d as a sequence of bytes, suitable to be
 // deserialized later with UnmarshalBinary.
 func (t *TDigest) MarshalBinary() ([]byte, error) {
@@ -352,16 +1434,344 @@ func (t *TDigest) MarshalBinary() ([]byte, error) {
 	return marshalBinary(t)
 }
 
+// MarshalBinaryFloat32 is like MarshalBinary but stores centroid weights and
+// means as float32 and leaves out the cumulative weights, which
+// UnmarshalBinary recomputes, so each centroid takes 8 bytes instead of 24.
+// Means and weights are rounded to about 7 significant decimal digits, a
+// relative error of at most 2^-24, which is well below the digest's own
+// approximation error for most data. Integer weights up to 2^24 are kept
+// exactly; Count is stored in full either way. Decoded means are clamped to
+// [Min, Max]. It returns an error if a weight or mean is outside the float32
+// range. Timestamps, exact totals and the other state of the extended
+// MarshalBinary format follow the centroids, which older readers reject. UnmarshalBinary detects the format
+// from the header.
+func (t *TDigest) MarshalBinaryFloat32() ([]byte, error) {
+	t.process()
+	return marshalBinaryVersion(t, encodingVersionFloat32)
+}
+
+// MarshalBinaryChecksummed is like MarshalBinary but appends a CRC-32 of the
+// encoding, 4 bytes, so that UnmarshalBinary detects bit flips that leave the
+// structure valid, returning ErrChecksumMismatch. It suits long-term storage;
+// readers older than the format reject it as an unknown version, which is why
+// MarshalBinary does not checksum by default. The checksum also covers any
+// timestamps, exact totals or other extended state, written as MarshalBinary
+// would.
+func (t *TDigest) MarshalBinaryChecksummed() ([]byte, error) {
+	t.process()
+	return marshalBinaryVersion(t, encodingVersionChecksum)
+}
+
+// MarshalBinaryDelta is like MarshalBinary but stores each centroid mean as
+// the difference of its bits from the previous mean's, in an order-preserving
+// mapping of float64 to uint64. The encoding is the same size and decodes to
+// exactly the same means, but sorted means that are close together differ
+// only in their low bytes, so gzip and similar compressors shrink it much
+// further. Extended state such as timestamps and exact totals is kept as in
+// MarshalBinary. Readers older than the format reject it as an unknown
+// version. UnmarshalBinary detects the format from the header.
+func (t *TDigest) MarshalBinaryDelta() ([]byte, error) {
+	t.process()
+	return marshalBinaryVersion(t, encodingVersionDelta)
+}
+
+// MarshalBinaryMaxSize is like MarshalBinary but guarantees a result of at
+// most maxBytes, for fixed-width columns and frames. If t's encoding is too
+// large, t is re-clustered at successively lower compressions until it fits,
+// and the encoding records the compression used; t itself is not modified.
+// Each centroid takes 24 bytes, or 32 with timestamps, on top of 70 bytes of
+// header and summary and any extended sections MarshalBinary writes. It
+// returns ErrSizeBudget if maxBytes cannot hold a single centroid. A
+// re-clustered digest keeps t's timestamps, exact totals and effective
+// compression but not a tail pinned by MergePreferTail.
+func (t *TDigest) MarshalBinaryMaxSize(maxBytes int) ([]byte, error) {
+	t.process()
+	d := t
+	per := 24
+	if t.keepTimes {
+		per += 8
+	}
+	for {
+		b, err := marshalBinary(d)
+		if err != nil || len(b) <= maxBytes {
+			return b, err
+		}
+		n := d.processed.Len()
+		fit := (maxBytes - (len(b) - per*n)) / per
+		if fit < 1 || n <= 1 {
+			return nil, ErrSizeBudget
+		}
+		// Centroid counts grow about linearly with compression; aim a little
+		// low so that most budgets fit at the first attempt.
+		d = t.downsample(d.Compression * math.Min(0.9, 0.95*float64(fit)/float64(n)))
+	}
+}
+
+// downsample returns t re-clustered at the given compression, with t's decay
+// settings, timestamps and exact totals.
+func (t *TDigest) downsample(compression float64) *TDigest {
+	d := NewWithDecay(compression, t.decayValue, t.decayEvery)
+	d.decayCount = t.decayCount
+	d.KeepTimestamps(t.keepTimes)
+	d.KeepExactTotals(t.keepExact)
+	d.appendUnprocessed(t)
+	d.process()
+	return d
+}
+
 // UnmarshalBinary populates d with the parsed contents of p, which should have
 // been created with a call to MarshalBinary.
 func (t *TDigest) UnmarshalBinary(p []byte) error {
 	return unmarshalBinary(t, p)
 }
 
+// UnmarshalBinaryStrict is like UnmarshalBinary but also rejects a digest
+// with a centroid larger than the scaler permits at its quantile, which no
+// sequence of unit-weight adds can produce but which would distort the
+// quantiles around it. Use it for digests from untrusted sources. Digests
+// built by AddRepeated, by adding large weights, with a MergeThreshold above
+// 1 or from a coarser digest by MergePreferTail can legitimately hold such
+// centroids and fail it. It also rejects cumulative weights that do not match
+// the centroids. On error t is left unchanged.
+func (t *TDigest) UnmarshalBinaryStrict(p []byte) error {
+	d := new(TDigest)
+	if err := unmarshalBinary(d, p); err != nil {
+		return err
+	}
+	if err := checkCumulative(d); err != nil {
+		return err
+	}
+	if err := checkSizeBounds(d); err != nil {
+		return err
+	}
+	*t = *d
+	return nil
+}
+
 func (t *TDigest) Count() int64 {
+	if t.decayCounts {
+		return int64(math.Round(t.decayedCount))
+	}
 	return t.count
 }
 
+// EffectiveCompression returns the lowest compression among t and every digest
+// merged into it, directly or through intermediate merges. Merging cannot
+// restore detail a coarser source has already clustered away, so this, not
+// Compression, bounds the accuracy of an aggregate of heterogeneous sources.
+// Merging an empty digest leaves it unchanged. It is serialized by
+// MarshalBinary, in a format that older readers reject, when it is below
+// Compression.
+func (t *TDigest) EffectiveCompression() float64 {
+	if t.effectiveCompression > 0 && t.effectiveCompression < t.Compression {
+		return t.effectiveCompression
+	}
+	return t.Compression
+}
+
+// mergedFrom records that other's centroids have been merged into t. A
+// digest without weight contributes no data, so its compression is ignored.
+func (t *TDigest) mergedFrom(other *TDigest) {
+	c := other.EffectiveCompression()
+	if other.totalWeight() > 0 && (t.effectiveCompression == 0 || c < t.effectiveCompression) {
+		t.effectiveCompression = c
+	}
+	t.mergeExact(other)
+}
+
+// ResolutionProfile returns, for each centroid in ascending order of mean, the
+// fraction of the total weight it holds, which is the width of the quantile
+// range it covers. The fractions sum to one. Scalers that concentrate
+// resolution in the tails give small fractions at both ends.
+func (t *TDigest) ResolutionProfile() []float64 {
+	t.processForQuery()
+	profile := make([]float64, t.processed.Len())
+	for i, c := range t.processed {
+		profile[i] = c.Weight / t.processedWeight
+	}
+	return profile
+}
+
+// accuracyTailWeight is the most weight AccuracyWarning accepts in each
+// extreme centroid before it warns.
+const accuracyTailWeight = 100
+
+// AccuracyWarning reports whether t's compression is too low for the weight
+// it holds, with a suggestion for the operator. The scaler limits the
+// extreme centroids to a fixed fraction of the total weight, so as samples
+// accumulate each comes to hold more of them, and quantiles within that
+// fraction of either end are interpolated over hundreds of samples rather
+// than read from a few. It warns once that bound exceeds 100 samples, naming
+// the lowest compression that would restore it. This is advisory: the
+// digest remains valid, and only the far tails are affected.
+func (t *TDigest) AccuracyWarning() (string, bool) {
+	w := t.totalWeight()
+	tail := func(compression float64) float64 {
+		return w * t.Scaler.integratedQ(1, compression)
+	}
+	if !(tail(t.Compression) > accuracyTailWeight) {
+		return "", false
+	}
+	// Double up to a compression that keeps the bound, then bisect down to
+	// the lowest whole one.
+	lo, hi := math.Ceil(t.Compression), 2*math.Ceil(t.Compression)
+	for tail(hi) > accuracyTailWeight {
+		lo, hi = hi, 2*hi
+	}
+	for hi-lo > 1 {
+		mid := math.Floor((lo + hi) / 2)
+		if tail(mid) > accuracyTailWeight {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return fmt.Sprintf("compression %g lets each extreme centroid hold up to %.0f of %.0f samples, "+
+		"so quantiles within %.2g of either end are interpolated; "+
+		"compression %g or more keeps that to %d samples",
+		t.Compression, tail(t.Compression), w, t.Scaler.integratedQ(1, t.Compression), hi, accuracyTailWeight), true
+}
+
+// SizeBytes estimates the heap memory retained by t: the digest itself plus
+// the capacity of its centroid, cumulative and example buffers, including the
+// copies a decaying digest keeps for queries. It counts allocated capacity
+// rather than length, since that is what stays live, and is unrelated to the
+// size of the serialized form.
+func (t *TDigest) SizeBytes() int {
+	n := int(unsafe.Sizeof(*t))
+	n += bufferBytes(t.processed, t.unprocessed, t.cumulative, t.processedExamples, t.processedTimes, t.unprocessedTimes)
+	if p := t.pending; p != nil {
+		n += int(unsafe.Sizeof(*p))
+		n += bufferBytes(p.processed, p.unprocessed, p.cumulative, p.processedExamples, p.processedTimes, p.unprocessedTimes)
+	}
+	if c, ok := t.quantiles.Load().(*quantileCache); ok {
+		n += int(unsafe.Sizeof(*c)) + (cap(c.q)+cap(c.v))*8
+	}
+	return n
+}
+
+// bufferBytes is the allocated size of one set of a digest's buffers.
+func bufferBytes(processed, unprocessed CentroidList, cumulative []float64, examples [][]float64, processedTimes, unprocessedTimes []int64) int {
+	n := (cap(processed) + cap(unprocessed)) * int(unsafe.Sizeof(Centroid{}))
+	n += cap(cumulative) * 8
+	n += cap(examples) * int(unsafe.Sizeof([]float64(nil)))
+	for _, e := range examples {
+		n += cap(e) * 8
+	}
+	return n + (cap(processedTimes)+cap(unprocessedTimes))*8
+}
+
+// Sum returns the weighted sum of all values added, including those not yet
+// processed. Each centroid's mean is the exact weighted mean of the values
+// merged into it, so the result differs from the true sum only by
+// floating-point rounding, a relative error of roughly the number of merges
+// times 2^-53. On a decaying digest it is the sum of the decayed weights.
+func (t *TDigest) Sum() float64 {
+	var sum float64
+	for _, c := range t.processed {
+		sum += c.Mean * c.Weight
+	}
+	for _, c := range t.unprocessed {
+		sum += c.Mean * c.Weight
+	}
+	return sum
+}
+
+// Mean returns the weighted mean of all values added, or NaN for an empty
+// digest. Like Sum it is exact up to floating-point rounding.
+func (t *TDigest) Mean() float64 {
+	w := t.totalWeight()
+	if !(w > 0) {
+		return math.NaN()
+	}
+	return t.Sum() / w
+}
+
+// StdDev returns the weighted population standard deviation estimated from
+// the centroid means, or NaN for an empty digest. The spread of values within
+// each centroid is lost when they merge, so it slightly underestimates the
+// true value; at the default compression the shortfall is well under 0.1%.
+func (t *TDigest) StdDev() float64 {
+	mean := t.Mean()
+	if math.IsNaN(mean) {
+		return math.NaN()
+	}
+	var ss compensatedSum
+	for _, l := range []CentroidList{t.processed, t.unprocessed} {
+		for _, c := range l {
+			d := c.Mean - mean
+			ss.add(c.Weight * d * d)
+		}
+	}
+	return math.Sqrt(ss.value() / t.totalWeight())
+}
+
+// CoefficientOfVariation returns StdDev divided by Mean, a dimensionless
+// measure of spread for comparing metrics on different scales. It is only
+// meaningful for positive quantities, so it returns NaN unless the mean is
+// positive, as well as for an empty digest.
+func (t *TDigest) CoefficientOfVariation() float64 {
+	mean := t.Mean()
+	if !(mean > 0) {
+		return math.NaN()
+	}
+	return t.StdDev() / mean
+}
+
+// ExpectedShortfall returns the mean of the weight above quantile q, the
+// conditional value at risk of the upper tail. Each centroid's weight is
+// treated as spread over its share of the ranks, so the centroid straddling q
+// contributes only the part of its weight above q. It returns Max for q = 1,
+// and NaN if q is outside [0, 1] or the digest is empty.
+func (t *TDigest) ExpectedShortfall(q float64) float64 {
+	t.processForQuery()
+	if !(q >= 0 && q <= 1) || t.processed.Len() == 0 {
+		return math.NaN()
+	}
+	if q == 1 {
+		return t.max
+	}
+	tail := (1 - q) * t.processedWeight
+	var weight, sum compensatedSum
+	for i := t.processed.Len() - 1; i >= 0; i-- {
+		c := t.processed[i]
+		w := math.Min(c.Weight, tail-weight.value())
+		if w <= 0 {
+			break
+		}
+		weight.add(w)
+		sum.add(w * c.Mean)
+	}
+	return sum.value() / weight.value()
+}
+
+// TrimmedSum returns the weighted sum of the values between quantiles lowQ
+// and highQ, such as a total that ignores the most extreme 1% as anomalies.
+// Like ExpectedShortfall it treats each centroid's weight as spread over its
+// share of the ranks, so a centroid straddling either bound contributes only
+// the part of its weight inside the band, at its mean. TrimmedSum(0, 1) is
+// Sum of the processed digest. It returns 0 for an empty digest, and NaN if
+// either quantile is outside [0, 1] or lowQ is above highQ.
+func (t *TDigest) TrimmedSum(lowQ, highQ float64) float64 {
+	t.processForQuery()
+	if !(lowQ >= 0 && highQ <= 1 && lowQ <= highQ) {
+		return math.NaN()
+	}
+	lo, hi := lowQ*t.processedWeight, highQ*t.processedWeight
+	var start, sum compensatedSum
+	for _, c := range t.processed {
+		from := start.value()
+		start.add(c.Weight)
+		if from >= hi {
+			break
+		}
+		if w := math.Min(start.value(), hi) - math.Max(from, lo); w > 0 {
+			sum.add(w * c.Mean)
+		}
+	}
+	return sum.value()
+}
+
 func (t *TDigest) Min() float64 {
 	return t.min
 }
@@ -1,12 +1,16 @@
 package tdigest
 
 import (
+	"context"
 	"testing"
 
 	"golang.org/x/exp/rand"
 	"gonum.org/v1/gonum/stat/distuv"
 	"math"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -353,3 +357,1905 @@ func BenchmarkCDF(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkAddQuantile(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		new  func() *TDigest
+	}{
+		{name: "plain", new: func() *TDigest { return NewWithCompression(1000) }},
+		{name: "decay", new: func() *TDigest {
+			return NewWithDecay(1000, benchmarkDecayValue, benchmarkDecayEvery)
+		}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			src := rand.New(rand.NewSource(1))
+			td := bm.new()
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				td.Add(src.NormFloat64(), 1)
+				td.Quantile(0.99)
+			}
+		})
+	}
+}
+
+func TestQuantilesContext(t *testing.T) {
+	qs := make([]float64, 1000)
+	for i := range qs {
+		qs[i] = float64(i) / float64(len(qs)-1)
+	}
+	qs = append(qs, -1, math.NaN())
+	got, err := NormalDigest.QuantilesContext(context.Background(), qs)
+	if err != nil {
+		t.Fatalf("QuantilesContext err: %v", err)
+	}
+	for i, q := range qs {
+		if want := NormalDigest.Quantile(q); got[i] != want && !(math.IsNaN(got[i]) && math.IsNaN(want)) {
+			t.Errorf("quantile %g: got %g want %g", q, got[i], want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	td := simpleTDigest(100)
+	if got, err := td.QuantilesContext(ctx, qs); err != context.Canceled || got != nil {
+		t.Errorf("unexpected result for a canceled context, got %v, %v", got, err)
+	}
+	if !td.Dirty() {
+		t.Errorf("canceled query processed the digest")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if _, err := td.QuantilesContext(ctx, qs); err != context.DeadlineExceeded {
+		t.Errorf("unexpected err for an expired deadline, got %v want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestQueryAllocs(t *testing.T) {
+	td := NewWithCompression(benchmarkCompression)
+	for _, x := range NormalData[:100000] {
+		td.Add(x, 1)
+	}
+	qs := []float64{0.5, 0.9, 0.99, 0.999}
+	// The second miss of each quantile admits it to the cache.
+	for i := 0; i < 2; i++ {
+		for _, q := range qs {
+			td.Quantile(q)
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	queries := map[string]func(){
+		"cached quantiles": func() {
+			for _, q := range qs {
+				td.Quantile(q)
+			}
+		},
+		"distinct quantiles": func() { td.Quantile(rng.Float64()) },
+		"CDF":                func() { td.CDF(Mu + Sigma*rng.NormFloat64()) },
+	}
+	for name, query := range queries {
+		if allocs := testing.AllocsPerRun(1000, query); allocs != 0 {
+			t.Errorf("%s: unexpected allocations between adds, got %g want 0", name, allocs)
+		}
+	}
+}
+
+func TestConsumeChannel(t *testing.T) {
+	ch := make(chan float64, 64)
+	td := New()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		td.ConsumeChannel(ch, nil)
+	}()
+	for _, x := range UniformData {
+		ch <- x
+	}
+	close(ch)
+	wg.Wait()
+
+	if got := td.Count(); got != N {
+		t.Errorf("unexpected count, got %d want %d", got, int64(N))
+	}
+	if td.unprocessed.Len() != 0 {
+		t.Errorf("expected consumed values to be processed")
+	}
+	if got, want := td.Quantile(0.5), UniformDigest.Quantile(0.5); math.Abs(got-want) > 0.05 {
+		t.Errorf("unexpected median, got %g want %g", got, want)
+	}
+
+	// done stops consumption even though ch stays open.
+	done := make(chan struct{})
+	ch = make(chan float64)
+	td = New()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		td.ConsumeChannel(ch, done)
+	}()
+	ch <- 1
+	ch <- 2
+	close(done)
+	wg.Wait()
+	if got := td.Count(); got != 2 {
+		t.Errorf("unexpected count after done, got %d want 2", got)
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		mean    float64
+		weight  float64
+		wantErr error
+	}{
+		{name: "valid", mean: 1, weight: 1},
+		{name: "nan mean", mean: math.NaN(), weight: 1, wantErr: ErrInvalidMean},
+		{name: "inf mean", mean: math.Inf(1), weight: 1, wantErr: ErrInvalidMean},
+		{name: "zero weight", mean: 1, weight: 0, wantErr: ErrInvalidWeight},
+		{name: "negative weight", mean: 1, weight: -1, wantErr: ErrInvalidWeight},
+		{name: "inf weight", mean: 1, weight: math.Inf(1), wantErr: ErrInvalidWeight},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			td := New()
+			td.StrictMode = true
+			td.Add(5, 1)
+			td.Add(tt.mean, tt.weight)
+			if err := td.Err(); err != tt.wantErr {
+				t.Errorf("unexpected Err(), got %v want %v", err, tt.wantErr)
+			}
+			wantCount := int64(1)
+			if tt.wantErr == nil {
+				wantCount = 2
+			}
+			if got := td.Count(); got != wantCount {
+				t.Errorf("unexpected count, got %d want %d", got, wantCount)
+			}
+		})
+	}
+
+	td := New()
+	td.StrictMode = true
+	td.AddCentroidList(CentroidList{{Mean: 1, Weight: 1}, {Mean: 2, Weight: -1}, {Mean: 3, Weight: 1}})
+	if err := td.Err(); err != ErrInvalidWeight {
+		t.Errorf("unexpected Err() after AddCentroidList, got %v want %v", err, ErrInvalidWeight)
+	}
+	if got := td.Quantile(1); got != 3 {
+		t.Errorf("unexpected max quantile after rejection, got %g want 3", got)
+	}
+}
+
+func TestAddSafe(t *testing.T) {
+	td := NewWithCompression(20)
+	values := []float64{math.NaN(), math.Inf(1), math.Inf(-1), 0, -0.0, 1e308, -1e308, math.SmallestNonzeroFloat64, math.MaxFloat64}
+	weights := []float64{math.NaN(), math.Inf(1), -1, 0, 1, 1e-300, 1e300, math.MaxFloat64}
+	src := rand.New(rand.NewSource(2))
+	for i := 0; i < 10000; i++ {
+		mean := values[src.Intn(len(values))]
+		weight := weights[src.Intn(len(weights))]
+		if src.Intn(2) == 0 {
+			mean = src.NormFloat64()
+			weight = src.Float64()
+		}
+		err := td.AddSafe(mean, weight)
+		switch {
+		case math.IsNaN(mean) || math.IsInf(mean, 0):
+			if err != ErrInvalidMean {
+				t.Fatalf("AddSafe(%g, %g): got err %v want %v", mean, weight, err, ErrInvalidMean)
+			}
+		case !(weight > 0) || math.IsInf(weight, 0):
+			if err != ErrInvalidWeight {
+				t.Fatalf("AddSafe(%g, %g): got err %v want %v", mean, weight, err, ErrInvalidWeight)
+			}
+		}
+		if err := td.CheckConsistency(); err != nil {
+			t.Fatalf("after AddSafe(%g, %g): inconsistent digest: %v", mean, weight, err)
+		}
+	}
+	td.ProcessNow()
+	if err := td.CheckConsistency(); err != nil {
+		t.Fatalf("inconsistent digest after processing: %v", err)
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	if err := NormalDigest.CheckConsistency(); err != nil {
+		t.Errorf("unexpected err for a valid digest: %v", err)
+	}
+
+	td := simpleTDigest(1000)
+	td.processed[1], td.processed[2] = td.processed[2], td.processed[1]
+	if err := td.CheckConsistency(); err != ErrUnsortedCentroids {
+		t.Errorf("unexpected err, got %v want %v", err, ErrUnsortedCentroids)
+	}
+	td = simpleTDigest(1000)
+	td.processedWeight++
+	if err := td.CheckConsistency(); err != ErrInconsistentWeight {
+		t.Errorf("unexpected err, got %v want %v", err, ErrInconsistentWeight)
+	}
+	td = simpleTDigest(1000)
+	td.AddCentroid(Centroid{Mean: math.NaN(), Weight: 1})
+	if err := td.CheckConsistency(); err != ErrInvalidMean {
+		t.Errorf("unexpected err, got %v want %v", err, ErrInvalidMean)
+	}
+}
+
+func TestProcessNow(t *testing.T) {
+	td := New()
+	for _, x := range []float64{1, 2, 3, 4, 5} {
+		td.Add(x, 1)
+	}
+	if td.unprocessed.Len() != 5 {
+		t.Fatalf("expected 5 unprocessed centroids, got %d", td.unprocessed.Len())
+	}
+	td.ProcessNow()
+	if td.unprocessed.Len() != 0 {
+		t.Errorf("expected no unprocessed centroids, got %d", td.unprocessed.Len())
+	}
+	if td.processedWeight != 5 {
+		t.Errorf("unexpected processed weight, got %g want 5", td.processedWeight)
+	}
+	if got := td.Quantile(0.5); got != 3 {
+		t.Errorf("unexpected quantile after ProcessNow, got %g want 3", got)
+	}
+}
+
+func TestDirty(t *testing.T) {
+	td := New()
+	if td.Dirty() {
+		t.Errorf("new digest is dirty")
+	}
+	td.Add(1, 1)
+	if !td.Dirty() {
+		t.Errorf("digest with a pending value is not dirty")
+	}
+	td.Quantile(0.5)
+	if td.Dirty() {
+		t.Errorf("digest is dirty after a query")
+	}
+	td.Add(2, 1)
+	td.ProcessNow()
+	if td.Dirty() {
+		t.Errorf("digest is dirty after ProcessNow")
+	}
+}
+
+func TestClear(t *testing.T) {
+	fill := func(td *TDigest) {
+		for _, x := range UniformData[:10000] {
+			td.Add(x, 1)
+		}
+	}
+	want := NewWithDecay(100, 0.9, 500)
+	fill(want)
+
+	for _, tc := range []struct {
+		name  string
+		clear func(*TDigest)
+		keeps bool
+	}{
+		{"keeping capacity", (*TDigest).ClearKeepingCapacity, true},
+		{"releasing memory", (*TDigest).ClearReleasingMemory, false},
+	} {
+		td := NewWithDecay(100, 0.9, 500)
+		td.KeepExamples(1)
+		fill(td)
+		td.Quantile(0.5)
+		processedCap, unprocessedCap, cumulativeCap := cap(td.processed), cap(td.unprocessed), cap(td.cumulative)
+
+		tc.clear(td)
+		if td.Count() != 0 || !math.IsNaN(td.Quantile(0.5)) || td.Dirty() {
+			t.Errorf("%s: digest not empty, count %d", tc.name, td.Count())
+		}
+		if tc.keeps {
+			if cap(td.processed) != processedCap || cap(td.unprocessed) != unprocessedCap || cap(td.cumulative) != cumulativeCap {
+				t.Errorf("%s: capacity changed, got %d %d %d want %d %d %d", tc.name, cap(td.processed), cap(td.unprocessed), cap(td.cumulative), processedCap, unprocessedCap, cumulativeCap)
+			}
+		} else if cap(td.processed) != 0 || cap(td.unprocessed) != 0 || cap(td.cumulative) != 0 {
+			t.Errorf("%s: buffers retained, got %d %d %d", tc.name, cap(td.processed), cap(td.unprocessed), cap(td.cumulative))
+		}
+		if td.Compression != 100 || td.decayEvery != 500 || td.exampleLimit != 1 {
+			t.Errorf("%s: settings changed", tc.name)
+		}
+
+		// The cleared digest behaves like a new one with the same settings.
+		td.KeepExamples(0)
+		fill(td)
+		if td.Count() != want.Count() || td.Min() != want.Min() || td.Max() != want.Max() {
+			t.Errorf("%s: unexpected refilled state", tc.name)
+		}
+		for _, q := range []float64{0.01, 0.5, 0.99} {
+			if got, want := td.Quantile(q), want.Quantile(q); got != want {
+				t.Errorf("%s: unexpected quantile %g, got %g want %g", tc.name, q, got, want)
+			}
+		}
+	}
+}
+
+func TestClearRefillAllocs(t *testing.T) {
+	td := NewWithDecay(benchmarkCompression, benchmarkDecayValue, benchmarkDecayEvery)
+	refill := func() {
+		td.ClearKeepingCapacity()
+		for _, x := range NormalData[:2000] {
+			td.Add(x, 1)
+		}
+		td.Quantile(0.99)
+	}
+	// The first cycles grow the buffers to their working size.
+	refill()
+	refill()
+	if allocs := testing.AllocsPerRun(100, refill); allocs != 0 {
+		t.Errorf("unexpected allocations per clear and refill, got %g want 0", allocs)
+	}
+}
+
+// BenchmarkClearRefill resets a scratch digest every few thousand adds, as a
+// windowed aggregator does.
+func BenchmarkClearRefill(b *testing.B) {
+	td := NewWithDecay(benchmarkCompression, benchmarkDecayValue, benchmarkDecayEvery)
+	data := NormalData[:2000]
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		td.ClearKeepingCapacity()
+		for _, x := range data {
+			td.Add(x, 1)
+		}
+		td.Quantile(0.99)
+	}
+}
+
+func TestQuantileRatio(t *testing.T) {
+	zero := New()
+	for i := 0; i < 10; i++ {
+		zero.Add(0, 1)
+	}
+	zero.Add(5, 1)
+	tests := []struct {
+		name        string
+		digest      *TDigest
+		qHigh, qLow float64
+		want        float64
+	}{
+		{"normal", NormalDigest, 0.99, 0.5, NormalDigest.Quantile(0.99) / NormalDigest.Quantile(0.5)},
+		{"inverted", UniformDigest, 0.25, 0.75, UniformDigest.Quantile(0.25) / UniformDigest.Quantile(0.75)},
+		{"zero denominator", zero, 0.99, 0.5, math.NaN()},
+		{"invalid quantile", NormalDigest, 1.5, 0.5, math.NaN()},
+		{"empty", New(), 0.99, 0.5, math.NaN()},
+	}
+	for _, tt := range tests {
+		got := tt.digest.QuantileRatio(tt.qHigh, tt.qLow)
+		if got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) {
+			t.Errorf("%s: got %g want %g", tt.name, got, tt.want)
+		}
+	}
+
+	// Pending values are merged once, before either quantile is read.
+	td := simpleTDigest(100)
+	want := td.Clone().Quantile(0.9) / td.Clone().Quantile(0.1)
+	if got := td.QuantileRatio(0.9, 0.1); got != want {
+		t.Errorf("unexpected ratio with pending values, got %g want %g", got, want)
+	}
+}
+
+func TestCountBetween(t *testing.T) {
+	tests := []struct {
+		name      string
+		digest    *TDigest
+		low, high float64
+		want      float64
+		epsilon   float64
+	}{
+		{name: "uniform middle", digest: UniformDigest, low: 25, high: 75, want: N / 2, epsilon: N * 0.001},
+		{name: "uniform all", digest: UniformDigest, low: -1, high: 101, want: N},
+		{name: "uniform empty range", digest: UniformDigest, low: 50, high: 50, want: 0},
+		{name: "uniform reversed range", digest: UniformDigest, low: 75, high: 25, want: 0},
+		{name: "normal within sigma", digest: NormalDigest, low: Mu - Sigma, high: Mu + Sigma, want: N * 0.6827, epsilon: N * 0.001},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.digest.CountBetween(tt.low, tt.high)
+			if math.Abs(got-tt.want) > tt.epsilon {
+				t.Errorf("unexpected count in [%g, %g), got %g want %g", tt.low, tt.high, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMassBetween(t *testing.T) {
+	tests := []struct {
+		name      string
+		low, high float64
+		want      float64
+	}{
+		{"middle", 0.25, 0.75, 0.5},
+		{"clamped", -1, 2, 1},
+		{"empty band", 0.5, 0.5, 0},
+		{"reversed", 0.75, 0.25, 0},
+		{"NaN", math.NaN(), 0.5, 0},
+	}
+	for _, tt := range tests {
+		if got := UniformDigest.MassBetweenQuantiles(tt.low, tt.high); got != tt.want {
+			t.Errorf("%s: unexpected mass between quantiles, got %g want %g", tt.name, got, tt.want)
+		}
+	}
+	if got := New().MassBetweenQuantiles(0, 1); got != 0 {
+		t.Errorf("empty digest: got %g want 0", got)
+	}
+
+	// The value-based band agrees with the quantiles that bound it, and
+	// with CountBetween.
+	for _, band := range [][2]float64{{0.1, 0.3}, {0.4, 0.6}, {0.99, 0.999}, {0.9999, 1}} {
+		low, high := NormalDigest.Quantile(band[0]), NormalDigest.Quantile(band[1])
+		got := NormalDigest.MassBetweenValues(low, high)
+		if want := NormalDigest.MassBetweenQuantiles(band[0], band[1]); math.Abs(got-want) > 1e-3*want+1e-9 {
+			t.Errorf("band %v: unexpected mass, got %g want %g", band, got, want)
+		}
+		if count := NormalDigest.CountBetween(low, high) / N; math.Abs(got-count) > 1e-6 {
+			t.Errorf("band %v: mass %g disagrees with CountBetween %g", band, got, count)
+		}
+	}
+	for _, tt := range tests[2:] {
+		if got := UniformDigest.MassBetweenValues(tt.low*100, tt.high*100); got != 0 {
+			t.Errorf("%s: unexpected mass between values, got %g want 0", tt.name, got)
+		}
+	}
+	if got := New().MassBetweenValues(0, 1); got != 0 {
+		t.Errorf("empty digest: got %g want 0", got)
+	}
+}
+
+func TestThresholdForTopN(t *testing.T) {
+	if got, want := UniformDigest.ThresholdForTopN(N/100), UniformDigest.Quantile(0.99); got != want {
+		t.Errorf("unexpected threshold for the top 1%%, got %g want %g", got, want)
+	}
+	if got := UniformDigest.ThresholdForTopN(1000); math.Abs(got-99.9) > 0.01 {
+		t.Errorf("unexpected threshold for the top 1000, got %g want about 99.9", got)
+	}
+	tests := []struct {
+		name   string
+		digest *TDigest
+		n      float64
+		want   float64
+	}{
+		{"all", UniformDigest, N, UniformDigest.Min()},
+		{"more than all", UniformDigest, 2 * N, UniformDigest.Min()},
+		{"none", UniformDigest, 0, UniformDigest.Max()},
+		{"negative", UniformDigest, -1, UniformDigest.Max()},
+		{"NaN", UniformDigest, math.NaN(), math.NaN()},
+		{"empty", New(), 1, math.NaN()},
+	}
+	for _, tt := range tests {
+		got := tt.digest.ThresholdForTopN(tt.n)
+		if got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) {
+			t.Errorf("%s: got %g want %g", tt.name, got, tt.want)
+		}
+	}
+
+	// Decayed weights are measured against the weight that remains.
+	td := NewWithDecay(100, 0.5, 1000)
+	for _, x := range UniformData[:1500] {
+		td.Add(x, 1)
+	}
+	td.ProcessNow()
+	if got, want := td.ThresholdForTopN(td.processedWeight/10), td.Quantile(0.9); got != want {
+		t.Errorf("decayed digest: got %g want %g", got, want)
+	}
+}
+
+func TestCDFOutOfRange(t *testing.T) {
+	td := New()
+	for i := 1; i <= 5; i++ {
+		td.Add(float64(i), 1)
+	}
+	if got := td.CDF(0); got != 0 {
+		t.Errorf("clamped CDF below the minimum: got %g want 0", got)
+	}
+	if got := td.CDF(6); got != 1 {
+		t.Errorf("clamped CDF above the maximum: got %g want 1", got)
+	}
+
+	td.CDFOutOfRange = OutOfRangeNaN
+	for _, x := range []float64{0, 0.999, 5.001, 6, math.Inf(1)} {
+		if got := td.CDF(x); !math.IsNaN(got) {
+			t.Errorf("CDF(%g) outside the range: got %g want NaN", x, got)
+		}
+	}
+	if got := td.PercentileRank(6); !math.IsNaN(got) {
+		t.Errorf("PercentileRank outside the range: got %g want NaN", got)
+	}
+	for _, x := range []float64{1, 3, 5} {
+		if got, want := td.CDF(x), td.cdf(x); got != want {
+			t.Errorf("CDF(%g) inside the range: got %g want %g", x, got, want)
+		}
+	}
+	if got := td.Clone().CDF(6); !math.IsNaN(got) {
+		t.Errorf("clone did not keep the mode, got %g", got)
+	}
+	empty := New()
+	empty.CDFOutOfRange = OutOfRangeNaN
+	if got := empty.CDF(0); !math.IsNaN(got) {
+		t.Errorf("empty digest: got %g want NaN", got)
+	}
+
+	wide := New()
+	for i := 0; i <= 10; i++ {
+		wide.Add(float64(i), 1)
+	}
+	deltas := wide.CDFDelta(td, []float64{0, 3, 8})
+	if !math.IsNaN(deltas[0]) || math.IsNaN(deltas[1]) || !math.IsNaN(deltas[2]) {
+		t.Errorf("CDFDelta ignored the mode, got %v", deltas)
+	}
+	td.CDFOutOfRange = OutOfRangeClamp
+	if deltas := wide.CDFDelta(td, []float64{0, 8}); deltas[0] != wide.CDF(0) || deltas[1] != wide.CDF(8)-1 {
+		t.Errorf("clamped CDFDelta outside the range, got %v", deltas)
+	}
+}
+
+func TestPercentileRank(t *testing.T) {
+	td := New()
+	for i := 1; i <= 5; i++ {
+		td.Add(float64(i), 1)
+	}
+	tests := []struct {
+		x, want float64
+	}{
+		{x: 0, want: 0},
+		{x: 1, want: 0},
+		{x: 2, want: 30},
+		{x: 2.5, want: 40},
+		{x: 3, want: 50},
+		{x: 5, want: 100},
+		{x: 6, want: 100},
+	}
+	for _, tt := range tests {
+		if got := td.PercentileRank(tt.x); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("unexpected percentile rank of %g, got %g want %g", tt.x, got, tt.want)
+		}
+	}
+
+	single := New()
+	single.Add(42, 1)
+	if got := single.PercentileRank(42); got != 50 {
+		t.Errorf("unexpected percentile rank of a lone value, got %g want 50", got)
+	}
+}
+
+func TestSLO(t *testing.T) {
+	p99 := UniformDigest.Quantile(0.99)
+	tests := []struct {
+		name      string
+		threshold float64
+		meets     bool
+		headroom  float64
+	}{
+		{name: "above", threshold: p99 + 1, meets: true, headroom: 1},
+		{name: "boundary", threshold: p99, meets: true, headroom: 0},
+		{name: "below", threshold: p99 - 1, meets: false, headroom: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := UniformDigest.MeetsSLO(0.99, tt.threshold); got != tt.meets {
+				t.Errorf("unexpected compliance, got %v want %v", got, tt.meets)
+			}
+			if got := UniformDigest.SLOHeadroom(0.99, tt.threshold); math.Abs(got-tt.headroom) > 1e-9 {
+				t.Errorf("unexpected headroom, got %g want %g", got, tt.headroom)
+			}
+		})
+	}
+	if New().MeetsSLO(0.99, math.Inf(1)) {
+		t.Errorf("empty digest should not meet an objective")
+	}
+	if got := New().SLOHeadroom(0.99, 300); !math.IsNaN(got) {
+		t.Errorf("unexpected headroom of empty digest, got %g want NaN", got)
+	}
+}
+
+func TestProbabilityWeighted(t *testing.T) {
+	td := New()
+	td.ProbabilityWeighted = true
+	// densities summing to slightly less than one
+	for i := 0; i < 1000; i++ {
+		td.Add(float64(i), 0.00098)
+	}
+	if got := td.CountBetween(0, 500); math.Abs(got-0.5) > 0.001 {
+		t.Errorf("unexpected fraction between, got %g want 0.5", got)
+	}
+	if got, want := td.ValueAtRank(0.25), td.Quantile(0.25); got != want {
+		t.Errorf("unexpected value at rank, got %g want %g", got, want)
+	}
+	if got := td.Count(); got != 1000 {
+		t.Errorf("unexpected count, got %d want 1000", got)
+	}
+
+	td.ProbabilityWeighted = false
+	if got := td.CountBetween(0, 500); math.Abs(got-0.49) > 0.001 {
+		t.Errorf("unexpected weight between, got %g want 0.49", got)
+	}
+}
+
+func TestAddCentroidListBounded(t *testing.T) {
+	list := make(CentroidList, 100000)
+	for i := range list {
+		list[i] = Centroid{Mean: UniformData[i], Weight: 1}
+	}
+	td := NewWithCompression(100)
+	td.AddCentroidList(list)
+
+	// Processing appends the processed centroids to the buffer, so allow for
+	// both plus append's growth factor.
+	limit := 2 * (td.maxUnprocessed + td.maxProcessed + 1)
+	if got := cap(td.unprocessed); got > limit {
+		t.Errorf("unprocessed buffer grew with input, cap %d want at most %d", got, limit)
+	}
+	if got := td.processedWeight + td.unprocessedWeight; got != float64(len(list)) {
+		t.Errorf("unexpected total weight, got %g want %d", got, len(list))
+	}
+}
+
+func TestQuantileDetailed(t *testing.T) {
+	for _, q := range []float64{0, 0.0000001, 0.01, 0.5, 0.99, 0.9999999, 1} {
+		value, left, right := NormalDigest.QuantileDetailed(q)
+		if want := NormalDigest.Quantile(q); value != want {
+			t.Errorf("unexpected quantile %g, got %g want %g", q, value, want)
+		}
+		if left.Weight <= 0 || right.Weight <= 0 || left.Mean > right.Mean {
+			t.Errorf("quantile %g: unexpected centroids %v and %v", q, left, right)
+		}
+		lo, hi := math.Min(left.Mean, NormalDigest.Min()), math.Max(right.Mean, NormalDigest.Max())
+		if q > 0.001 && q < 0.999 {
+			lo, hi = left.Mean, right.Mean
+		}
+		if value < lo || value > hi {
+			t.Errorf("quantile %g: value %g outside [%g, %g]", q, value, lo, hi)
+		}
+	}
+
+	if _, left, right := NormalDigest.QuantileDetailed(0); left != NormalDigest.processed[0] || right != left {
+		t.Errorf("expected the first centroid in the left tail, got %v and %v", left, right)
+	}
+	if value, left, right := New().QuantileDetailed(0.5); !math.IsNaN(value) || left != (Centroid{}) || right != (Centroid{}) {
+		t.Errorf("unexpected result for empty digest, got %g, %v, %v", value, left, right)
+	}
+}
+
+func TestQuantileInt(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []float64
+		quantile float64
+		want     int64
+	}{
+		{name: "exact", quantile: 0.5, data: []float64{1, 2, 3, 4, 5}, want: 3},
+		{name: "round half up", quantile: 0.5, data: []float64{1, 2}, want: 2},
+		{name: "round half away from zero", quantile: 0.5, data: []float64{-1, -2}, want: -2},
+		{name: "round down", quantile: 0.25, data: []float64{0, 1}, want: 0},
+		{name: "empty", quantile: 0.5, want: 0},
+		{name: "invalid quantile", quantile: 2, data: []float64{1}, want: 0},
+		{name: "saturate", quantile: 0.5, data: []float64{1e300}, want: math.MaxInt64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			td := New()
+			for _, x := range tt.data {
+				td.Add(x, 1)
+			}
+			if got := td.QuantileInt(tt.quantile); got != tt.want {
+				t.Errorf("unexpected quantile %f, got %d want %d (from %g)", tt.quantile, got, tt.want, td.Quantile(tt.quantile))
+			}
+		})
+	}
+}
+
+func TestSingleValue(t *testing.T) {
+	td := New()
+	td.Add(7, 1)
+	for _, q := range []float64{0, 0.3, 0.5, 0.99, 1} {
+		if got := td.Quantile(q); got != 7 {
+			t.Errorf("unexpected quantile %g, got %g want 7", q, got)
+		}
+	}
+	tests := []struct {
+		x, want float64
+	}{
+		{x: math.Inf(-1), want: 0},
+		{x: 6.999, want: 0},
+		{x: 7, want: 0.5},
+		{x: 7.001, want: 1},
+		{x: math.Inf(1), want: 1},
+	}
+	for _, tt := range tests {
+		if got := td.CDF(tt.x); got != tt.want {
+			t.Errorf("unexpected CDF %g, got %g want %g", tt.x, got, tt.want)
+		}
+	}
+}
+
+func TestExtremesTracked(t *testing.T) {
+	// At low compression the end centroids absorb many values, so their
+	// means lie well inside the observed range.
+	td := NewWithCompression(5)
+	for _, x := range UniformData[:10000] {
+		td.Add(x, 1)
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, x := range UniformData[:10000] {
+		lo, hi = math.Min(lo, x), math.Max(hi, x)
+	}
+	td.ProcessNow()
+	if first := td.processed[0].Mean; first-lo < 1 {
+		t.Fatalf("expected the first centroid to move inwards, mean %g min %g", first, lo)
+	}
+
+	if td.Min() != lo || td.Max() != hi {
+		t.Errorf("unexpected range, got [%g, %g] want [%g, %g]", td.Min(), td.Max(), lo, hi)
+	}
+	if got := td.CDF(lo); got != 0 {
+		t.Errorf("unexpected CDF at min, got %g want 0", got)
+	}
+	if got := td.CDF(hi); got != 1 {
+		t.Errorf("unexpected CDF at max, got %g want 1", got)
+	}
+	if got := td.Quantile(0); got != lo {
+		t.Errorf("unexpected quantile 0, got %g want %g", got, lo)
+	}
+	if got := td.Quantile(1); got != hi {
+		t.Errorf("unexpected quantile 1, got %g want %g", got, hi)
+	}
+	// Interpolating from the true minimum keeps the tail close to uniform.
+	if got := td.CDF(lo + 1); got <= 0 || got > 0.02 {
+		t.Errorf("unexpected CDF near min, got %g want in (0, 0.02]", got)
+	}
+}
+
+func TestValueAtRank(t *testing.T) {
+	for _, q := range []float64{0, 0.01, 0.5, 0.99, 1} {
+		rank := q * float64(len(NormalData))
+		if got, want := NormalDigest.ValueAtRank(rank), NormalDigest.Quantile(q); got != want {
+			t.Errorf("unexpected value at rank %g, got %g want %g", rank, got, want)
+		}
+	}
+
+	td := NewWithDecay(100, 0.5, 10)
+	for i := 0; i < 100; i++ {
+		td.Add(float64(i), 1)
+	}
+	if got := td.ValueAtRank(float64(td.Count())); !math.IsNaN(got) {
+		t.Errorf("unexpected value beyond decayed weight, got %g want NaN", got)
+	}
+	if got, want := td.ValueAtRank(0), td.Min(); got != want {
+		t.Errorf("unexpected value at rank 0, got %g want %g", got, want)
+	}
+
+	for _, rank := range []float64{-1, math.NaN(), math.Inf(1)} {
+		if got := NormalDigest.ValueAtRank(rank); !math.IsNaN(got) {
+			t.Errorf("unexpected value at rank %g, got %g want NaN", rank, got)
+		}
+	}
+	if got := New().ValueAtRank(0); !math.IsNaN(got) {
+		t.Errorf("unexpected value at rank of empty digest, got %g want NaN", got)
+	}
+}
+
+func TestFractionalWeights(t *testing.T) {
+	unit := New()
+	for _, x := range NormalData {
+		unit.Add(x, 1)
+	}
+	tests := []struct {
+		weight  float64
+		epsilon float64
+	}{
+		// Halving every weight is exact, so the digests should be identical.
+		{weight: 0.5},
+		{weight: 0.1, epsilon: 0.001 * Sigma},
+	}
+	for _, tt := range tests {
+		td := New()
+		for _, x := range NormalData {
+			td.Add(x, tt.weight)
+		}
+		for _, q := range []float64{0.001, 0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+			got, want := td.Quantile(q), unit.Quantile(q)
+			if math.Abs(got-want) > tt.epsilon {
+				t.Errorf("weight %g: unexpected quantile %g, got %g want %g", tt.weight, q, got, want)
+			}
+		}
+		if got, want := td.processedWeight, tt.weight*N; math.Abs(got-want) > 1e-6 {
+			t.Errorf("weight %g: unexpected total weight, got %g want %g", tt.weight, got, want)
+		}
+	}
+}
+
+func TestAddRepeated(t *testing.T) {
+	repeated := New()
+	looped := New()
+	for i, x := range []float64{1, 2, 3, 4, 5} {
+		repeated.AddRepeated(x, i+1)
+		for j := 0; j <= i; j++ {
+			looped.Add(x, 1)
+		}
+	}
+	repeated.AddRepeated(6, 0)
+	repeated.AddRepeated(6, -1)
+	// Interpolation differs between one heavy centroid and many light ones,
+	// but never by more than the gap between adjacent values.
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 1} {
+		if got, want := repeated.Quantile(q), looped.Quantile(q); math.Abs(got-want) > 1 {
+			t.Errorf("unexpected quantile %f, got %g want %g", q, got, want)
+		}
+	}
+	if repeated.Min() != 1 || repeated.Max() != 5 {
+		t.Errorf("unexpected range, got [%g, %g] want [1, 5]", repeated.Min(), repeated.Max())
+	}
+	if got := repeated.processedWeight; got != 15 {
+		t.Errorf("unexpected total weight, got %g want 15", got)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	td := New()
+	for _, x := range UniformData[:10000] {
+		td.Add(x, 1)
+	}
+	snap := td.Snapshot()
+	want := snap.Quantile(0.99)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if got := snap.Quantile(0.99); got != want {
+					t.Errorf("snapshot changed under concurrent reads, got %g want %g", got, want)
+					return
+				}
+			}
+		}()
+	}
+	for _, x := range UniformData[10000:20000] {
+		td.Add(-x, 1)
+	}
+	wg.Wait()
+
+	if snap.unprocessed.Len() != 0 {
+		t.Errorf("expected snapshot to be fully processed")
+	}
+	if got := snap.Min(); got < 0 {
+		t.Errorf("snapshot saw writes to the original, min %g", got)
+	}
+}
+
+func TestSizeBytes(t *testing.T) {
+	small, large := NewWithCompression(100), NewWithCompression(1000)
+	if a, b := small.SizeBytes(), large.SizeBytes(); a >= b {
+		t.Errorf("expected higher compression to retain more, got %d and %d", a, b)
+	}
+	min := (cap(large.processed)+cap(large.unprocessed))*16 + cap(large.cumulative)*8
+	if got := large.SizeBytes(); got < min {
+		t.Errorf("unexpected size, got %d want at least %d", got, min)
+	}
+
+	td := simpleTDigest(1000)
+	before := td.SizeBytes()
+	td.KeepExamples(4)
+	for i := 0; i < 1000; i++ {
+		td.Add(float64(i), 1)
+	}
+	td.ProcessNow()
+	if got := td.SizeBytes(); got <= before {
+		t.Errorf("expected examples to add to the size, got %d want more than %d", got, before)
+	}
+
+	// A query on a decaying digest keeps a copy of the buffers to resume
+	// from.
+	decayed := NewWithDecay(100, 0.9, 1000)
+	for i := 0; i < 500; i++ {
+		decayed.Add(float64(i), 1)
+	}
+	before = decayed.SizeBytes()
+	decayed.Quantile(0.5)
+	p := decayed.pending
+	if want := before + (cap(p.processed)+cap(p.unprocessed))*16; decayed.SizeBytes() < want {
+		t.Errorf("unexpected size after a query, got %d want at least %d", decayed.SizeBytes(), want)
+	}
+}
+
+func TestSum(t *testing.T) {
+	td := NewWithCompression(10)
+	want := 0.0
+	for i := 1; i <= 1000; i++ {
+		td.Add(float64(i), 2)
+		want += float64(i) * 2
+	}
+	// Some values are still buffered.
+	if td.unprocessed.Len() == 0 {
+		t.Fatalf("expected pending values")
+	}
+	if got := td.Sum(); math.Abs(got-want) > want*1e-12 {
+		t.Errorf("unexpected sum, got %g want %g", got, want)
+	}
+
+	var uniform float64
+	for _, x := range UniformData {
+		uniform += x
+	}
+	if got := UniformDigest.Sum(); math.Abs(got-uniform) > uniform*1e-9 {
+		t.Errorf("unexpected sum of uniform data, got %g want %g", got, uniform)
+	}
+	if got := New().Sum(); got != 0 {
+		t.Errorf("unexpected sum of empty digest, got %g want 0", got)
+	}
+}
+
+func TestMoments(t *testing.T) {
+	tests := []struct {
+		name           string
+		digest         *TDigest
+		mean, stddev   float64
+		epsilon        float64
+		coefficientVar float64
+	}{
+		{name: "normal", digest: NormalDigest, mean: Mu, stddev: Sigma, epsilon: 0.01, coefficientVar: float64(Sigma) / Mu},
+		{name: "uniform", digest: UniformDigest, mean: 50, stddev: 100 / math.Sqrt(12), epsilon: 0.1, coefficientVar: 1 / math.Sqrt(3)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.digest.Mean(); math.Abs(got-tt.mean) > tt.epsilon {
+				t.Errorf("unexpected mean, got %g want %g", got, tt.mean)
+			}
+			if got := tt.digest.StdDev(); math.Abs(got-tt.stddev) > tt.epsilon {
+				t.Errorf("unexpected standard deviation, got %g want %g", got, tt.stddev)
+			}
+			if got := tt.digest.CoefficientOfVariation(); math.Abs(got-tt.coefficientVar) > 0.01 {
+				t.Errorf("unexpected coefficient of variation, got %g want %g", got, tt.coefficientVar)
+			}
+		})
+	}
+
+	negative := New()
+	negative.Add(-1, 1)
+	negative.Add(-3, 1)
+	if got := negative.Mean(); got != -2 {
+		t.Errorf("unexpected mean, got %g want -2", got)
+	}
+	if got := negative.StdDev(); got != 1 {
+		t.Errorf("unexpected standard deviation, got %g want 1", got)
+	}
+	if got := negative.CoefficientOfVariation(); !math.IsNaN(got) {
+		t.Errorf("unexpected coefficient of variation for a negative mean, got %g want NaN", got)
+	}
+	empty := New()
+	if !math.IsNaN(empty.Mean()) || !math.IsNaN(empty.StdDev()) || !math.IsNaN(empty.CoefficientOfVariation()) {
+		t.Errorf("expected NaN moments for an empty digest")
+	}
+}
+
+func TestExpectedShortfall(t *testing.T) {
+	// For a uniform distribution on [0, 100] the mean above quantile q lies
+	// halfway between the quantile and the maximum.
+	for _, q := range []float64{0, 0.5, 0.9, 0.99} {
+		want := (100*q + 100) / 2
+		if got := UniformDigest.ExpectedShortfall(q); math.Abs(got-want) > 0.05 {
+			t.Errorf("unexpected shortfall at %g, got %g want %g", q, got, want)
+		}
+	}
+	// A standard normal's tail mean above z is pdf(z) / (1 - q).
+	z := distuv.UnitNormal.Quantile(0.95)
+	want := Mu + Sigma*distuv.UnitNormal.Prob(z)/0.05
+	if got := NormalDigest.ExpectedShortfall(0.95); math.Abs(got-want) > 0.01 {
+		t.Errorf("unexpected normal shortfall, got %g want %g", got, want)
+	}
+	if got := UniformDigest.ExpectedShortfall(0); math.Abs(got-UniformDigest.Mean()) > 1e-9 {
+		t.Errorf("unexpected shortfall at 0, got %g want the mean %g", got, UniformDigest.Mean())
+	}
+
+	// The straddling centroid is prorated.
+	td := New()
+	td.Add(0, 1)
+	td.Add(10, 1)
+	if got := td.ExpectedShortfall(0.25); math.Abs(got-(0.5*0+1*10)/1.5) > 1e-12 {
+		t.Errorf("unexpected prorated shortfall, got %g want %g", got, (0.5*0+1*10)/1.5)
+	}
+	if got := td.ExpectedShortfall(1); got != 10 {
+		t.Errorf("unexpected shortfall at 1, got %g want 10", got)
+	}
+	for _, q := range []float64{-0.1, 1.1, math.NaN()} {
+		if got := td.ExpectedShortfall(q); !math.IsNaN(got) {
+			t.Errorf("unexpected shortfall at %g, got %g want NaN", q, got)
+		}
+	}
+	if got := New().ExpectedShortfall(0.5); !math.IsNaN(got) {
+		t.Errorf("unexpected shortfall of empty digest, got %g want NaN", got)
+	}
+}
+
+func TestTrimmedSum(t *testing.T) {
+	// Uniform values between quantiles a and b average 50(a+b).
+	for _, band := range [][2]float64{{0, 1}, {0.01, 0.99}, {0.25, 0.5}} {
+		a, b := band[0], band[1]
+		want := N * (b - a) * 50 * (a + b)
+		if got := UniformDigest.TrimmedSum(a, b); math.Abs(got-want) > want*1e-3 {
+			t.Errorf("unexpected trimmed sum over %v, got %g want %g", band, got, want)
+		}
+	}
+	if got, want := UniformDigest.TrimmedSum(0, 1), UniformDigest.Sum(); math.Abs(got-want) > want*1e-12 {
+		t.Errorf("untrimmed sum %g differs from Sum %g", got, want)
+	}
+
+	// Outliers beyond the band do not inflate it, and straddling centroids
+	// are prorated.
+	td := New()
+	for i := 0; i < 99; i++ {
+		td.Add(1, 1)
+	}
+	td.Add(1e9, 1)
+	if got := td.TrimmedSum(0, 0.99); got != 99 {
+		t.Errorf("unexpected sum without the outlier, got %g want 99", got)
+	}
+	if got := td.TrimmedSum(0.985, 0.995); math.Abs(got-(0.5+0.5e9)) > 1e-3 {
+		t.Errorf("unexpected prorated sum, got %g want %g", got, 0.5+0.5e9)
+	}
+	if got := td.TrimmedSum(0.5, 0.5); got != 0 {
+		t.Errorf("unexpected sum over an empty band, got %g", got)
+	}
+	for _, band := range [][2]float64{{-0.1, 0.5}, {0.5, 1.1}, {0.6, 0.4}, {math.NaN(), 1}} {
+		if got := td.TrimmedSum(band[0], band[1]); !math.IsNaN(got) {
+			t.Errorf("unexpected sum over %v, got %g want NaN", band, got)
+		}
+	}
+	if got := New().TrimmedSum(0, 1); got != 0 {
+		t.Errorf("unexpected sum of empty digest, got %g want 0", got)
+	}
+}
+
+func TestIsMonotonic(t *testing.T) {
+	coarse := NewWithCompression(5)
+	for _, x := range NormalData[:10000] {
+		coarse.Add(x, 1)
+	}
+	for name, td := range map[string]*TDigest{
+		"normal":  NormalDigest,
+		"uniform": UniformDigest,
+		"coarse":  coarse,
+		"decayed": simpleTDigest(10000),
+		"empty":   New(),
+	} {
+		if !td.IsMonotonic(10000) {
+			t.Errorf("%s: quantiles decrease", name)
+		}
+	}
+	if !NormalDigest.IsMonotonic(0) {
+		t.Errorf("zero steps reported a decrease")
+	}
+
+	corrupt := coarse.Clone()
+	corrupt.processed[1].Mean, corrupt.processed[2].Mean = corrupt.processed[2].Mean, corrupt.processed[1].Mean
+	if corrupt.IsMonotonic(10000) {
+		t.Errorf("unsorted centroids not detected")
+	}
+}
+
+func TestQuantileUpperTail(t *testing.T) {
+	// Two centroids, {3, 5} and {8, 5}, with midpoints at ranks 2.5 and 7.5
+	// of 10. Past the last midpoint the quantile runs linearly from its mean
+	// to the maximum, mirroring the lower tail, rather than jumping to it.
+	td := NewWithCompression(2)
+	for i := 1; i <= 10; i++ {
+		td.Add(float64(i), 1)
+	}
+	td.ProcessNow()
+	if got := td.processed; !reflect.DeepEqual(got, CentroidList{{Mean: 3, Weight: 5}, {Mean: 8, Weight: 5}}) {
+		t.Fatalf("unexpected centroids %v", got)
+	}
+	for _, tt := range []struct{ q, want float64 }{
+		{0.75, 8},
+		{0.8, 8.4},
+		{0.9, 9.2},
+		{0.95, 9.6},
+		{0.99, 9.92},
+		{1, 10},
+	} {
+		if got := td.Quantile(tt.q); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("quantile %g: got %g want %g", tt.q, got, tt.want)
+		}
+		if got := td.Quantile(1 - tt.q); math.Abs(got-(11-tt.want)) > 1e-12 {
+			t.Errorf("quantile %g: got %g want %g, mirroring the upper tail", 1-tt.q, got, 11-tt.want)
+		}
+	}
+}
+
+func TestQuantileBreakpoints(t *testing.T) {
+	qs, values := NormalDigest.QuantileBreakpoints()
+	if len(qs) != len(values) || len(qs) != NormalDigest.processed.Len()+2 {
+		t.Fatalf("unexpected lengths, got %d and %d for %d centroids", len(qs), len(values), NormalDigest.processed.Len())
+	}
+	if qs[0] != 0 || qs[len(qs)-1] != 1 || values[0] != NormalDigest.Min() || values[len(values)-1] != NormalDigest.Max() {
+		t.Errorf("unexpected end points, got (%g, %g) and (%g, %g)", qs[0], values[0], qs[len(qs)-1], values[len(values)-1])
+	}
+	for i := 1; i < len(qs); i++ {
+		if qs[i] <= qs[i-1] || values[i] < values[i-1] {
+			t.Fatalf("breakpoints not increasing at %d", i)
+		}
+	}
+
+	// Linear interpolation between the breakpoints is the quantile function,
+	// including in both tails. The coarse digest's outer centroids hold many
+	// values, so its tails span a wide range of quantiles.
+	coarse := NewWithCompression(5)
+	for i := 1; i <= 100; i++ {
+		coarse.Add(float64(i), 1)
+	}
+	rng := rand.New(rand.NewSource(7))
+	for _, td := range []*TDigest{NormalDigest, coarse} {
+		qs, values := td.QuantileBreakpoints()
+		for i := 0; i < 10000; i++ {
+			q := rng.Float64()
+			if i%2 == 0 {
+				q = math.Pow(q, 8)
+			} else {
+				q = 1 - math.Pow(q, 8)
+			}
+			j := sort.SearchFloat64s(qs, q)
+			if j == 0 {
+				j = 1
+			}
+			f := (q - qs[j-1]) / (qs[j] - qs[j-1])
+			want := td.Quantile(q)
+			if got := values[j-1] + f*(values[j]-values[j-1]); math.Abs(got-want) > 1e-9 {
+				t.Fatalf("quantile %g: got %g want %g", q, got, want)
+			}
+		}
+	}
+
+	single := New()
+	single.Add(3, 5)
+	if qs, values := single.QuantileBreakpoints(); len(qs) != 2 || values[0] != 3 || values[1] != 3 {
+		t.Errorf("unexpected single centroid breakpoints, got %v %v", qs, values)
+	}
+	if qs, values := New().QuantileBreakpoints(); qs != nil || values != nil {
+		t.Errorf("unexpected empty breakpoints, got %v %v", qs, values)
+	}
+}
+
+func TestQuantileHD(t *testing.T) {
+	// For small normal samples, Harrell-Davis has a lower mean squared
+	// error than the plain estimate.
+	src := rand.New(rand.NewSource(1))
+	norm := distuv.Normal{Mu: 0, Sigma: 1}
+	for _, q := range []float64{0.5, 0.9} {
+		want := norm.Quantile(q)
+		var plain, hd float64
+		for trial := 0; trial < 1000; trial++ {
+			td := New()
+			for i := 0; i < 15; i++ {
+				td.Add(src.NormFloat64(), 1)
+			}
+			plain += math.Pow(td.Quantile(q)-want, 2)
+			hd += math.Pow(td.QuantileHD(q)-want, 2)
+		}
+		if hd >= plain {
+			t.Errorf("quantile %g: Harrell-Davis error %g not below plain %g", q, hd/1000, plain/1000)
+		}
+	}
+
+	small := New()
+	for _, x := range NormalData[:50] {
+		small.Add(x, 1)
+	}
+	prev := math.Inf(-1)
+	for q := 0.0; q <= 1; q += 0.01 {
+		v := small.QuantileHD(q)
+		if v < prev || v < small.Min() || v > small.Max() {
+			t.Fatalf("quantile %g: got %g after %g, range [%g, %g]", q, v, prev, small.Min(), small.Max())
+		}
+		prev = v
+	}
+	if small.QuantileHD(0) != small.Min() || small.QuantileHD(1) != small.Max() {
+		t.Errorf("extreme quantiles are not the extremes")
+	}
+
+	for _, q := range []float64{0.01, 0.5, 0.99} {
+		if got, want := NormalDigest.QuantileHD(q), NormalDigest.Quantile(q); got != want {
+			t.Errorf("large digest quantile %g: got %g want %g", q, got, want)
+		}
+	}
+	lone := New()
+	lone.Add(7, 3)
+	if got := lone.QuantileHD(0.3); got != 7 {
+		t.Errorf("lone value: got %g want 7", got)
+	}
+	if !math.IsNaN(New().QuantileHD(0.5)) || !math.IsNaN(small.QuantileHD(math.NaN())) || !math.IsNaN(small.QuantileHD(1.1)) {
+		t.Errorf("expected NaN for an empty digest or invalid quantile")
+	}
+}
+
+func TestQuantileCubic(t *testing.T) {
+	coarse := NewWithCompression(20)
+	for _, x := range NormalData {
+		coarse.Add(x, 1)
+	}
+	for _, td := range []*TDigest{NormalDigest, coarse} {
+		qs, values := td.QuantileBreakpoints()
+		for i, q := range qs {
+			if got := td.QuantileCubic(q); math.Abs(got-values[i]) > 1e-9 {
+				t.Errorf("breakpoint %d: got %g want %g", i, got, values[i])
+			}
+		}
+		prev := math.Inf(-1)
+		for i := 0; i <= 100000; i++ {
+			q := float64(i) / 100000
+			got := td.QuantileCubic(q)
+			if got < prev {
+				t.Fatalf("quantile %g decreased, got %g after %g", q, got, prev)
+			}
+			prev = got
+			j := sort.SearchFloat64s(qs, q)
+			if j > 0 && (got < values[j-1] || got > values[j]) {
+				t.Fatalf("quantile %g: %g outside [%g, %g]", q, got, values[j-1], values[j])
+			}
+		}
+	}
+
+	// On smooth data the curve between the coarse centroids tracks the
+	// finer estimate more closely than straight lines do.
+	var linear, cubic float64
+	for i := 1; i < 1000; i++ {
+		q := float64(i) / 1000
+		want := NormalDigest.Quantile(q)
+		linear += math.Abs(coarse.Quantile(q) - want)
+		cubic += math.Abs(coarse.QuantileCubic(q) - want)
+	}
+	if cubic >= linear {
+		t.Errorf("cubic interpolation no closer, error %g, linear %g", cubic, linear)
+	}
+
+	single := New()
+	single.Add(3, 2)
+	for _, tt := range []struct {
+		name   string
+		digest *TDigest
+		q      float64
+		want   float64
+	}{
+		{"single", single, 0.7, 3},
+		{"empty", New(), 0.5, math.NaN()},
+		{"below", coarse, -0.1, math.NaN()},
+		{"above", coarse, 1.1, math.NaN()},
+		{"NaN", coarse, math.NaN(), math.NaN()},
+	} {
+		if got := tt.digest.QuantileCubic(tt.q); got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) {
+			t.Errorf("%s: got %g want %g", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExtremeMagnitudes(t *testing.T) {
+	tests := []struct {
+		name string
+		data []float64
+	}{
+		{name: "large", data: []float64{math.MaxFloat64 / 2, math.MaxFloat64 / 2, math.MaxFloat64 / 4}},
+		{name: "large both signs", data: []float64{math.MaxFloat64 / 2, -math.MaxFloat64 / 2, math.MaxFloat64, -math.MaxFloat64, 0}},
+		{name: "subnormal", data: []float64{math.SmallestNonzeroFloat64, 2 * math.SmallestNonzeroFloat64, 0, -math.SmallestNonzeroFloat64}},
+		{name: "mixed", data: []float64{math.SmallestNonzeroFloat64, math.MaxFloat64 / 2, 1, -math.MaxFloat64 / 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A small compression forces extreme values into shared centroids.
+			td := NewWithCompression(1)
+			for i := 0; i < 100; i++ {
+				for _, x := range tt.data {
+					td.Add(x, float64(i+1))
+				}
+			}
+			td.ProcessNow()
+			for i, c := range td.processed {
+				if math.IsNaN(c.Mean) || math.IsInf(c.Mean, 0) {
+					t.Fatalf("centroid %d has invalid mean %g", i, c.Mean)
+				}
+			}
+			prev := math.Inf(-1)
+			for q := 0.0; q <= 1; q += 0.01 {
+				v := td.Quantile(q)
+				if math.IsNaN(v) || math.IsInf(v, 0) || v < prev {
+					t.Fatalf("invalid quantile %g: %g after %g", q, v, prev)
+				}
+				prev = v
+			}
+			for _, x := range tt.data {
+				if c := td.CDF(x); math.IsNaN(c) || c < 0 || c > 1 {
+					t.Errorf("invalid CDF(%g) = %g", x, c)
+				}
+			}
+		})
+	}
+}
+
+func TestSurvival(t *testing.T) {
+	for _, x := range []float64{-1, 0, 10, 50, 90, 99.9, 100, 101} {
+		want := 1 - UniformDigest.CDF(x)
+		if got := UniformDigest.Survival(x); math.Abs(got-want) > 1e-12 {
+			t.Errorf("unexpected survival %g, got %g want %g", x, got, want)
+		}
+	}
+	for _, x := range []float64{0, 5, 10, 15, 20} {
+		want := 1 - NormalDigest.CDF(x)
+		if got := NormalDigest.Survival(x); math.Abs(got-want) > 1e-12 {
+			t.Errorf("unexpected survival %g, got %g want %g", x, got, want)
+		}
+	}
+
+	// A heavy body with a sparse tail: the tail mass is far below float64
+	// resolution near one, so 1 - CDF(x) collapses.
+	td := New()
+	td.Add(0, 1e18)
+	for i := 1; i <= 10; i++ {
+		td.Add(float64(i), 1)
+	}
+	td.ProcessNow()
+	last := td.processed[td.processed.Len()-1]
+	x := (last.Mean + td.max) / 2
+	want := (td.max - x) / (td.max - last.Mean) * last.Weight / td.processedWeight / 2
+	got := td.Survival(x)
+	if math.Abs(got-want) > want*1e-9 {
+		t.Errorf("unexpected tail survival, got %g want %g", got, want)
+	}
+	if naive := 1 - td.CDF(x); math.Abs(naive-want) <= math.Abs(got-want) {
+		t.Errorf("expected Survival to be more precise than 1 - CDF, got %g and %g want %g", got, naive, want)
+	}
+
+	// Pareto counts with alpha 1.5 on a grid of quarter octaves, 1e18 in
+	// all, as a latency histogram would report them.
+	const alpha = 1.5
+	pareto := New()
+	for k := 0; ; k++ {
+		lo, hi := math.Pow(2, float64(k)/4), math.Pow(2, float64(k+1)/4)
+		w := math.Round(1e18 * (math.Pow(lo, -alpha) - math.Pow(hi, -alpha)))
+		if w < 1 {
+			break
+		}
+		pareto.Add(math.Sqrt(lo*hi), w)
+	}
+	pareto.ProcessNow()
+	n := pareto.processed.Len()
+	var above float64
+	for i := n - 1; i >= n/2; i-- {
+		c := pareto.processed[i]
+		want := (above + c.Weight/2) / pareto.processedWeight
+		above += c.Weight
+		if got := pareto.Survival(c.Mean); math.Abs(got-want) > want*1e-12 {
+			t.Errorf("centroid %d: unexpected survival at %g, got %g want %g", i, c.Mean, got, want)
+		}
+	}
+	// Past the last centroid the tail thins out to nothing at the maximum,
+	// far below where 1 - CDF can resolve it.
+	top := pareto.processed[n-1]
+	collapsed := false
+	for f := 1e-2; f > 1e-14; f /= 10 {
+		x := pareto.max - f*(pareto.max-top.Mean)
+		want := (pareto.max - x) / (pareto.max - top.Mean) * top.Weight / pareto.processedWeight / 2
+		if got := pareto.Survival(x); math.Abs(got-want) > want*1e-9 {
+			t.Errorf("unexpected tail survival at %g, got %g want %g", x, got, want)
+		}
+		if pareto.CDF(x) == 1 {
+			collapsed = true
+		}
+	}
+	if !collapsed {
+		t.Errorf("expected 1 - CDF to round to 0 in the far tail")
+	}
+}
+
+func TestDecayBoundary(t *testing.T) {
+	for _, a := range []Algorithm{Merging, Clustering} {
+		quiet := NewWithDecay(100, 0.9, 1000)
+		queried := NewWithDecay(100, 0.9, 1000)
+		quiet.Algorithm, queried.Algorithm = a, a
+		for i, x := range NormalData[:20000] {
+			quiet.Add(x, 1)
+			queried.Add(x, 1)
+			switch i % 37 {
+			case 0:
+				queried.Quantile(0.99)
+			case 11:
+				queried.CDF(Mu)
+			}
+			if (i+1)%1000 != 0 {
+				continue
+			}
+			// Both digests decayed in this Add, so neither has pending values
+			// and their centroids must match however often they were queried.
+			if quiet.unprocessed.Len() != 0 || queried.unprocessed.Len() != 0 {
+				t.Fatalf("%v: add %d: decay left values unprocessed", a, i+1)
+			}
+			if !reflect.DeepEqual(quiet.processed, queried.processed) {
+				t.Fatalf("%v: add %d: centroids diverged", a, i+1)
+			}
+		}
+		for _, q := range []float64{0.01, 0.5, 0.99} {
+			if a, b := quiet.Quantile(q), queried.Quantile(q); a != b {
+				t.Errorf("unexpected quantile %g, got %g and %g", q, a, b)
+			}
+		}
+	}
+
+	// Between boundaries, a query sees the buffered values but leaves the
+	// digest to resume as though it had not looked.
+	quiet := NewWithDecay(50, 0.9, 1<<30)
+	queried := NewWithDecay(50, 0.9, 1<<30)
+	for _, d := range []*TDigest{quiet, queried} {
+		d.KeepExamples(2)
+		d.KeepTimestamps(true)
+	}
+	for i, x := range NormalData[:3000] {
+		quiet.AddAt(x, 1, time.Unix(int64(i), 0))
+		queried.AddAt(x, 1, time.Unix(int64(i), 0))
+		if i%7 != 0 {
+			continue
+		}
+		fresh := NewWithCompression(50)
+		for _, x := range NormalData[:i+1] {
+			fresh.Add(x, 1)
+		}
+		if got, want := queried.Quantile(0.5), fresh.Quantile(0.5); got != want {
+			t.Fatalf("add %d: median %g, want %g", i+1, got, want)
+		}
+	}
+	quiet.ProcessNow()
+	queried.ProcessNow()
+	if !reflect.DeepEqual(quiet.processed, queried.processed) ||
+		!reflect.DeepEqual(quiet.processedExamples, queried.processedExamples) ||
+		!reflect.DeepEqual(quiet.processedTimes, queried.processedTimes) {
+		t.Errorf("centroids diverged after interleaved queries")
+	}
+}
+
+func TestDecayStationary(t *testing.T) {
+	const (
+		cycles = 5000
+		every  = 1000
+	)
+	want := distuv.UnitNormal.Quantile(0.99)
+	src := rand.New(rand.NewSource(5))
+	td := NewWithDecay(100, 0.9, every)
+	var sum float64
+	var samples int
+	for cycle := 0; cycle < cycles; cycle++ {
+		for i := 0; i < every; i++ {
+			td.Add(src.NormFloat64(), 1)
+		}
+		if cycle < 100 || cycle%10 != 0 {
+			continue
+		}
+		// The window holds about 9000 samples, whose p99 alone varies by
+		// about 0.04.
+		got := td.Quantile(0.99)
+		if math.Abs(got-want) > 0.2 {
+			t.Fatalf("cycle %d: p99 %g strayed from %g", cycle, got, want)
+		}
+		sum += got
+		samples++
+
+		// By now the weight has converged to every*0.9/(1-0.9).
+		if w := td.processedWeight; cycle >= 400 && math.Abs(w-9000) > 1e-6 {
+			t.Fatalf("cycle %d: unexpected total weight %g", cycle, w)
+		}
+	}
+	if mean := sum / float64(samples); math.Abs(mean-want) > 0.01 {
+		t.Errorf("p99 drifted over %d decay cycles, mean %g want %g", cycles, mean, want)
+	}
+}
+
+func TestWindowedDecayCount(t *testing.T) {
+	td := NewWithWindowedDecay(100, 0.9, 1000)
+	for i, x := range UniformData[:100000] {
+		td.Add(x, 1)
+		if i < 90000 || (i+1)%1000 != 0 {
+			continue
+		}
+		// Just after a decay the count is at the bottom of its range.
+		if got := td.Count(); got < 8990 || got > 9000 {
+			t.Fatalf("add %d: unexpected steady-state count, got %d want 9000", i+1, got)
+		}
+		if w := td.processedWeight; math.Abs(w-float64(td.Count())) > 1 {
+			t.Errorf("add %d: count %d does not track total weight %g", i+1, td.Count(), w)
+		}
+	}
+	before := td.Count()
+	td.Add(1, 1)
+	if got := td.Count(); got != before+1 {
+		t.Errorf("unexpected count between decays, got %d want %d", got, before+1)
+	}
+
+	plain := NewWithDecay(100, 0.9, 1000)
+	for _, x := range UniformData[:100000] {
+		plain.Add(x, 1)
+	}
+	if got := plain.Count(); got != 100000 {
+		t.Errorf("unexpected count without windowed decay, got %d want 100000", got)
+	}
+}
+
+func TestResolutionProfile(t *testing.T) {
+	profile := UniformDigest.ResolutionProfile()
+	if len(profile) != UniformDigest.processed.Len() {
+		t.Fatalf("expected one entry per centroid, got %d want %d", len(profile), UniformDigest.processed.Len())
+	}
+	var sum float64
+	for _, f := range profile {
+		sum += f
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		t.Errorf("profile does not sum to one, got %g", sum)
+	}
+	middle := profile[len(profile)/2]
+	if profile[0] >= middle || profile[len(profile)-1] >= middle {
+		t.Errorf("expected K1 to give tail centroids less of the range than the middle, got %g, %g, %g",
+			profile[0], middle, profile[len(profile)-1])
+	}
+	if got := New().ResolutionProfile(); len(got) != 0 {
+		t.Errorf("unexpected profile of empty digest, got %v", got)
+	}
+}
+
+func TestWeightBeyond2to53(t *testing.T) {
+	// Each process adds an odd batch weight to a total above 2^53, where it
+	// cannot be represented exactly.
+	td := NewWithCompression(100)
+	heavy := math.Pow(2, 53)
+	td.Add(-1, heavy)
+	n := 20 * (td.maxUnprocessed + 1)
+	for i := 0; i < n; i++ {
+		td.Add(float64(i%(n/20))*100/float64(n/20), 1)
+	}
+	td.ProcessNow()
+
+	if got := td.cumulative[len(td.cumulative)-1]; got != td.processedWeight {
+		t.Errorf("total weight %v disagrees with cumulative weight %v", td.processedWeight, got)
+	}
+	// The median of the unit-weight values sits n/2 below the top.
+	q := 1 - float64(n/2)/(heavy+float64(n))
+	if got := td.Quantile(q); math.Abs(got-50) > 1 {
+		t.Errorf("unexpected quantile %v, got %g want 50", q, got)
+	}
+}
+
+// linearScaler gives every centroid the same share of the weight.
+type linearScaler struct{}
+
+func (*linearScaler) integratedQ(k, compression float64) float64 {
+	return math.Min(k, compression) / compression
+}
+
+func (*linearScaler) integratedLocation(q, compression float64) float64 {
+	return q * compression
+}
+
+func (*linearScaler) MaxCentroids(compression, n float64) int {
+	return (&K1{}).MaxCentroids(compression, n)
+}
+
+func TestRescaleWith(t *testing.T) {
+	src := NewWithCompression(200)
+	for _, x := range NormalData {
+		src.Add(x, 1)
+	}
+	before := src.processed.Len()
+
+	same := src.RescaleWith(&K1{})
+	linear := src.RescaleWith(&linearScaler{})
+	if src.processed.Len() != before {
+		t.Errorf("source digest was modified")
+	}
+	if _, ok := linear.Scaler.(*linearScaler); !ok {
+		t.Errorf("unexpected scaler %T", linear.Scaler)
+	}
+	for _, td := range []*TDigest{same, linear} {
+		if td.Count() != src.Count() || td.Min() != src.Min() || td.Max() != src.Max() {
+			t.Errorf("unexpected summary, got count %d range [%g, %g]", td.Count(), td.Min(), td.Max())
+		}
+		if got := td.processedWeight; got != N {
+			t.Errorf("unexpected total weight, got %g want %g", got, float64(N))
+		}
+	}
+	if got := same.processed.Len(); got > before {
+		t.Errorf("re-clustering under the same scaler grew the digest, got %d centroids want at most %d", got, before)
+	}
+	for _, q := range []float64{0.1, 0.5, 0.9} {
+		want := src.Quantile(q)
+		if got := linear.Quantile(q); math.Abs(got-want) > 0.01*Sigma {
+			t.Errorf("unexpected quantile %g under linear scaler, got %g want %g", q, got, want)
+		}
+	}
+	// A linear scaler gives up the tails' resolution.
+	if got, want := math.Abs(linear.Quantile(0.0001)-src.Quantile(0.0001)), 0.01*Sigma; got < want {
+		t.Errorf("expected a coarser tail under the linear scaler, error %g", got)
+	}
+}
+
+func TestAccuracyWarning(t *testing.T) {
+	if msg, warn := NormalDigest.AccuracyWarning(); warn || msg != "" {
+		t.Errorf("unexpected warning at compression %g: %q", NormalDigest.Compression, msg)
+	}
+	low := NewWithCompression(50)
+	for _, x := range NormalData[:1000] {
+		low.Add(x, 1)
+	}
+	if _, warn := low.AccuracyWarning(); warn {
+		t.Errorf("unexpected warning for a small digest")
+	}
+	for _, x := range NormalData[1000:] {
+		low.Add(x, 1)
+	}
+	msg, warn := low.AccuracyWarning()
+	if !warn || !strings.Contains(msg, "compression 50 ") || !strings.Contains(msg, "compression 158 or more") {
+		t.Fatalf("unexpected warning %q, %v", msg, warn)
+	}
+
+	// The suggested compression is the lowest that clears the warning.
+	for _, tt := range []struct {
+		compression float64
+		warn        bool
+	}{{157, true}, {158, false}} {
+		td := NewWithCompression(tt.compression)
+		td.AddRepeated(1, N)
+		if _, warn := td.AccuracyWarning(); warn != tt.warn {
+			t.Errorf("compression %g: got warning %v want %v", tt.compression, warn, tt.warn)
+		}
+	}
+}
+
+func TestFewerSamplesThanCompression(t *testing.T) {
+	// Below the compression every value keeps its own centroid, so quantiles
+	// interpolate between the exact order statistics from the first add.
+	for _, n := range []int{1, 2, 10, 99} {
+		td := NewWithCompression(100)
+		sorted := append([]float64(nil), NormalData[:n]...)
+		for _, x := range sorted {
+			td.Add(x, 1)
+		}
+		sort.Float64s(sorted)
+		td.ProcessNow()
+		if td.processed.Len() != n {
+			t.Errorf("n=%d: %d centroids", n, td.processed.Len())
+		}
+		if !td.IsMonotonic(1000) {
+			t.Errorf("n=%d: quantiles not monotonic", n)
+		}
+		for _, q := range []float64{0, 0.1, 0.5, 0.9, 1} {
+			// Each value is centred on rank i+0.5, so rank q*n falls between
+			// the two values either side of it.
+			r := q*float64(n) - 0.5
+			lo, hi := sorted[int(math.Max(0, math.Floor(r)))], sorted[int(math.Min(float64(n-1), math.Ceil(r)))]
+			if got := td.Quantile(q); got < math.Min(lo, hi) || got > math.Max(lo, hi) {
+				t.Errorf("n=%d: quantile %g is %g, outside [%g, %g]", n, q, got, lo, hi)
+			}
+		}
+	}
+}
+
+func TestMaxCentroids(t *testing.T) {
+	sorted := append([]float64(nil), NormalData...)
+	sort.Float64s(sorted)
+	for _, compression := range []float64{10, 33.3, 100, 500} {
+		for name, data := range map[string][]float64{"normal": NormalData, "uniform": UniformData, "sorted": sorted} {
+			for _, algorithm := range []Algorithm{Merging, Clustering} {
+				td := NewWithAlgorithm(compression, algorithm)
+				for _, x := range data[:200000] {
+					td.Add(x, 1)
+				}
+				td.ProcessNow()
+				if bound := td.Scaler.MaxCentroids(compression, 200000); td.processed.Len() > bound {
+					t.Errorf("%s %s at %g: %d centroids, bound %d", name, algorithm, compression, td.processed.Len(), bound)
+				}
+			}
+		}
+	}
+	for _, tt := range []struct {
+		compression, n float64
+		want           int
+	}{
+		{100, math.Inf(1), 200},
+		{33.3, math.Inf(1), 68},
+		{100, 50, 50},
+		{100, 0.5, 1},
+		{100, 0, 0},
+	} {
+		if got := (&K1{}).MaxCentroids(tt.compression, tt.n); got != tt.want {
+			t.Errorf("MaxCentroids(%g, %g): got %d want %d", tt.compression, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestScalerByName(t *testing.T) {
+	names := AvailableScalers()
+	if len(names) == 0 || names[0] != "k1" {
+		t.Errorf("unexpected scalers %v", names)
+	}
+	for _, name := range names {
+		s, err := ScalerByName(name)
+		if err != nil || s == nil {
+			t.Errorf("available scaler %q not constructible: %v", name, err)
+		}
+	}
+	if s, _ := ScalerByName("k1"); s != nil {
+		if _, ok := s.(*K1); !ok {
+			t.Errorf("unexpected scaler for k1, got %T", s)
+		}
+	}
+	if _, err := ScalerByName("k9"); err != ErrUnknownScaler {
+		t.Errorf("unexpected err, got %v want %v", err, ErrUnknownScaler)
+	}
+}
+
+func TestCloneInto(t *testing.T) {
+	src := simpleTDigest(1000)
+	src.KeepExamples(2)
+	for i := 0; i < 100; i++ {
+		src.Add(float64(i), 1)
+	}
+
+	dst := New()
+	for _, x := range UniformData[:20000] {
+		dst.Add(x, 1)
+	}
+	src.CloneInto(dst)
+	if !reflect.DeepEqual(src, dst) {
+		t.Errorf("CloneInto did not produce an equal digest")
+	}
+	if !reflect.DeepEqual(src.Clone(), dst) {
+		t.Errorf("CloneInto and Clone disagree")
+	}
+
+	i := 0
+	for len(dst.processedExamples[i]) == 0 {
+		i++
+	}
+	dst.processedExamples[i][0] = -100
+	dst.Add(-5, 1)
+	dst.ProcessNow()
+	if src.Min() == -5 || src.processedExamples[i][0] == -100 {
+		t.Errorf("CloneInto shares state with the source")
+	}
+}
+
+func BenchmarkCloneInto(b *testing.B) {
+	src := NewWithCompression(benchmarkCompression)
+	for _, x := range NormalData[:100000] {
+		src.Add(x, 1)
+	}
+	dst := src.Clone()
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		src.CloneInto(dst)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	for n := 0; n < 40; n++ {
+		cumulative := make([]float64, n)
+		l := make(CentroidList, n)
+		for i := range cumulative {
+			cumulative[i] = float64(i / 3)
+			l[i].Mean = float64(i / 3)
+		}
+		for x := -1.0; x <= float64(n/3)+1; x += 0.5 {
+			if got, want := searchCumulative(cumulative, x), sort.SearchFloat64s(cumulative, x); got != want {
+				t.Errorf("searchCumulative(%d values, %g) = %d, want %d", n, x, got, want)
+			}
+			want := sort.Search(n, func(i int) bool { return l[i].Mean > x })
+			if got := searchMeans(l, x); got != want {
+				t.Errorf("searchMeans(%d values, %g) = %d, want %d", n, x, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkSearch(b *testing.B) {
+	td := NewWithCompression(1000)
+	for _, x := range NormalData {
+		td.Add(x, 1)
+	}
+	td.ProcessNow()
+	xs := make([]float64, 1024)
+	qs := make([]float64, len(xs))
+	for i := range xs {
+		xs[i] = NormalData[i]
+		qs[i] = UniformData[i] / 100
+	}
+
+	b.Run("CDF", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			td.CDF(xs[i%len(xs)])
+		}
+	})
+	b.Run("Quantile", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			td.quantile(qs[i%len(qs)])
+		}
+	})
+
+	// The searches alone, against the sort.Search calls they replaced.
+	indices := make([]float64, len(qs))
+	for i, q := range qs {
+		indices[i] = q * td.processedWeight
+	}
+	var sink int
+	b.Run("searchCumulative", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sink += searchCumulative(td.cumulative, indices[i%len(indices)])
+		}
+	})
+	b.Run("sort.Search/cumulative", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			index := indices[i%len(indices)]
+			sink += sort.Search(len(td.cumulative), func(j int) bool {
+				return td.cumulative[j] >= index
+			})
+		}
+	})
+	b.Run("searchMeans", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sink += searchMeans(td.processed, xs[i%len(xs)])
+		}
+	})
+	b.Run("sort.Search/means", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			x := xs[i%len(xs)]
+			sink += sort.Search(td.processed.Len(), func(j int) bool {
+				return td.processed[j].Mean > x
+			})
+		}
+	})
+	_ = sink
+}
+
+func TestMergeThreshold(t *testing.T) {
+	// centroids counts the centroids starting below the 1st percentile and
+	// between the 40th and 60th.
+	centroids := func(compression, threshold float64) (tail, body int) {
+		td := NewWithCompression(compression)
+		td.MergeThreshold = threshold
+		for _, x := range NormalData {
+			td.Add(x, 1)
+		}
+		td.ProcessNow()
+		for i := range td.processed {
+			q := (td.cumulative[i] - td.processed[i].Weight/2) / td.processedWeight
+			switch {
+			case q < 0.01:
+				tail++
+			case q >= 0.4 && q < 0.6:
+				body++
+			}
+		}
+		return tail, body
+	}
+
+	baseTail, baseBody := centroids(500, 0)
+	tail, body := centroids(500, 4)
+	if math.Abs(float64(tail-baseTail)) > 0.1*float64(baseTail) {
+		t.Errorf("threshold changed the tail, got %d centroids want about %d", tail, baseTail)
+	}
+	if body > baseBody/2 {
+		t.Errorf("threshold did not merge the body, got %d centroids want at most %d", body, baseBody/2)
+	}
+
+	tail, body = centroids(1000, 2)
+	if tail < baseTail*3/2 {
+		t.Errorf("compression did not add tail centroids, got %d want at least %d", tail, baseTail*3/2)
+	}
+	if math.Abs(float64(body-baseBody)) > 0.2*float64(baseBody) {
+		t.Errorf("threshold did not keep the body merged, got %d centroids want about %d", body, baseBody)
+	}
+}
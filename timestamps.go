@@ -0,0 +1,117 @@
+package tdigest
+
+import (
+	"math"
+	"time"
+)
+
+// KeepTimestamps makes each centroid record when its values were added, so
+// that EvictBefore can drop old data without a decay schedule. A centroid's
+// timestamp is the weighted mean of the times of the values merged into it.
+// Centroids present before the call are stamped with the current time. The
+// timestamps are serialized by MarshalBinary, in a format that older readers
+// reject. Passing false drops them.
+func (t *TDigest) KeepTimestamps(keep bool) {
+	t.resumePending()
+	if !keep {
+		t.keepTimes = false
+		t.processedTimes = nil
+		t.unprocessedTimes = nil
+		return
+	}
+	if t.keepTimes {
+		return
+	}
+	t.keepTimes = true
+	now := time.Now().UnixNano()
+	t.processedTimes = appendTimes(t.processedTimes[:0], nil, t.processed.Len(), now)
+	t.unprocessedTimes = appendTimes(t.unprocessedTimes[:0], nil, t.unprocessed.Len(), now)
+}
+
+// AddAt is like Add but stamps the value with at rather than the current
+// time, for replaying or backfilling timestamped data. The time is ignored
+// unless KeepTimestamps is enabled.
+func (t *TDigest) AddAt(x, w float64, at time.Time) {
+	t.stampAt, t.stampSet = at.UnixNano(), true
+	t.Add(x, w)
+	t.stampSet = false
+}
+
+// EvictBefore removes the centroids stamped before cutoff, subtracting their
+// weight from the digest, and returns the weight removed. A centroid holds
+// values of mixed ages, so it is kept or removed whole by the weighted mean
+// of their times; with a handful of values per centroid at the tails and
+// many in the body, eviction is exact only at the granularity the digest
+// itself keeps. Min and Max become the extreme remaining centroid means. It
+// does nothing unless KeepTimestamps is enabled.
+func (t *TDigest) EvictBefore(cutoff time.Time) float64 {
+	if !t.keepTimes {
+		return 0
+	}
+	t.process()
+	limit := cutoff.UnixNano()
+	var evicted compensatedSum
+	kept := 0
+	for i, c := range t.processed {
+		if t.processedTimes[i] < limit {
+			evicted.add(c.Weight)
+			continue
+		}
+		t.processed[kept] = c
+		t.processedTimes[kept] = t.processedTimes[i]
+		if len(t.processedExamples) > i {
+			t.processedExamples[kept] = t.processedExamples[i]
+		}
+		kept++
+	}
+	if kept == t.processed.Len() {
+		return 0
+	}
+	t.processed = t.processed[:kept]
+	t.processedTimes = t.processedTimes[:kept]
+	if len(t.processedExamples) > kept {
+		t.processedExamples = t.processedExamples[:kept]
+	}
+	if kept > 0 {
+		t.min = t.processed[0].Mean
+		t.max = t.processed[kept-1].Mean
+	} else {
+		t.min = math.MaxFloat64
+		t.max = -math.MaxFloat64
+	}
+	t.processedWeight = sumWeights(t.processed)
+	t.count -= int64(math.Round(evicted.value()))
+	if t.count < 0 || kept == 0 {
+		t.count = 0
+	}
+	t.updateCumulative()
+	t.invalidateQuantiles()
+	t.checkAlerts()
+	return evicted.value()
+}
+
+// stamp returns the time to record for a value being added now.
+func (t *TDigest) stamp() int64 {
+	if t.stampSet {
+		return t.stampAt
+	}
+	return time.Now().UnixNano()
+}
+
+// mergeTimes returns the weighted mean of times a and b, computed from their
+// difference so that it cannot overflow.
+func mergeTimes(a int64, wa float64, b int64, wb float64) int64 {
+	return a + int64(float64(b-a)*(wb/(wa+wb)))
+}
+
+// appendTimes appends times to dst for n centroids, or now for each of them
+// if times is nil because the centroids were not stamped.
+func appendTimes(dst, times []int64, n int, now int64) []int64 {
+	if times != nil {
+		return append(dst, times...)
+	}
+	for i := 0; i < n; i++ {
+		dst = append(dst, now)
+	}
+	return dst
+}
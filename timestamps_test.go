@@ -0,0 +1,130 @@
+package tdigest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEvictBefore(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	td := NewWithCompression(100)
+	td.KeepTimestamps(true)
+	// An hour of slow values followed by an hour of fast ones.
+	for i := 0; i < 3600; i++ {
+		td.AddAt(1000+float64(i%100), 1, start.Add(time.Duration(i)*time.Second))
+	}
+	for i := 3600; i < 7200; i++ {
+		td.AddAt(float64(i%100), 1, start.Add(time.Duration(i)*time.Second))
+	}
+	if got := td.Quantile(0.9); got < 1000 {
+		t.Fatalf("p90 before eviction: %g", got)
+	}
+
+	// The centroid bridging the two ranges holds values of both ages, so
+	// eviction is only approximately the first hour.
+	evicted := td.EvictBefore(start.Add(time.Hour))
+	if evicted < 3500 || evicted > 3700 {
+		t.Errorf("evicted %g, want about 3600", evicted)
+	}
+	if want := 7200 - int64(evicted+0.5); td.Count() != want {
+		t.Errorf("count %d after eviction, want %d", td.Count(), want)
+	}
+	if got := td.Quantile(0.9); got > 100 {
+		t.Errorf("p90 after eviction: %g", got)
+	}
+	if td.Max() >= 100 {
+		t.Errorf("max %g after eviction", td.Max())
+	}
+	if !td.IsMonotonic(100) {
+		t.Error("quantiles not monotonic after eviction")
+	}
+
+	if got := td.EvictBefore(start.Add(time.Hour)); got != 0 {
+		t.Errorf("second eviction removed %g", got)
+	}
+	td.EvictBefore(start.Add(3 * time.Hour))
+	if td.Count() != 0 || td.processed.Len() != 0 {
+		t.Errorf("count %d, %d centroids after evicting everything", td.Count(), td.processed.Len())
+	}
+
+	plain := NewWithCompression(100)
+	plain.Add(1, 1)
+	if got := plain.EvictBefore(time.Now().Add(time.Hour)); got != 0 || plain.Count() != 1 {
+		t.Errorf("evicted %g without timestamps", got)
+	}
+}
+
+func TestTimestampsFollowMerges(t *testing.T) {
+	old := time.Unix(1000, 0)
+	td := NewWithCompression(50)
+	td.KeepTimestamps(true)
+	for i := 0; i < 1000; i++ {
+		td.AddAt(float64(i), 1, old)
+	}
+	// Stamps from a digest without timestamps are the time of the merge.
+	other := NewWithCompression(50)
+	for i := 0; i < 1000; i++ {
+		other.Add(float64(5000+i), 1)
+	}
+	td.Merge(other)
+	tail := td.Clone()
+	tail.MergePreferTail(other, 0.9)
+
+	for name, d := range map[string]*TDigest{"merge": td, "prefer tail": tail} {
+		d.ProcessNow()
+		if len(d.processedTimes) != d.processed.Len() {
+			t.Fatalf("%s: %d times for %d centroids", name, len(d.processedTimes), d.processed.Len())
+		}
+		d.EvictBefore(old.Add(time.Second))
+		if d.Min() < 1000 {
+			t.Errorf("%s: min %g after evicting the old values", name, d.Min())
+		}
+	}
+
+	clustered := NewWithCompression(50)
+	clustered.Algorithm = Clustering
+	clustered.KeepTimestamps(true)
+	for i := 0; i < 1000; i++ {
+		clustered.AddAt(float64(i), 1, old.Add(time.Duration(i)*time.Second))
+	}
+	clustered.ProcessNow()
+	if len(clustered.processedTimes) != clustered.processed.Len() {
+		t.Fatalf("clustering: %d times for %d centroids", len(clustered.processedTimes), clustered.processed.Len())
+	}
+	clustered.EvictBefore(old.Add(500 * time.Second))
+	if got := clustered.Quantile(0.1); got < 400 {
+		t.Errorf("clustering: p10 %g after eviction", got)
+	}
+}
+
+func TestTimestampsRoundTrip(t *testing.T) {
+	td := NewWithCompression(100)
+	td.KeepTimestamps(true)
+	for i := 0; i < 1000; i++ {
+		td.AddAt(float64(i), 1, time.Unix(int64(i), 0))
+	}
+	b, err := td.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(TDigest)
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.processedTimes, td.processedTimes) || !got.keepTimes {
+		t.Errorf("timestamps did not round trip")
+	}
+	if c := td.Clone(); !reflect.DeepEqual(c.processedTimes, td.processedTimes) {
+		t.Errorf("clone did not copy timestamps")
+	}
+
+	td.KeepTimestamps(false)
+	b, err = td.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 70+24*td.processed.Len() {
+		t.Errorf("encoding without timestamps is %d bytes", len(b))
+	}
+}
@@ -0,0 +1,73 @@
+package tdigest
+
+import "math"
+
+// quantileTracker is the running estimate kept by AddAndTrack.
+type quantileTracker struct {
+	q       float64
+	value   float64
+	density float64 // estimated density at value, per unit of total weight
+	weight  float64 // total weight the estimate accounts for
+}
+
+// AddAndTrack adds v with weight 1 and returns an estimate of quantile q that
+// includes it, without processing the buffered values on every call.
+//
+// Whenever the add flushes the buffer, the estimate is reset to Quantile(q).
+// In between, each value nudges the estimate up or down by the distance that
+// moves q by one sample under the density at the estimate, a stochastic
+// approximation step that keeps each call O(1). The estimate therefore lags a
+// full recompute by at most a buffer's worth of adds, where the density may
+// have drifted; at compression 1000 it typically agrees with Quantile(q) to
+// well within the digest's own error. Calling it with a different q, or after
+// values were added by other means, pays for one full recompute.
+func (t *TDigest) AddAndTrack(v float64, q float64) float64 {
+	tr := &t.tracker
+	if tr.q != q || tr.weight != t.totalWeight() || !(tr.density > 0) {
+		t.Add(v, 1)
+		t.resetTracker(q)
+		return tr.value
+	}
+
+	t.Add(v, 1)
+	if t.unprocessed.Len() == 0 {
+		// the add flushed the buffer, so a fresh quantile is cheap
+		t.resetTracker(q)
+		return tr.value
+	}
+	if !math.IsNaN(v) {
+		below := 0.0
+		if v <= tr.value {
+			below = 1.0
+		}
+		w := t.totalWeight()
+		tr.value += (q - below) / (tr.density * w)
+		tr.value = math.Max(t.min, math.Min(t.max, tr.value))
+	}
+	tr.weight = t.totalWeight()
+	return tr.value
+}
+
+func (t *TDigest) totalWeight() float64 {
+	return t.processedWeight + t.unprocessedWeight
+}
+
+// resetTracker recomputes the tracked quantile q and the density around it
+// from the processed centroids.
+func (t *TDigest) resetTracker(q float64) {
+	t.processForQuery()
+	tr := &t.tracker
+	tr.q = q
+	tr.value = t.Quantile(q)
+	tr.weight = t.totalWeight()
+
+	// Difference the quantile function across about one centroid's share
+	// of the weight either side of q.
+	dq := math.Max(1.0/float64(t.processed.Len()+1), 1.0/t.processedWeight)
+	lo, hi := math.Max(0, q-dq), math.Min(1, q+dq)
+	if width := t.quantile(hi) - t.quantile(lo); width > 0 {
+		tr.density = (hi - lo) / width
+	} else {
+		tr.density = 0
+	}
+}
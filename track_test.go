@@ -0,0 +1,44 @@
+package tdigest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAddAndTrack(t *testing.T) {
+	td, ref := New(), New()
+	var worst float64
+	for i, x := range NormalData[:200000] {
+		got := td.AddAndTrack(x, 0.95)
+		ref.Add(x, 1)
+		if i < 10000 || i%1000 != 0 {
+			continue
+		}
+		worst = math.Max(worst, math.Abs(got-ref.Quantile(0.95)))
+	}
+	if worst > 0.005*Sigma {
+		t.Errorf("tracked quantile strayed from a full recompute by %g", worst)
+	}
+	if td.Count() != ref.Count() {
+		t.Errorf("unexpected count, got %d want %d", td.Count(), ref.Count())
+	}
+
+	// Switching quantiles or adding behind the tracker's back recomputes.
+	if got, want := td.AddAndTrack(Mu, 0.5), td.Quantile(0.5); got != want {
+		t.Errorf("unexpected quantile after switching, got %g want %g", got, want)
+	}
+	for i := 0; i < 100000; i++ {
+		td.Add(Mu+10*Sigma, 1)
+	}
+	if got, want := td.AddAndTrack(Mu, 0.5), td.Quantile(0.5); got != want {
+		t.Errorf("unexpected quantile after untracked adds, got %g want %g", got, want)
+	}
+}
+
+func BenchmarkAddAndTrack(b *testing.B) {
+	td := NewWithCompression(benchmarkCompression)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		td.AddAndTrack(NormalData[i%len(NormalData)], 0.95)
+	}
+}
@@ -0,0 +1,27 @@
+package tdigest
+
+import "math"
+
+// AddSignedLog adds v transformed by sign(v)·log(1+|v|). The transform is
+// defined for every finite value, including zero and negatives, and compresses
+// large magnitudes of either sign, which suits signed heavy-tailed data where
+// a plain logarithm would produce NaN. A digest should hold only transformed
+// or only untransformed values; query it with QuantileSignedLog.
+func (t *TDigest) AddSignedLog(v float64) {
+	t.Add(signedLog(v), 1)
+}
+
+// QuantileSignedLog returns quantile q of a digest built with AddSignedLog,
+// mapped back to the original scale. The transform is monotonic, so this is
+// the quantile of the original values.
+func (t *TDigest) QuantileSignedLog(q float64) float64 {
+	return signedExp(t.Quantile(q))
+}
+
+func signedLog(v float64) float64 {
+	return math.Copysign(math.Log1p(math.Abs(v)), v)
+}
+
+func signedExp(y float64) float64 {
+	return math.Copysign(math.Expm1(math.Abs(y)), y)
+}
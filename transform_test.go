@@ -0,0 +1,31 @@
+package tdigest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAddSignedLog(t *testing.T) {
+	td := New()
+	for _, x := range NormalData {
+		td.AddSignedLog((x - Mu) * 1000)
+	}
+	for _, q := range []float64{0.1, 0.5, 0.9} {
+		want := (NormalDigest.Quantile(q) - Mu) * 1000
+		if got := td.QuantileSignedLog(q); math.Abs(got-want) > 0.001*Sigma*1000 {
+			t.Errorf("unexpected quantile %g, got %g want %g", q, got, want)
+		}
+	}
+	for _, v := range []float64{0, -1, 1, -1e300, 1e300, math.SmallestNonzeroFloat64} {
+		y := signedLog(v)
+		if math.IsNaN(y) || math.IsInf(y, 0) {
+			t.Errorf("signedLog(%g) = %g", v, y)
+		}
+		if got := signedExp(y); math.Abs(got-v) > math.Abs(v)*1e-12 {
+			t.Errorf("signedExp(signedLog(%g)) = %g", v, got)
+		}
+	}
+	if got := New().QuantileSignedLog(0.5); !math.IsNaN(got) {
+		t.Errorf("unexpected quantile of empty digest, got %g want NaN", got)
+	}
+}
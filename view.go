@@ -0,0 +1,105 @@
+package tdigest
+
+import "math"
+
+// MergedView answers queries over the union of several digests without
+// merging them. Each query combines the digests' own cumulative weights, so a
+// view costs no memory beyond its list of digests, but every CDF scans all of
+// them and every Quantile searches over CDFs. It suits infrequent cross-shard
+// queries; merge the digests instead for repeated ones.
+//
+// A view reads its digests without processing them, so it never modifies
+// them. Values still buffered in a digest are counted as exact points rather
+// than merged into its centroids. The digests must not be modified
+// concurrently with a query.
+type MergedView struct {
+	digests []*TDigest
+}
+
+// NewMergedView returns a view over digests, ignoring nil ones. The digests
+// are not copied, so the view reflects values added to them later.
+func NewMergedView(digests ...*TDigest) *MergedView {
+	v := &MergedView{digests: make([]*TDigest, 0, len(digests))}
+	for _, d := range digests {
+		if d != nil {
+			v.digests = append(v.digests, d)
+		}
+	}
+	return v
+}
+
+// Count returns the total count of the digests.
+func (v *MergedView) Count() int64 {
+	var n int64
+	for _, d := range v.digests {
+		n += d.Count()
+	}
+	return n
+}
+
+// CDF returns the estimated fraction of the combined weight at or below x,
+// weighting each digest's CDF by its total weight. It is 0 if the digests are
+// empty. Values outside a digest's range count as in OutOfRangeClamp, whatever
+// the digest's CDFOutOfRange, since another digest may cover them.
+func (v *MergedView) CDF(x float64) float64 {
+	var below, total compensatedSum
+	for _, d := range v.digests {
+		if d.processedWeight > 0 {
+			below.add(d.cdf(x) * d.processedWeight)
+			total.add(d.processedWeight)
+		}
+		for _, c := range d.unprocessed {
+			switch {
+			case c.Mean < x:
+				below.add(c.Weight)
+			case c.Mean == x:
+				below.add(c.Weight / 2)
+			}
+			total.add(c.Weight)
+		}
+	}
+	if !(total.value() > 0) {
+		return 0
+	}
+	return math.Min(1, below.value()/total.value())
+}
+
+// Quantile returns the estimated value at quantile q of the combined weight,
+// the smallest value whose CDF reaches q, found by bisection between the
+// overall Min and Max. It returns NaN if q is outside [0, 1] or the digests
+// are empty.
+func (v *MergedView) Quantile(q float64) float64 {
+	if !(q >= 0 && q <= 1) {
+		return math.NaN()
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, d := range v.digests {
+		if d.processed.Len()+d.unprocessed.Len() > 0 {
+			lo = math.Min(lo, d.min)
+			hi = math.Max(hi, d.max)
+		}
+	}
+	if lo > hi {
+		return math.NaN()
+	}
+	if q == 0 {
+		return lo
+	}
+	if q == 1 {
+		return hi
+	}
+	// Halving reaches adjacent floats within about 2100 steps even across
+	// the whole float64 range, and within about 60 for typical data.
+	for i := 0; i < 2100; i++ {
+		mid := lo/2 + hi/2
+		if mid <= lo || mid >= hi {
+			break
+		}
+		if v.CDF(mid) >= q {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi
+}
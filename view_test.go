@@ -0,0 +1,60 @@
+package tdigest
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestMergedView(t *testing.T) {
+	shards := make([]*TDigest, 4)
+	for i := range shards {
+		shards[i] = NewWithCompression(200)
+		for _, x := range NormalData[i*N/4 : (i+1)*N/4] {
+			shards[i].Add(x, 1)
+		}
+		shards[i].ProcessNow()
+	}
+	// A shard with only buffered values is counted without processing it.
+	pending := NewWithCompression(200)
+	pending.Add(Mu, 1)
+	pending.Add(Mu+1, 1)
+	before := append(CentroidList(nil), pending.unprocessed...)
+
+	v := NewMergedView(append(shards, nil, pending)...)
+	if got, want := v.Count(), int64(N+2); got != want {
+		t.Errorf("unexpected count, got %d want %d", got, want)
+	}
+	merged := MergeBalanced(200, shards...)
+	for _, x := range []float64{Mu - 2*Sigma, Mu, Mu + 3*Sigma} {
+		if got, want := v.CDF(x), merged.CDF(x); math.Abs(got-want) > 1e-3 {
+			t.Errorf("CDF(%g): got %g, merged digest %g", x, got, want)
+		}
+	}
+	for _, q := range []float64{0.001, 0.1, 0.5, 0.99, 0.999} {
+		got, want := v.Quantile(q), merged.Quantile(q)
+		if math.Abs(got-want) > 0.02 {
+			t.Errorf("Quantile(%g): got %g, merged digest %g", q, got, want)
+		}
+		if c := v.CDF(got); math.Abs(c-q) > 1e-9 {
+			t.Errorf("Quantile(%g) = %g is not the inverse of CDF, which gives %g", q, got, c)
+		}
+	}
+	if got := v.Quantile(0); got != merged.Min() {
+		t.Errorf("Quantile(0): got %g want %g", got, merged.Min())
+	}
+	if got := v.Quantile(1); got != merged.Max() {
+		t.Errorf("Quantile(1): got %g want %g", got, merged.Max())
+	}
+	if pending.processed.Len() != 0 || !reflect.DeepEqual(pending.unprocessed, before) {
+		t.Errorf("view modified a digest")
+	}
+
+	empty := NewMergedView(New(), nil)
+	if !math.IsNaN(empty.Quantile(0.5)) || empty.CDF(1) != 0 || empty.Count() != 0 {
+		t.Errorf("unexpected results for an empty view")
+	}
+	if !math.IsNaN(v.Quantile(math.NaN())) || !math.IsNaN(v.Quantile(1.5)) {
+		t.Errorf("invalid quantiles should be NaN")
+	}
+}